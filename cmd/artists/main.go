@@ -0,0 +1,154 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/tracks"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: artists [-config path] command [args]
+
+commands:
+  list                    print the canonical artists and their aliases
+  top <data-id> [n]       print the n most played artists of a channel, 20 by default
+  aliases                 print the alias rules, one "alias<TAB>artist" per line
+  alias <alias> <artist>  credit the tracks of alias to artist
+  unalias <alias>         drop the alias rule
+  load <file>             apply the "alias<TAB>artist" rules of file, - for stdin`
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	ctx := context.Background()
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanup()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		return handleErr(errors.New("no command"))
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		err = printArtists(ctx, r)
+	case args[0] == "top" && (len(args) == 2 || len(args) == 3):
+		n := 20
+		if len(args) == 3 {
+			if n, err = strconv.Atoi(args[2]); err != nil {
+				return handleErr(err)
+			}
+		}
+		err = printTop(ctx, r, args[1], n)
+	case args[0] == "aliases" && len(args) == 1:
+		err = printAliases(ctx, r)
+	case args[0] == "alias" && len(args) == 3:
+		err = r.SaveAliasRule(ctx, tracks.AliasRule{Alias: args[1], Artist: args[2]})
+	case args[0] == "unalias" && len(args) == 2:
+		err = r.DeleteAliasRule(ctx, args[1])
+	case args[0] == "load" && len(args) == 2:
+		err = loadAliases(ctx, r, args[1], l)
+	default:
+		flag.Usage()
+		err = fmt.Errorf("bad command %q", strings.Join(args, " "))
+	}
+	if err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+func printArtists(ctx context.Context, r tracks.ArtistRepo) error {
+	aa, err := r.GetArtists(ctx)
+	if err != nil {
+		return err
+	}
+	for _, a := range aa {
+		fmt.Printf("%s\t%s\n", a.Name, strings.Join(a.Aliases, ", "))
+	}
+	return nil
+}
+
+func printTop(ctx context.Context, r tracks.ArtistRepo, dataId string, n int) error {
+	top, err := r.TopArtists(ctx, dataId, n)
+	if err != nil {
+		return err
+	}
+	for _, c := range top {
+		fmt.Printf("%d\t%d\t%s\n", c.Tracks, c.Featured, c.Artist.Name)
+	}
+	return nil
+}
+
+func printAliases(ctx context.Context, r tracks.ArtistRepo) error {
+	rules, err := r.GetAliasRules(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		fmt.Printf("%s\t%s\n", rule.Alias, rule.Artist)
+	}
+	return nil
+}
+
+// loadAliases reads the output of the aliases command back, blank lines and
+// lines starting with # are skipped.
+func loadAliases(ctx context.Context, r tracks.ArtistRepo, path string, l *log.Logger) error {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	sc := bufio.NewScanner(f)
+	n := 0
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		alias, artist, ok := strings.Cut(text, "\t")
+		if !ok {
+			return fmt.Errorf("%s:%d: want alias<TAB>artist", path, line)
+		}
+		if err := r.SaveAliasRule(ctx, tracks.AliasRule{Alias: alias, Artist: artist}); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	l.Printf("%d alias rules loaded", n)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/tracks"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const usage = `usage: channels [-config path] command [args]
+
+commands:
+  categories          print the genre hierarchy
+  list [category]     list all channels, or those of a genre and its subgenres
+  genres <data-id>    list the genres a channel belongs to
+  enable <data-id>    rip the channel again
+  disable <data-id>   stop ripping the channel`
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	ctx := context.Background()
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanup()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		return handleErr(errors.New("no command"))
+	}
+	switch {
+	case args[0] == "categories" && len(args) == 1:
+		err = printCategories(ctx, r)
+	case args[0] == "list" && len(args) == 1:
+		err = printChannels(ctx, r, "")
+	case args[0] == "list" && len(args) == 2:
+		err = printChannels(ctx, r, args[1])
+	case args[0] == "genres" && len(args) == 2:
+		err = printGenres(ctx, r, args[1])
+	case args[0] == "enable" && len(args) == 2:
+		err = r.SetChannelEnabled(ctx, args[1], true)
+	case args[0] == "disable" && len(args) == 2:
+		err = r.SetChannelEnabled(ctx, args[1], false)
+	default:
+		flag.Usage()
+		err = fmt.Errorf("bad command %q", strings.Join(args, " "))
+	}
+	if err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+func printCategories(ctx context.Context, r tracks.CategoryRepo) error {
+	cc, err := r.GetCategories(ctx)
+	if err != nil {
+		return err
+	}
+	children := map[string][]tracks.Category{}
+	for _, c := range cc {
+		children[c.Parent] = append(children[c.Parent], c)
+	}
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		for _, c := range children[parent] {
+			fmt.Printf("%s%s\t%s\n", strings.Repeat("  ", depth), c.Slug, c.Name)
+			walk(c.Slug, depth+1)
+		}
+	}
+	walk("", 0)
+	return nil
+}
+
+func printChannels(ctx context.Context, r cmd.Repo, slug string) error {
+	var chs []tracks.Channel
+	var err error
+	if slug == "" {
+		chs, err = r.GetChannels(ctx)
+	} else {
+		chs, err = r.GetChannelsByCategory(ctx, slug)
+	}
+	if err != nil {
+		return err
+	}
+	for _, ch := range chs {
+		fmt.Printf("%s\t%s\n", ch.DataId, ch.Name)
+	}
+	return nil
+}
+
+func printGenres(ctx context.Context, r tracks.CategoryRepo, dataId string) error {
+	cc, err := r.GetChannelCategories(ctx, dataId)
+	if err != nil {
+		return err
+	}
+	for _, c := range cc {
+		fmt.Printf("%s\t%s\n", c.Slug, c.Name)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/drivers/repo"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const usage = `usage: compactindexes [-config path]
+
+applies the pending Redis migrations, then turns the index lists written
+by older versions into sorted sets without duplicates. Stop the rippers
+while it runs.`
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	ctx := context.Background()
+	redisHost := cfg.RedisHost
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	redisClient, cleanupRedis, err := repo.NewRedisClient(ctx, redisHost, cfg.RedisPort, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupRedis()
+	r := repo.NewRedis(redisClient, l)
+	if err := r.Migrate(ctx); err != nil {
+		return handleErr(err)
+	}
+	stats, err := r.CompactIndexes(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	l.Printf("compacted: %s", stats)
+	return nil
+}
@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"accu/drivers/repo"
+	"accu/drivers/workqueue"
+	"accu/tracks"
+	"accu/tracks/dedupe"
+	"accu/tracks/usecase"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Duration is a time.Duration that is read from JSON as a string like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("duration: %w", err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type PollConfig struct {
+	MinInterval Duration
+	MaxInterval Duration
+	Jitter      float64
+	Smoothing   float64
+	GlobalRPS   float64
+	Budget      int
+}
+
+type StopConfig struct {
+	MaxEmptyFetches    int
+	MaxFetches         int
+	TargetCoverage     float64
+	Estimator          string
+	MinCoverageFetches int
+	MaxPermanentErrors int
+}
+
+type DaemonConfig struct {
+	RediscoverInterval Duration
+	ReviveInterval     Duration
+	MinRetryBackoff    Duration
+	MaxRetryBackoff    Duration
+}
+
+type DownloadConfig struct {
+	Hedge     Duration
+	Smoothing float64
+}
+
+// DuplicatesConfig mirrors dedupe.Cfg.
+type DuplicatesConfig struct {
+	Tolerance Duration
+}
+
+// TrackCacheConfig mirrors repo.CachedCfg.
+type TrackCacheConfig struct {
+	Enabled           bool
+	ExpectedTracks    int
+	FalsePositiveRate float64
+	LRUSize           int
+}
+
+// ChannelRuleConfig mirrors usecase.ChannelRule, Name is a regular expression.
+type ChannelRuleConfig struct {
+	Name     string
+	DataId   string
+	Category string
+}
+
+// FaultRuleConfig mirrors faults.Rule, Host and Path are regular expressions.
+type FaultRuleConfig struct {
+	Host        string
+	Path        string
+	Probability float64
+	Latency     Duration
+	Reset       bool
+	Throttle    Duration
+	Status      int
+	PartialBody float64
+}
+
+// PoliteConfig mirrors polite.Cfg, it is ignored when replaying.
+type PoliteConfig struct {
+	RPS        float64
+	MaxPerHost int
+	UserAgent  string
+	Robots     bool
+	MinDelay   Duration
+	MinBackoff Duration
+	MaxBackoff Duration
+}
+
+// QueueConfig mirrors workqueue.Cfg, the queue is kept at RedisHost.
+type QueueConfig struct {
+	Enabled       bool
+	Stream        string
+	Group         string
+	DeadLetter    string
+	ClaimAfter    Duration
+	MaxDeliveries int
+}
+
+// LeasesConfig mirrors repo.LeasesCfg and usecase.LeaseCfg, the leases
+// are kept at RedisHost.
+type LeasesConfig struct {
+	Enabled  bool
+	Instance string
+	TTL      Duration
+	Interval Duration
+}
+
+type CacheTTLConfig struct {
+	Pattern string
+	TTL     Duration
+}
+
+// CacheConfig enables the HTTP cache on disk when Dir is set or in Redis
+// at RedisHost when Redis is set.
+type CacheConfig struct {
+	Dir   string
+	Redis bool
+	// Retain is how long stale entries are kept in Redis for revalidation,
+	// zero keeps them until they are overwritten.
+	Retain      Duration
+	MaxBodySize int64
+	TTL         []CacheTTLConfig
+}
+
+type SelectConfig struct {
+	Include []ChannelRuleConfig
+	Exclude []ChannelRuleConfig
+}
+
+// Config is the JSON configuration file shared by the commands.
+// Zero values fall back to the defaults.
+type Config struct {
+	AccuURI          string
+	CategoryURI      string
+	CategoryURIs     []string
+	IndexURI         string
+	SqliteName       string
+	RedisHost        string
+	RedisPort        int
+	DownloadsRootDir string
+	// TrackCache keeps known track IDs in memory for the rippers, it is left
+	// out with Leases.
+	TrackCache TrackCacheConfig
+	Poll       PollConfig
+	Stop       StopConfig
+	Daemon     DaemonConfig
+	Select     SelectConfig
+	Download   DownloadConfig
+	Duplicates DuplicatesConfig
+	// Queue hands the new tracks found by the rippers out to the
+	// downloaders started with -consumer.
+	Queue QueueConfig
+	// Leases share the channels among the rippers, each channel is ripped
+	// by one of them.
+	Leases       LeasesConfig
+	FetchTimeout Duration
+	// LastSeenInterval is how often a known track seen again is saved.
+	LastSeenInterval Duration
+	// FetchHeaders are sent with every channel and playlist request.
+	FetchHeaders map[string]string
+	// RecordDir saves upstream responses to a cassette, ReplayDir serves
+	// them back instead of going to the network.
+	RecordDir   string
+	RecordAudio bool
+	ReplayDir   string
+	Polite      PoliteConfig
+	Cache       CacheConfig
+	// Faults are injected into upstream requests, for resilience testing only.
+	Faults []FaultRuleConfig
+}
+
+var DefaultConfig = Config{
+	AccuURI:          DefaultAccuURI,
+	CategoryURI:      DefaultCategoryURI,
+	SqliteName:       DefaultSqliteName,
+	RedisPort:        6379,
+	DownloadsRootDir: "downloads",
+	TrackCache: TrackCacheConfig{
+		Enabled: true,
+	},
+	Poll: PollConfig{
+		Jitter: usecase.DefaultPollCfg.Jitter,
+	},
+	Polite: PoliteConfig{
+		RPS:        5,
+		MaxPerHost: 4,
+		Robots:     true,
+	},
+}
+
+// LoadConfig reads the config at path on top of DefaultConfig.
+// An empty path yields DefaultConfig.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig
+	if path == "" {
+		return cfg, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("load config: %w", err)
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return Config{}, fmt.Errorf("load config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c Config) DedupeCfg() dedupe.Cfg {
+	return dedupe.Cfg{
+		Tolerance: time.Duration(c.Duplicates.Tolerance),
+	}
+}
+
+func (c Config) WorkqueueCfg() workqueue.Cfg {
+	return workqueue.Cfg{
+		Stream:        c.Queue.Stream,
+		Group:         c.Queue.Group,
+		DeadLetter:    c.Queue.DeadLetter,
+		ClaimAfter:    time.Duration(c.Queue.ClaimAfter),
+		MaxDeliveries: c.Queue.MaxDeliveries,
+		FenceKey:      repo.FenceKey,
+	}
+}
+
+func (c Config) LeasesCfg() repo.LeasesCfg {
+	return repo.LeasesCfg{
+		Instance: c.Leases.Instance,
+		TTL:      time.Duration(c.Leases.TTL),
+	}
+}
+
+func (c Config) UsecaseCfg() (usecase.Cfg, error) {
+	handleErr := func(err error) (usecase.Cfg, error) {
+		return usecase.Cfg{}, fmt.Errorf("usecase cfg: %w", err)
+	}
+	include, err := channelRules(c.Select.Include)
+	if err != nil {
+		return handleErr(err)
+	}
+	exclude, err := channelRules(c.Select.Exclude)
+	if err != nil {
+		return handleErr(err)
+	}
+	return usecase.Cfg{
+		DownloadsRootDir: c.DownloadsRootDir,
+		Poll: usecase.PollCfg{
+			MinInterval: time.Duration(c.Poll.MinInterval),
+			MaxInterval: time.Duration(c.Poll.MaxInterval),
+			Jitter:      c.Poll.Jitter,
+			Smoothing:   c.Poll.Smoothing,
+			GlobalRPS:   c.Poll.GlobalRPS,
+			Budget:      c.Poll.Budget,
+		},
+		Stop: usecase.StopCfg{
+			MaxEmptyFetches:    c.Stop.MaxEmptyFetches,
+			MaxFetches:         c.Stop.MaxFetches,
+			TargetCoverage:     c.Stop.TargetCoverage,
+			Estimator:          usecase.Estimator(c.Stop.Estimator),
+			MinCoverageFetches: c.Stop.MinCoverageFetches,
+			MaxPermanentErrors: c.Stop.MaxPermanentErrors,
+		},
+		Daemon: usecase.DaemonCfg{
+			RediscoverInterval: time.Duration(c.Daemon.RediscoverInterval),
+			ReviveInterval:     time.Duration(c.Daemon.ReviveInterval),
+			MinRetryBackoff:    time.Duration(c.Daemon.MinRetryBackoff),
+			MaxRetryBackoff:    time.Duration(c.Daemon.MaxRetryBackoff),
+		},
+		Select: usecase.SelectCfg{
+			Include: include,
+			Exclude: exclude,
+		},
+		Download: usecase.DownloadCfg{
+			Hedge:     time.Duration(c.Download.Hedge),
+			Smoothing: c.Download.Smoothing,
+		},
+		Leases: usecase.LeaseCfg{
+			Interval: time.Duration(c.Leases.Interval),
+		},
+		Fetch: tracks.FetchOptions{
+			Timeout:  time.Duration(c.FetchTimeout),
+			Metadata: c.FetchHeaders,
+		},
+		LastSeenInterval: time.Duration(c.LastSeenInterval),
+	}, nil
+}
+
+func channelRules(rcs []ChannelRuleConfig) ([]usecase.ChannelRule, error) {
+	rules := make([]usecase.ChannelRule, 0, len(rcs))
+	for _, rc := range rcs {
+		r := usecase.ChannelRule{
+			DataId:   rc.DataId,
+			Category: rc.Category,
+		}
+		if rc.Name != "" {
+			re, err := regexp.Compile(rc.Name)
+			if err != nil {
+				return nil, fmt.Errorf("channel rule: %w", err)
+			}
+			r.Name = re
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
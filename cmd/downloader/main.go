@@ -5,9 +5,12 @@ import (
 	"accu/drivers/channelfetcher"
 	"accu/drivers/fetcher"
 	"accu/drivers/repo"
+	"accu/tracks"
 	"accu/tracks/usecase"
 	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -29,32 +32,36 @@ func run(l *log.Logger) error {
 	handleErr := func(err error) error {
 		return fmt.Errorf("run: %w", err)
 	}
-	rt := &http.Transport{}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	consumer := flag.String("consumer", "", "download the tracks of the queue as this consumer instead of all saved tracks")
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	rt, cleanupTransport, err := cmd.NewTransport(context.Background(), cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupTransport()
 	tfCfg := fetcher.Cfg{
-		BaseURI: cmd.DefaultAccuURI,
+		BaseURI: cfg.AccuURI,
 	}
 	tlf := fetcher.NewTrackListFetcher(rt, tfCfg)
 	cfCfg := channelfetcher.Cfg{
-		BaseURI: cmd.DefaultCategoryURI,
+		BaseURI:      cfg.CategoryURI,
+		CategoryURIs: cfg.CategoryURIs,
+		IndexURI:     cfg.IndexURI,
 	}
-	if len(os.Args) == 2 {
-		cfCfg.BaseURI = os.Args[1]
+	if flag.NArg() >= 1 {
+		cfCfg.BaseURI = flag.Arg(0)
+		cfCfg.CategoryURIs = flag.Args()[1:]
 	}
-	cf := channelfetcher.NewChannelFetcher(rt, cfCfg)
-	sqliteName := cmd.DefaultSqliteName
-	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s.sqlite?mode=rwc&cache=shared", sqliteName))
+	cf := channelfetcher.NewChannelFetcher(rt, cfCfg, l)
+	ucfg, err := cfg.UsecaseCfg()
 	if err != nil {
 		return handleErr(err)
 	}
-	defer db.Close()
-	r := repo.NewSqlite(db)
-	if err := r.Create(); err != nil {
-		return handleErr(err)
-	}
-	ucfg := usecase.Cfg{
-		DownloadsRootDir: "downloads",
-	}
-	u := usecase.New(ucfg, rt, tlf, cf, r, l)
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
@@ -63,8 +70,44 @@ func run(l *log.Logger) error {
 		<-sigint
 		cancel()
 	}()
+	if *consumer != "" {
+		if err := work(ctx, cfg, ucfg, rt, tlf, cf, *consumer, l); err != nil {
+			return handleErr(err)
+		}
+		return nil
+	}
+	sqliteName := cfg.SqliteName
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s.sqlite?mode=rwc&cache=shared", sqliteName))
+	if err != nil {
+		return handleErr(err)
+	}
+	defer db.Close()
+	r := repo.NewSqlite(db)
+	if err := r.Create(); err != nil {
+		return handleErr(err)
+	}
+	u := usecase.New(ucfg, rt, tlf, cf, r, l)
 	if err := u.Save(ctx); err != nil {
 		return handleErr(err)
 	}
 	return nil
 }
+
+// work downloads from the queue shared with the rippers, the duplicates
+// are read from the configured repo.
+func work(ctx context.Context, cfg cmd.Config, ucfg usecase.Cfg, rt http.RoundTripper, tf tracks.TracksFetcher, cf tracks.ChannelFetcher, consumer string, l *log.Logger) error {
+	if !cfg.Queue.Enabled {
+		return errors.New("-consumer needs Queue.Enabled in the config")
+	}
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	q, cleanupQueue, err := cmd.OpenQueue(ctx, cfg, l)
+	if err != nil {
+		return err
+	}
+	defer cleanupQueue()
+	return usecase.New(ucfg, rt, tf, cf, r, l).WithQueue(q).Work(ctx, consumer)
+}
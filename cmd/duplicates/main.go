@@ -0,0 +1,163 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/tracks"
+	"accu/tracks/dedupe"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const usage = `usage: duplicates [-config path] command [args]
+
+commands:
+  find                       group the tracks that look like the same recording
+  list                       print the groups, * marks the downloaded track
+  merge <track-id> <track-id>...
+                             put the tracks and their groups into one group
+  prefer <track-id>          download this track of its group
+  split <track-id>           take the track out of its group for good`
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	ctx := context.Background()
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanup()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		return handleErr(errors.New("no command"))
+	}
+	switch {
+	case args[0] == "find" && len(args) == 1:
+		err = findDuplicates(ctx, r, cfg.DedupeCfg(), l)
+	case args[0] == "list" && len(args) == 1:
+		err = printDuplicates(ctx, r)
+	case args[0] == "merge" && len(args) >= 3:
+		err = update(ctx, r, args[1:], func(groups []tracks.DuplicateGroup) ([]tracks.DuplicateGroup, error) {
+			return dedupe.Merge(groups, args[1:]...)
+		})
+	case args[0] == "prefer" && len(args) == 2:
+		err = update(ctx, r, args[1:], func(groups []tracks.DuplicateGroup) ([]tracks.DuplicateGroup, error) {
+			return dedupe.Prefer(groups, args[1])
+		})
+	case args[0] == "split" && len(args) == 2:
+		err = update(ctx, r, args[1:], func(groups []tracks.DuplicateGroup) ([]tracks.DuplicateGroup, error) {
+			return dedupe.Split(groups, args[1])
+		})
+	default:
+		flag.Usage()
+		err = fmt.Errorf("bad command %q", strings.Join(args, " "))
+	}
+	if err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+func findDuplicates(ctx context.Context, r tracks.Repo, cfg dedupe.Cfg, l *log.Logger) error {
+	var trks []tracks.Track
+	if err := r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		trks = append(trks, t)
+		return nil
+	}); err != nil {
+		return err
+	}
+	existing, err := r.GetDuplicateGroups(ctx)
+	if err != nil {
+		return err
+	}
+	groups := dedupe.Find(trks, existing, cfg)
+	if err := r.ReplaceDuplicateGroups(ctx, groups...); err != nil {
+		return err
+	}
+	found := 0
+	for _, g := range groups {
+		if !g.Reviewed {
+			found++
+		}
+	}
+	l.Printf("%d tracks, %d groups found, %d reviewed groups kept", len(trks), found, len(groups)-found)
+	return nil
+}
+
+func printDuplicates(ctx context.Context, r tracks.Repo) error {
+	groups, err := r.GetDuplicateGroups(ctx)
+	if err != nil {
+		return err
+	}
+	byID := map[string]tracks.Track{}
+	if err := r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		byID[t.ID] = t
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if len(g.TrackIDs) < 2 {
+			continue
+		}
+		state := "found"
+		if g.Reviewed {
+			state = "reviewed"
+		}
+		fmt.Printf("%s (%s)\n", g.ID, state)
+		for _, id := range g.TrackIDs {
+			mark := " "
+			if id == g.Preferred {
+				mark = "*"
+			}
+			t := byID[id]
+			fmt.Printf("  %s %s\t%s - %s\t%s\t%ds\n", mark, id, t.Artist, t.Title, t.Album, t.Duration)
+		}
+	}
+	return nil
+}
+
+// update applies change to the stored groups, ids must be saved tracks.
+func update(ctx context.Context, r tracks.Repo, ids []string, change func([]tracks.DuplicateGroup) ([]tracks.DuplicateGroup, error)) error {
+	unknown, err := r.UnknownIDs(ctx, "", ids...)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return &tracks.NotFoundError{Entity: "track", Key: unknown[0]}
+	}
+	groups, err := r.GetDuplicateGroups(ctx)
+	if err != nil {
+		return err
+	}
+	groups, err = change(groups)
+	if err != nil {
+		return err
+	}
+	return r.ReplaceDuplicateGroups(ctx, groups...)
+}
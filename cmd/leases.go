@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"accu/drivers/repo"
+	"accu/tracks"
+	"context"
+	"fmt"
+	"log"
+)
+
+// OpenLeases connects to the channel leases at RedisHost when they are
+// enabled, the leases are nil otherwise.
+func OpenLeases(ctx context.Context, cfg Config, l *log.Logger) (tracks.ChannelLeases, func(), error) {
+	if !cfg.Leases.Enabled {
+		return nil, func() {}, nil
+	}
+	redisHost := cfg.RedisHost
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	client, cleanupRedis, err := repo.NewRedisClient(ctx, redisHost, cfg.RedisPort, l)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open leases: %w", err)
+	}
+	leases := repo.NewLeases(client, cfg.LeasesCfg())
+	l.Printf("leasing channels as %s", leases.Instance())
+	return leases, cleanupRedis, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/drivers/repo"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const usage = `usage: leases [-config path]
+
+prints the live rippers and the channels leased to each of them.`
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	ctx := context.Background()
+	redisHost := cfg.RedisHost
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	redisClient, cleanupRedis, err := repo.NewRedisClient(ctx, redisHost, cfg.RedisPort, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupRedis()
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanup()
+	channels, err := r.GetChannels(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	names := make(map[string]string, len(channels))
+	for _, ch := range channels {
+		names[ch.DataId] = ch.Name
+	}
+	leases := repo.NewLeases(redisClient, cfg.LeasesCfg())
+	rippers, err := leases.Rippers(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	held, err := leases.Leases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	byRipper := map[string][]repo.Lease{}
+	for _, lease := range held {
+		byRipper[lease.Instance] = append(byRipper[lease.Instance], lease)
+	}
+	now := time.Now()
+	for _, rp := range rippers {
+		fmt.Printf("%s\t%d channels\texpires in %s\n", rp.Instance, len(byRipper[rp.Instance]), rp.Expires.Sub(now).Round(time.Second))
+		printLeases(byRipper[rp.Instance], names, now)
+		delete(byRipper, rp.Instance)
+	}
+	// leases of rippers that died, until they expire
+	gone := make([]string, 0, len(byRipper))
+	for instance := range byRipper {
+		gone = append(gone, instance)
+	}
+	sort.Strings(gone)
+	for _, instance := range gone {
+		fmt.Printf("%s\tgone\n", instance)
+		printLeases(byRipper[instance], names, now)
+	}
+	return nil
+}
+
+func printLeases(leases []repo.Lease, names map[string]string, now time.Time) {
+	for _, lease := range leases {
+		fmt.Printf("\t%s - %s\ttoken %d\texpires in %s\n", lease.Channel, names[lease.Channel], lease.Token, lease.Expires.Sub(now).Round(time.Second))
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"accu/drivers/repo"
+	"accu/drivers/workqueue"
+	"accu/tracks"
+	"context"
+	"fmt"
+	"log"
+)
+
+// OpenQueue connects to the work queue at RedisHost when it is enabled,
+// the queue is nil otherwise.
+func OpenQueue(ctx context.Context, cfg Config, l *log.Logger) (tracks.TrackQueue, func(), error) {
+	handleErr := func(err error) (tracks.TrackQueue, func(), error) {
+		return nil, nil, fmt.Errorf("open queue: %w", err)
+	}
+	if !cfg.Queue.Enabled {
+		return nil, func() {}, nil
+	}
+	redisHost := cfg.RedisHost
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	client, cleanupRedis, err := repo.NewRedisClient(ctx, redisHost, cfg.RedisPort, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	q, err := workqueue.New(ctx, client, cfg.WorkqueueCfg())
+	if err != nil {
+		cleanupRedis()
+		return handleErr(err)
+	}
+	return q, cleanupRedis, nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"accu/drivers/repo"
+	"accu/tracks"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Repo interface {
+	tracks.Repo
+	tracks.CategoryRepo
+	tracks.ArtistRepo
+	tracks.QueryRepo
+}
+
+// OpenRepo opens Redis when cfg.RedisHost is set and Sqlite otherwise.
+func OpenRepo(ctx context.Context, cfg Config, l *log.Logger) (Repo, func(), error) {
+	handleErr := func(err error) (Repo, func(), error) {
+		return nil, nil, fmt.Errorf("open repo: %w", err)
+	}
+	if cfg.RedisHost != "" {
+		redisClient, cleanupRedis, err := repo.NewRedisClient(ctx, cfg.RedisHost, cfg.RedisPort, l)
+		if err != nil {
+			return handleErr(err)
+		}
+		r := repo.NewRedis(redisClient, l)
+		if err := r.Migrate(ctx); err != nil {
+			cleanupRedis()
+			return handleErr(err)
+		}
+		return r, cleanupRedis, nil
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s.sqlite?mode=rwc&cache=shared", cfg.SqliteName))
+	if err != nil {
+		return handleErr(err)
+	}
+	r := repo.NewSqlite(db)
+	if err := r.Create(); err != nil {
+		db.Close()
+		return handleErr(err)
+	}
+	return r, func() {
+		if err := db.Close(); err != nil {
+			l.Println(err)
+		}
+	}, nil
+}
+
+// CachedRepo puts the track cache in front of r when it is enabled,
+// the returned cleanup logs its statistics. With leases the repo is shared
+// with the other rippers, and the cache would take the tracks they saved
+// after warm up for unknown ones, so it is left out.
+func CachedRepo(ctx context.Context, cfg Config, r tracks.Repo, l *log.Logger) (tracks.Repo, func(), error) {
+	if !cfg.TrackCache.Enabled {
+		return r, func() {}, nil
+	}
+	if cfg.Leases.Enabled {
+		l.Print("track cache disabled, the repo is shared through the leases")
+		return r, func() {}, nil
+	}
+	c, err := repo.NewCached(ctx, r, repo.CachedCfg{
+		ExpectedTracks:    cfg.TrackCache.ExpectedTracks,
+		FalsePositiveRate: cfg.TrackCache.FalsePositiveRate,
+		LRUSize:           cfg.TrackCache.LRUSize,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cached repo: %w", err)
+	}
+	return c, func() {
+		l.Printf("track cache: %s", c.Stats())
+	}, nil
+}
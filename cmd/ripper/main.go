@@ -8,9 +8,9 @@ import (
 	"accu/tracks/usecase"
 	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 
@@ -29,19 +29,31 @@ func run(l *log.Logger) error {
 	handleErr := func(err error) error {
 		return fmt.Errorf("run: %w", err)
 	}
-	rt := &http.Transport{}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	rt, cleanupTransport, err := cmd.NewTransport(context.Background(), cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupTransport()
 	tfCfg := fetcher.Cfg{
-		BaseURI: cmd.DefaultAccuURI,
+		BaseURI: cfg.AccuURI,
 	}
 	tlf := fetcher.NewTrackListFetcher(rt, tfCfg)
 	cfCfg := channelfetcher.Cfg{
-		BaseURI: cmd.DefaultCategoryURI,
+		BaseURI:      cfg.CategoryURI,
+		CategoryURIs: cfg.CategoryURIs,
+		IndexURI:     cfg.IndexURI,
 	}
-	if len(os.Args) == 2 {
-		cfCfg.BaseURI = os.Args[1]
+	if flag.NArg() >= 1 {
+		cfCfg.BaseURI = flag.Arg(0)
+		cfCfg.CategoryURIs = flag.Args()[1:]
 	}
-	cf := channelfetcher.NewChannelFetcher(rt, cfCfg)
-	sqliteName := cmd.DefaultSqliteName
+	sqliteName := cfg.SqliteName
 	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s.sqlite?mode=rwc&cache=shared", sqliteName))
 	if err != nil {
 		return handleErr(err)
@@ -54,10 +66,18 @@ func run(l *log.Logger) error {
 	if err := r.Create(); err != nil {
 		return handleErr(err)
 	}
-	ucfg := usecase.Cfg{
-		DownloadsRootDir: "downloads",
+	cfCfg.Categories = r
+	cf := channelfetcher.NewChannelFetcher(rt, cfCfg, l)
+	ucfg, err := cfg.UsecaseCfg()
+	if err != nil {
+		return handleErr(err)
+	}
+	cr, cleanupCache, err := cmd.CachedRepo(context.Background(), cfg, r, l)
+	if err != nil {
+		return handleErr(err)
 	}
-	u := usecase.New(ucfg, rt, tlf, cf, r, l)
+	defer cleanupCache()
+	u := usecase.New(ucfg, rt, tlf, cf, cr, l)
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/drivers/channelfetcher"
+	"accu/drivers/fetcher"
+	"accu/tracks/usecase"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config, reloaded on SIGHUP")
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	rt, cleanupTransport, err := cmd.NewTransport(context.Background(), cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupTransport()
+	tlf := fetcher.NewTrackListFetcher(rt, fetcher.Cfg{
+		BaseURI: cfg.AccuURI,
+	})
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanup()
+	cf := channelfetcher.NewChannelFetcher(rt, channelfetcher.Cfg{
+		BaseURI:      cfg.CategoryURI,
+		CategoryURIs: cfg.CategoryURIs,
+		IndexURI:     cfg.IndexURI,
+		Categories:   r,
+	}, l)
+	ucfg, err := cfg.UsecaseCfg()
+	if err != nil {
+		return handleErr(err)
+	}
+	cr, cleanupCache, err := cmd.CachedRepo(ctx, cfg, r, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupCache()
+	q, cleanupQueue, err := cmd.OpenQueue(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupQueue()
+	leases, cleanupLeases, err := cmd.OpenLeases(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupLeases()
+	u := usecase.New(ucfg, rt, tlf, cf, cr, l).WithQueue(q).WithLeases(leases)
+	reload := make(chan usecase.Cfg)
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+			}
+			newCfg, err := cmd.LoadConfig(*cfgPath)
+			if err != nil {
+				l.Printf("reload: %v", err)
+				continue
+			}
+			newUcfg, err := newCfg.UsecaseCfg()
+			if err != nil {
+				l.Printf("reload: %v", err)
+				continue
+			}
+			select {
+			case reload <- newUcfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if err := u.Daemon(ctx, reload); err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
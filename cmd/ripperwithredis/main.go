@@ -7,9 +7,9 @@ import (
 	"accu/drivers/repo"
 	"accu/tracks/usecase"
 	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 
@@ -28,32 +28,66 @@ func run(l *log.Logger) error {
 	handleErr := func(err error) error {
 		return fmt.Errorf("run: %w", err)
 	}
-	rt := &http.Transport{}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	flag.Parse()
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	rt, cleanupTransport, err := cmd.NewTransport(context.Background(), cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupTransport()
 	tfCfg := fetcher.Cfg{
-		BaseURI: cmd.DefaultAccuURI,
+		BaseURI: cfg.AccuURI,
 	}
 	tlf := fetcher.NewTrackListFetcher(rt, tfCfg)
 	cfCfg := channelfetcher.Cfg{
-		BaseURI: cmd.DefaultCategoryURI,
+		BaseURI:      cfg.CategoryURI,
+		CategoryURIs: cfg.CategoryURIs,
+		IndexURI:     cfg.IndexURI,
 	}
-	if len(os.Args) == 2 {
-		cfCfg.BaseURI = os.Args[1]
+	if flag.NArg() >= 1 {
+		cfCfg.BaseURI = flag.Arg(0)
+		cfCfg.CategoryURIs = flag.Args()[1:]
 	}
-	cf := channelfetcher.NewChannelFetcher(rt, cfCfg)
 	ctx := context.Background()
-	redisClient, cleanupRedis, err := repo.NewRedisClient(ctx, "localhost", 6379, l)
+	redisHost := cfg.RedisHost
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	redisClient, cleanupRedis, err := repo.NewRedisClient(ctx, redisHost, cfg.RedisPort, l)
 	if err != nil {
 		return handleErr(err)
 	}
 	defer cleanupRedis()
 	r := repo.NewRedis(redisClient, l)
+	if err := r.Migrate(ctx); err != nil {
+		return handleErr(err)
+	}
+	cfCfg.Categories = r
+	cf := channelfetcher.NewChannelFetcher(rt, cfCfg, l)
+	ucfg, err := cfg.UsecaseCfg()
 	if err != nil {
 		return handleErr(err)
 	}
-	ucfg := usecase.Cfg{
-		DownloadsRootDir: "downloads", // TODO this is irrelevant, separate usecases
+	cr, cleanupCache, err := cmd.CachedRepo(ctx, cfg, r, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupCache()
+	q, cleanupQueue, err := cmd.OpenQueue(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanupQueue()
+	leases, cleanupLeases, err := cmd.OpenLeases(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
 	}
-	u := usecase.New(ucfg, rt, tlf, cf, r, l)
+	defer cleanupLeases()
+	u := usecase.New(ucfg, rt, tlf, cf, cr, l).WithQueue(q).WithLeases(leases)
 	ctx, cancelCtx := context.WithCancel(ctx)
 	go func() {
 		childCtx, cancelChildCtx := signal.NotifyContext(ctx, os.Interrupt)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"accu/cmd"
+	"accu/tracks"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const usage = `usage: tracks [-config path] [-channel data-id] [-artist name] [-album name] [-year n] [-limit n]
+
+prints the tracks matching all the given filters, newest first, one
+"id<TAB>artist - title<TAB>album<TAB>year<TAB>channels" per line`
+
+func main() {
+	l := log.Default()
+	if err := run(l); err != nil {
+		l.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(l *log.Logger) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("run: %w", err)
+	}
+	cfgPath := flag.String("config", "", "path to the JSON config")
+	var f tracks.TrackFilter
+	flag.StringVar(&f.Channel, "channel", "", "data id of a channel the tracks were seen on")
+	flag.StringVar(&f.Artist, "artist", "", "main or featured artist, aliases are resolved")
+	flag.StringVar(&f.Album, "album", "", "exact album")
+	flag.IntVar(&f.Year, "year", 0, "release year")
+	flag.IntVar(&f.Limit, "limit", 50, "most tracks to print, 0 for all")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		return handleErr(fmt.Errorf("bad arguments %q", strings.Join(flag.Args(), " ")))
+	}
+	cfg, err := cmd.LoadConfig(*cfgPath)
+	if err != nil {
+		return handleErr(err)
+	}
+	ctx := context.Background()
+	r, cleanup, err := cmd.OpenRepo(ctx, cfg, l)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer cleanup()
+	trks, err := r.FindTracks(ctx, f)
+	if err != nil {
+		return handleErr(err)
+	}
+	for _, t := range trks {
+		channels := make([]string, len(t.Channels))
+		for i, m := range t.Channels {
+			channels[i] = m.Channel
+		}
+		fmt.Printf("%s\t%s - %s\t%s\t%d\t%s\n", t.ID, t.Artist, t.Title, t.Album, t.Year, strings.Join(channels, ", "))
+	}
+	return nil
+}
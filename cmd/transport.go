@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"accu/drivers/cassette"
+	"accu/drivers/faults"
+	"accu/drivers/httpcache"
+	"accu/drivers/polite"
+	"accu/drivers/repo"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// NewTransport builds the round tripper shared by the fetchers and the
+// downloader, replaying or recording a cassette when configured to.
+// Upstream requests go through a single politeness limiter.
+// The cache sits in front of the cassette and faults are injected in front
+// of both so they are never cached or recorded. The returned cleanup logs
+// the cache statistics.
+func NewTransport(ctx context.Context, cfg Config, l *log.Logger) (http.RoundTripper, func(), error) {
+	cleanup := func() {}
+	handleErr := func(err error) (http.RoundTripper, func(), error) {
+		cleanup()
+		return nil, nil, fmt.Errorf("new transport: %w", err)
+	}
+	var rt http.RoundTripper = polite.New(&http.Transport{}, polite.Cfg{
+		RPS:        cfg.Polite.RPS,
+		MaxPerHost: cfg.Polite.MaxPerHost,
+		UserAgent:  cfg.Polite.UserAgent,
+		Robots:     cfg.Polite.Robots,
+		MinDelay:   time.Duration(cfg.Polite.MinDelay),
+		MinBackoff: time.Duration(cfg.Polite.MinBackoff),
+		MaxBackoff: time.Duration(cfg.Polite.MaxBackoff),
+	})
+	switch {
+	case cfg.ReplayDir != "" && cfg.RecordDir != "":
+		return handleErr(fmt.Errorf("replay and record are mutually exclusive"))
+	case cfg.ReplayDir != "":
+		rep, err := cassette.NewReplayer(cfg.ReplayDir)
+		if err != nil {
+			return handleErr(err)
+		}
+		rt = rep
+	case cfg.RecordDir != "":
+		rec, err := cassette.NewRecorder(rt, cassette.RecorderCfg{
+			Dir:         cfg.RecordDir,
+			RecordAudio: cfg.RecordAudio,
+		})
+		if err != nil {
+			return handleErr(err)
+		}
+		rt = rec
+	}
+	if cfg.Cache.Dir != "" || cfg.Cache.Redis {
+		store, closeStore, err := cacheStore(ctx, cfg, l)
+		if err != nil {
+			return handleErr(err)
+		}
+		rules, err := ttlRules(cfg.Cache.TTL)
+		if err != nil {
+			closeStore()
+			return handleErr(err)
+		}
+		cache := httpcache.New(rt, httpcache.Cfg{
+			Store:       store,
+			Rules:       rules,
+			MaxBodySize: cfg.Cache.MaxBodySize,
+		})
+		cleanup = func() {
+			l.Printf("http cache: %s", cache.Stats())
+			closeStore()
+		}
+		rt = cache
+	}
+	if len(cfg.Faults) == 0 {
+		return rt, cleanup, nil
+	}
+	rules, err := faultRules(cfg.Faults)
+	if err != nil {
+		return handleErr(err)
+	}
+	return faults.New(rt, faults.Cfg{
+		Rules: rules,
+		Seed:  time.Now().UnixNano(),
+	}), cleanup, nil
+}
+
+func cacheStore(ctx context.Context, cfg Config, l *log.Logger) (httpcache.Store, func(), error) {
+	if cfg.Cache.Dir != "" && cfg.Cache.Redis {
+		return nil, nil, fmt.Errorf("cache dir and redis are mutually exclusive")
+	}
+	if cfg.Cache.Dir != "" {
+		store, err := httpcache.NewDiskStore(cfg.Cache.Dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, func() {}, nil
+	}
+	redisHost := cfg.RedisHost
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	client, cleanupRedis, err := repo.NewRedisClient(ctx, redisHost, cfg.RedisPort, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	return httpcache.NewRedisStore(client, time.Duration(cfg.Cache.Retain)), cleanupRedis, nil
+}
+
+func ttlRules(rcs []CacheTTLConfig) ([]httpcache.TTLRule, error) {
+	rules := make([]httpcache.TTLRule, 0, len(rcs))
+	for _, rc := range rcs {
+		re, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cache ttl rule: %w", err)
+		}
+		rules = append(rules, httpcache.TTLRule{
+			Pattern: re,
+			TTL:     time.Duration(rc.TTL),
+		})
+	}
+	return rules, nil
+}
+
+func faultRules(rcs []FaultRuleConfig) ([]faults.Rule, error) {
+	compile := func(expr string) (*regexp.Regexp, error) {
+		if expr == "" {
+			return nil, nil
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("fault rule: %w", err)
+		}
+		return re, nil
+	}
+	rules := make([]faults.Rule, 0, len(rcs))
+	for _, rc := range rcs {
+		host, err := compile(rc.Host)
+		if err != nil {
+			return nil, err
+		}
+		path, err := compile(rc.Path)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, faults.Rule{
+			Host:        host,
+			Path:        path,
+			Probability: rc.Probability,
+			Latency:     time.Duration(rc.Latency),
+			Reset:       rc.Reset,
+			Throttle:    time.Duration(rc.Throttle),
+			Status:      rc.Status,
+			PartialBody: rc.PartialBody,
+		})
+	}
+	return rules, nil
+}
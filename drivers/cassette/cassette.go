@@ -0,0 +1,286 @@
+// Package cassette records upstream HTTP responses to a directory
+// and replays them without touching the network.
+package cassette
+
+import (
+	"accu/tracks"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrNotRecorded = errors.New("not recorded")
+
+// interaction is stored as <seq>.json next to its body in <seq>.body.
+type interaction struct {
+	Seq          int
+	Method       string
+	URL          string
+	StatusCode   int
+	Header       http.Header
+	BodyOmitted  bool
+	BodyComplete bool
+}
+
+func key(method, url string) string {
+	sum := sha1.Sum([]byte(method + " " + url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (i interaction) metaPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.json", i.Seq))
+}
+
+func (i interaction) bodyPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.body", i.Seq))
+}
+
+func isAudio(req *http.Request, resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "audio/") ||
+		strings.HasSuffix(req.URL.Path, ".m4a")
+}
+
+type RecorderCfg struct {
+	Dir string
+	// RecordAudio stores audio bodies as well, by default only their
+	// status and headers are recorded.
+	RecordAudio bool
+}
+
+// Recorder is an http.RoundTripper that saves every response it passes through.
+type Recorder struct {
+	next http.RoundTripper
+	cfg  RecorderCfg
+	mu   sync.Mutex
+	seq  int
+}
+
+func NewRecorder(next http.RoundTripper, cfg RecorderCfg) (*Recorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("new recorder: %w", err)
+	}
+	seq, err := lastSeq(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("new recorder: %w", err)
+	}
+	return &Recorder{
+		next: next,
+		cfg:  cfg,
+		seq:  seq,
+	}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	handleErr := func(err error) (*http.Response, error) {
+		return nil, fmt.Errorf("recorder: %w", err)
+	}
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.seq++
+	in := interaction{
+		Seq:        r.seq,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	}
+	r.mu.Unlock()
+	if isAudio(req, resp) && !r.cfg.RecordAudio {
+		in.BodyOmitted = true
+		if err := writeMeta(r.cfg.Dir, in); err != nil {
+			resp.Body.Close()
+			return handleErr(err)
+		}
+		return resp, nil
+	}
+	f, err := os.Create(in.bodyPath(r.cfg.Dir))
+	if err != nil {
+		resp.Body.Close()
+		return handleErr(err)
+	}
+	resp.Body = &teeBody{
+		rc:  resp.Body,
+		f:   f,
+		in:  in,
+		dir: r.cfg.Dir,
+	}
+	return resp, nil
+}
+
+// teeBody copies the body to disk as the caller reads it and writes the
+// interaction on Close, so large bodies are never held in memory.
+// A body closed before its end is recorded as incomplete, it isn't drained
+// from the upstream.
+type teeBody struct {
+	rc     io.ReadCloser
+	f      *os.File
+	in     interaction
+	dir    string
+	closed bool
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		if _, werr := t.f.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		t.in.BodyComplete = true
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	errs := []error{t.rc.Close(), t.f.Close(), writeMeta(t.dir, t.in)}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMeta(dir string, in interaction) error {
+	raw, err := json.MarshalIndent(in, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(in.metaPath(dir), raw, 0600)
+}
+
+func lastSeq(dir string) (int, error) {
+	ins, err := load(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(ins) == 0 {
+		return 0, nil
+	}
+	return ins[len(ins)-1].Seq, nil
+}
+
+func load(dir string) ([]interaction, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ins := make([]interaction, 0, len(paths))
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var in interaction
+		if err := json.Unmarshal(raw, &in); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		ins = append(ins, in)
+	}
+	sort.Slice(ins, func(i, j int) bool {
+		return ins[i].Seq < ins[j].Seq
+	})
+	return ins, nil
+}
+
+// Replayer is an http.RoundTripper that serves the responses of a cassette
+// directory. Repeated requests for the same URL get the recorded responses
+// in order, the last one is served again once they run out.
+type Replayer struct {
+	dir   string
+	mu    sync.Mutex
+	byKey map[string][]interaction
+	pos   map[string]int
+}
+
+func NewReplayer(dir string) (*Replayer, error) {
+	ins, err := load(dir)
+	if err != nil {
+		return nil, fmt.Errorf("new replayer: %w", err)
+	}
+	byKey := map[string][]interaction{}
+	for _, in := range ins {
+		k := key(in.Method, in.URL)
+		byKey[k] = append(byKey[k], in)
+	}
+	return &Replayer{
+		dir:   dir,
+		byKey: byKey,
+		pos:   map[string]int{},
+	}, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	handleErr := func(err error) (*http.Response, error) {
+		return nil, fmt.Errorf("replayer: %s %s: %w", req.Method, req.URL, err)
+	}
+	if err := req.Context().Err(); err != nil {
+		return handleErr(err)
+	}
+	k := key(req.Method, req.URL.String())
+	r.mu.Lock()
+	ins := r.byKey[k]
+	i := r.pos[k]
+	if i < len(ins)-1 {
+		r.pos[k]++
+	}
+	r.mu.Unlock()
+	if len(ins) == 0 {
+		return handleErr(ErrNotRecorded)
+	}
+	in := ins[i]
+	if in.BodyOmitted {
+		return handleErr(fmt.Errorf("body %w", ErrNotRecorded))
+	}
+	body, err := os.ReadFile(in.bodyPath(r.dir))
+	if err != nil {
+		return handleErr(err)
+	}
+	tracks.MarkReplayed(req.Context())
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.StatusCode, http.StatusText(in.StatusCode)),
+		StatusCode:    in.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        in.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	// a body recorded partially ends the way the upstream connection did
+	if !in.BodyComplete {
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), truncated{}))
+		resp.ContentLength = -1
+		if n, err := strconv.ParseInt(in.Header.Get("Content-Length"), 10, 64); err == nil {
+			resp.ContentLength = n
+		}
+	}
+	return resp, nil
+}
+
+// truncated fails the reads past a partially recorded body.
+type truncated struct{}
+
+func (truncated) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,141 @@
+package cassette
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.URL.Path == "/song.m4a" {
+			w.Header().Set("Content-Type", "audio/mp4")
+		}
+		fmt.Fprintf(w, "%s #%d", r.URL.Path, hits)
+	}))
+	dir := t.TempDir()
+	rec, err := NewRecorder(http.DefaultTransport, RecorderCfg{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: rec}
+	for _, path := range []string{"/playlist/", "/playlist/", "/song.m4a"} {
+		if _, err := get(c, srv.URL+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Close()
+
+	rep, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &http.Client{Transport: rep}
+	for _, want := range []string{"/playlist/ #1", "/playlist/ #2", "/playlist/ #2"} {
+		got, err := get(c, srv.URL+"/playlist/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := get(c, srv.URL+"/song.m4a"); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("audio body: got %v, want %v", err, ErrNotRecorded)
+	}
+	if _, err := get(c, srv.URL+"/unknown/"); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("unknown url: got %v, want %v", err, ErrNotRecorded)
+	}
+}
+
+// endless is an upstream body that never ends, read counts the bytes read.
+type endless struct {
+	read int
+}
+
+func (e *endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	e.read += len(p)
+	return len(p), nil
+}
+
+func (e *endless) Close() error {
+	return nil
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRecordIncomplete(t *testing.T) {
+	body := &endless{}
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Length": {"1000000"}},
+			Body:          body,
+			ContentLength: 1000000,
+			Request:       req,
+		}, nil
+	})
+	dir := t.TempDir()
+	rec, err := NewRecorder(upstream, RecorderCfg{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: rec}
+	resp, err := c.Get("http://up.example/playlist/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := make([]byte, 10)
+	if _, err := io.ReadFull(resp.Body, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if body.read > 4096 {
+		t.Errorf("%d bytes read from the upstream after close", body.read)
+	}
+
+	rep, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = (&http.Client{Transport: rep}).Get("http://up.example/playlist/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != 1000000 {
+		t.Errorf("content length %d, want the recorded 1000000", resp.ContentLength)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("replayed body ended with %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if len(got) != body.read || !bytes.Equal(got[:10], start) {
+		t.Errorf("replayed %d bytes, recorded %d", len(got), body.read)
+	}
+}
+
+func get(c *http.Client, uri string) (string, error) {
+	resp, err := c.Get(uri)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
@@ -2,57 +2,274 @@ package channelfetcher
 
 import (
 	"accu/tracks"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 )
 
 type Cfg struct {
 	BaseURI string
+	// CategoryURIs are crawled in addition to BaseURI.
+	CategoryURIs []string
+	// IndexURI is a page linking to category pages, every link matching
+	// CategoryPattern and not ExcludePattern is crawled as well.
+	IndexURI        string
+	CategoryPattern *regexp.Regexp
+	ExcludePattern  *regexp.Regexp
+	// Categories holds the channels of the previous crawls, a page of a
+	// category that has channels there and yields none fails the crawl.
+	// Without it empty pages go unnoticed.
+	Categories tracks.CategoryRepo
 }
 
+var (
+	DefaultCategoryPattern = regexp.MustCompile(`^/([a-z0-9-]+/){1,2}$`)
+	// DefaultExcludePattern skips the pages of the site that are not genres.
+	DefaultExcludePattern = regexp.MustCompile(`^/(about|account|apps?|blog|careers|contact|faq|help|jobs|legal|login|logout|news|playlist|press|privacy|register|search|settings|signup|support|terms)(-[a-z0-9-]+)?/`)
+)
+
 type ChannelFetcher struct {
 	cfg Cfg
 	c   *http.Client // pointer because http.DefaultClient is a pointer
+	l   *log.Logger
 }
 
-func NewChannelFetcher(rt http.RoundTripper, cfg Cfg) ChannelFetcher {
+func NewChannelFetcher(rt http.RoundTripper, cfg Cfg, l *log.Logger) ChannelFetcher {
+	if cfg.CategoryPattern == nil {
+		cfg.CategoryPattern = DefaultCategoryPattern
+	}
+	if cfg.ExcludePattern == nil {
+		cfg.ExcludePattern = DefaultExcludePattern
+	}
 	return ChannelFetcher{
 		c: &http.Client{
 			Transport: rt,
 		},
 		cfg: cfg,
+		l:   l,
 	}
 }
 
+var _ tracks.ChannelFetcher = ChannelFetcher{}
+
 var channelRegexp = regexp.MustCompile(`data-id=["']([a-f\d]+)["']\s+data-oldid="\d+"\s+data-name=['"](.+?)['"]`)
 
-func (cf ChannelFetcher) FetchChannels() ([]tracks.Channel, error) {
+// FetchChannels crawls every configured category page and merges channels
+// found on several pages into one with all their categories. A page that
+// can't be fetched is logged and skipped, the crawl only fails when no page
+// could be fetched or a page stopped producing channels.
+func (cf ChannelFetcher) FetchChannels(ctx context.Context, p tracks.FetchChannelsParams) ([]tracks.Channel, error) {
 	handleErr := func(err error) ([]tracks.Channel, error) {
 		return nil, fmt.Errorf("channel fetcher: fetch channels: %w", err)
 	}
-	resp, err := cf.c.Get(cf.cfg.BaseURI)
+	ctx, cancel := p.WithTimeout(ctx)
+	defer cancel()
+	categories, err := cf.categories(ctx, p.Metadata)
 	if err != nil {
 		return handleErr(err)
 	}
-	defer resp.Body.Close()
-	rawPage, err := io.ReadAll(resp.Body)
+	byId := map[string]int{}
+	var channels []tracks.Channel
+	var lastErr error
+	fetched := 0
+	for _, c := range categories {
+		found, err := cf.fetchCategory(ctx, c, p.Metadata)
+		// a page that stopped producing channels is drift, not a bad link
+		var se *tracks.StorageError
+		if err != nil && (errors.Is(err, tracks.ErrNoChannels) || errors.As(err, &se) || ctx.Err() != nil) {
+			return handleErr(err)
+		}
+		if err != nil {
+			cf.l.Printf("channel fetcher: skipping page: %v", err)
+			lastErr = err
+			continue
+		}
+		fetched++
+		for _, ch := range found {
+			ch.Categories = mergeCategories(append([]tracks.Category(nil), c.lineage...), ch.Categories)
+			i, ok := byId[ch.DataId]
+			if !ok {
+				byId[ch.DataId] = len(channels)
+				channels = append(channels, ch)
+				continue
+			}
+			channels[i].Categories = mergeCategories(channels[i].Categories, ch.Categories)
+		}
+	}
+	if fetched == 0 && lastErr != nil {
+		return handleErr(lastErr)
+	}
+	return channels, nil
+}
+
+type categoryPage struct {
+	uri string
+	// lineage is the category followed by its ancestors.
+	lineage []tracks.Category
+}
+
+func (cf ChannelFetcher) categories(ctx context.Context, md map[string]string) ([]categoryPage, error) {
+	handleErr := func(err error) ([]categoryPage, error) {
+		return nil, fmt.Errorf("categories: %w", err)
+	}
+	names := map[string]string{}
+	uris := make([]string, 0, len(cf.cfg.CategoryURIs)+1)
+	if cf.cfg.BaseURI != "" {
+		uris = append(uris, cf.cfg.BaseURI)
+	}
+	uris = append(uris, cf.cfg.CategoryURIs...)
+	if cf.cfg.IndexURI != "" {
+		discovered, err := cf.discoverCategories(ctx, md, names)
+		if err != nil {
+			return handleErr(err)
+		}
+		uris = append(uris, discovered...)
+	}
+	seen := map[string]struct{}{}
+	pages := make([]categoryPage, 0, len(uris))
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return handleErr(err)
+		}
+		if _, ok := seen[u.Path]; ok {
+			continue
+		}
+		seen[u.Path] = struct{}{}
+		pages = append(pages, categoryPage{
+			uri:     uri,
+			lineage: categoryLineage(u.Path, names),
+		})
+	}
+	return pages, nil
+}
+
+// discoverCategories returns the absolute URIs of category pages linked
+// from the index page and records their link texts in names by path.
+func (cf ChannelFetcher) discoverCategories(ctx context.Context, md map[string]string, names map[string]string) ([]string, error) {
+	handleErr := func(err error) ([]string, error) {
+		return nil, fmt.Errorf("discover categories: %w", err)
+	}
+	base, err := url.Parse(cf.cfg.IndexURI)
+	if err != nil {
+		return handleErr(err)
+	}
+	rawPage, err := cf.get(ctx, cf.cfg.IndexURI, md)
 	if err != nil {
 		return handleErr(err)
 	}
-	res := channelRegexp.FindAllStringSubmatch(string(rawPage), -1)
-	uniqChannels := map[string]struct{}{}
-	channels := make([]tracks.Channel, 0, len(res))
-	for _, r := range res {
-		if _, ok := uniqChannels[r[1]]; ok {
+	var uris []string
+	for _, l := range extractLinks(rawPage) {
+		ref, err := url.Parse(l.href)
+		if err != nil {
 			continue
 		}
-		uniqChannels[r[1]] = struct{}{}
-		channels = append(channels, tracks.Channel{
-			Name:   r[2],
-			DataId: r[1],
+		u := base.ResolveReference(ref)
+		if u.Host != base.Host || !cf.cfg.CategoryPattern.MatchString(u.Path) || cf.cfg.ExcludePattern.MatchString(u.Path) {
+			continue
+		}
+		u.RawQuery, u.Fragment = "", ""
+		if name := l.text; name != "" {
+			names[u.Path] = name
+		}
+		uris = append(uris, u.String())
+	}
+	return uris, nil
+}
+
+// fetchCategory fails with a tracks.DecodeError wrapping tracks.ErrNoChannels
+// when a page yields no channels while Cfg.Categories has channels of its
+// category.
+func (cf ChannelFetcher) fetchCategory(ctx context.Context, page categoryPage, md map[string]string) ([]tracks.Channel, error) {
+	handleErr := func(err error) ([]tracks.Channel, error) {
+		return nil, fmt.Errorf("fetch category %s: %w", page.uri, err)
+	}
+	rawPage, err := cf.get(ctx, page.uri, md)
+	if err != nil {
+		return handleErr(err)
+	}
+	channels := extractChannels(rawPage)
+	if len(channels) > 0 || cf.cfg.Categories == nil || len(page.lineage) == 0 {
+		return channels, nil
+	}
+	known, err := cf.cfg.Categories.GetChannelsByCategory(ctx, page.lineage[0].Slug)
+	if err != nil {
+		return handleErr(err)
+	}
+	if len(known) > 0 {
+		return handleErr(&tracks.DecodeError{
+			URI: page.uri,
+			Err: fmt.Errorf("%w, %d known in category %s", tracks.ErrNoChannels, len(known), page.lineage[0].Slug),
 		})
 	}
 	return channels, nil
 }
+
+func (cf ChannelFetcher) get(ctx context.Context, uri string, md map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range md {
+		req.Header.Set(k, v)
+	}
+	resp, err := cf.c.Do(req)
+	if err != nil {
+		return nil, &tracks.TransportError{URI: uri, Err: err}
+	}
+	defer resp.Body.Close()
+	if err := tracks.CheckStatus(resp); err != nil {
+		return nil, err
+	}
+	rawPage, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &tracks.TransportError{URI: uri, Err: err}
+	}
+	return rawPage, nil
+}
+
+// categoryLineage derives the category hierarchy from a page path,
+// "/jazz/smooth-jazz/" is smooth-jazz with parent jazz.
+func categoryLineage(path string, names map[string]string) []tracks.Category {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	lineage := make([]tracks.Category, 0, len(segments))
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i] == "" {
+			continue
+		}
+		c := tracks.Category{
+			Slug: segments[i],
+			Name: names["/"+strings.Join(segments[:i+1], "/")+"/"],
+		}
+		if c.Name == "" {
+			c.Name = segments[i]
+		}
+		if i > 0 {
+			c.Parent = segments[i-1]
+		}
+		lineage = append(lineage, c)
+	}
+	return lineage
+}
+
+func mergeCategories(cs []tracks.Category, more []tracks.Category) []tracks.Category {
+	for _, m := range more {
+		dup := false
+		for _, c := range cs {
+			if c.Slug == m.Slug {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			cs = append(cs, m)
+		}
+	}
+	return cs
+}
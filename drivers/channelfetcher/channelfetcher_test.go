@@ -0,0 +1,132 @@
+package channelfetcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"accu/tracks"
+)
+
+func TestCategoryLineage(t *testing.T) {
+	names := map[string]string{
+		"/jazz/":             "Jazz",
+		"/jazz/smooth-jazz/": "Smooth Jazz",
+	}
+	for _, tc := range []struct {
+		path string
+		want []tracks.Category
+	}{
+		{"/jazz/", []tracks.Category{{Slug: "jazz", Name: "Jazz"}}},
+		{"/jazz/smooth-jazz/", []tracks.Category{
+			{Slug: "smooth-jazz", Name: "Smooth Jazz", Parent: "jazz"},
+			{Slug: "jazz", Name: "Jazz"},
+		}},
+		// no link text, the slug is the name
+		{"/rock/indie-rock", []tracks.Category{
+			{Slug: "indie-rock", Name: "indie-rock", Parent: "rock"},
+			{Slug: "rock", Name: "rock"},
+		}},
+		{"/", []tracks.Category{}},
+	} {
+		if got := categoryLineage(tc.path, names); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.path, got, tc.want)
+		}
+	}
+}
+
+// site serves an index page and the category pages in pages, any other
+// path is a 404.
+func site(t *testing.T, index string, pages map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, index)
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+const index = `<nav>
+<a href="/jazz/">Jazz</a>
+<a href="/jazz/smooth-jazz/?ref=nav#top"> Smooth Jazz </a>
+<a href="/gone/">Gone</a>
+<a href="/about/">About us</a>
+<a href="/playlist/5a1b/">Now playing</a>
+<a href="/help/faq/">FAQ</a>
+<a href="https://elsewhere.example/rock/">Rock</a>
+<a href="/jazz/smooth-jazz/late/night/">Too deep</a>
+</nav>`
+
+func TestDiscoverCategories(t *testing.T) {
+	srv := site(t, index, nil)
+	cf := NewChannelFetcher(http.DefaultTransport, Cfg{IndexURI: srv.URL + "/"}, log.New(io.Discard, "", 0))
+	names := map[string]string{}
+	uris, err := cf.discoverCategories(context.Background(), nil, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{srv.URL + "/jazz/", srv.URL + "/jazz/smooth-jazz/", srv.URL + "/gone/"}
+	if !reflect.DeepEqual(uris, want) {
+		t.Errorf("got %v, want %v", uris, want)
+	}
+	wantNames := map[string]string{"/jazz/": "Jazz", "/jazz/smooth-jazz/": "Smooth Jazz", "/gone/": "Gone"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("got names %v, want %v", names, wantNames)
+	}
+}
+
+func TestFetchChannelsCategories(t *testing.T) {
+	srv := site(t, index, map[string]string{
+		"/jazz/": `<div data-id="c1" data-name="Big Band" data-genre="Swing"></div>`,
+		"/jazz/smooth-jazz/": `<div data-id="c2" data-name="Late Night"></div>
+<div data-id="c1" data-name="Big Band" data-category="Dinner"></div>`,
+	})
+	var logged bytes.Buffer
+	cf := NewChannelFetcher(http.DefaultTransport, Cfg{IndexURI: srv.URL + "/"}, log.New(&logged, "", 0))
+	chs, err := cf.FetchChannels(context.Background(), tracks.FetchChannelsParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jazz := tracks.Category{Slug: "jazz", Name: "Jazz"}
+	smooth := tracks.Category{Slug: "smooth-jazz", Name: "Smooth Jazz", Parent: "jazz"}
+	want := map[string][]tracks.Category{
+		"c1": {jazz, {Slug: "swing", Name: "Swing"}, smooth, {Slug: "dinner", Name: "Dinner"}},
+		"c2": {smooth, jazz},
+	}
+	if len(chs) != len(want) {
+		t.Fatalf("got %+v", chs)
+	}
+	for _, ch := range chs {
+		if !reflect.DeepEqual(ch.Categories, want[ch.DataId]) {
+			t.Errorf("%s: got %+v, want %+v", ch.DataId, ch.Categories, want[ch.DataId])
+		}
+	}
+	if !strings.Contains(logged.String(), "/gone/") {
+		t.Errorf("missing page not logged: %q", logged.String())
+	}
+}
+
+func TestFetchChannelsEveryPageFails(t *testing.T) {
+	srv := site(t, `<a href="/gone/">Gone</a><a href="/lost/">Lost</a>`, nil)
+	cf := NewChannelFetcher(http.DefaultTransport, Cfg{IndexURI: srv.URL + "/"}, log.New(io.Discard, "", 0))
+	_, err := cf.FetchChannels(context.Background(), tracks.FetchChannelsParams{})
+	if !tracks.IsPermanent(err) {
+		t.Fatalf("got %v, want a permanent error", err)
+	}
+}
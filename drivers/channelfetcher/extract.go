@@ -0,0 +1,187 @@
+package channelfetcher
+
+import (
+	"accu/tracks"
+	"bytes"
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// extractors find channels in a category page, they are tried in order
+// and the first one that finds channels wins.
+var extractors = [...]func(page []byte) []tracks.Channel{
+	extractMarkup,
+	extractJSON,
+	extractRegexp,
+}
+
+func extractChannels(page []byte) []tracks.Channel {
+	for _, extract := range extractors {
+		if chs := extract(page); len(chs) > 0 {
+			return chs
+		}
+	}
+	return nil
+}
+
+var dataIdRegexp = regexp.MustCompile(`^[a-f\d]+$`)
+
+// extractMarkup walks the page with an HTML tokenizer and collects elements
+// that carry a data-id and a data-name attribute, whatever their order.
+func extractMarkup(page []byte) []tracks.Channel {
+	z := xhtml.NewTokenizer(bytes.NewReader(page))
+	var chs []tracks.Channel
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return dedupe(chs)
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			attrs := map[string]string{}
+			_, more := z.TagName()
+			for more {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				attrs[string(k)] = string(v)
+			}
+			id, name := attrs["data-id"], attrs["data-name"]
+			if !dataIdRegexp.MatchString(id) || name == "" {
+				continue
+			}
+			chs = append(chs, tracks.Channel{
+				Name:        strings.TrimSpace(name),
+				DataId:      id,
+				OldId:       attrs["data-oldid"],
+				Description: firstNonEmpty(attrs["data-description"], attrs["data-desc"], attrs["title"]),
+				Image:       firstNonEmpty(attrs["data-image"], attrs["data-img"], attrs["data-logo"]),
+				Categories:  attrCategories(attrs["data-category"], attrs["data-genre"]),
+			})
+		}
+	}
+}
+
+var jsonObjectRegexp = regexp.MustCompile(`\{[^{}]*"_id"\s*:\s*"[a-f\d]+"[^{}]*\}`)
+
+type jsonChannel struct {
+	Id          string `json:"_id"`
+	OldId       json.RawMessage
+	Name        string
+	Description string
+	Image       string
+	Logo        string
+}
+
+// extractJSON looks for channel objects embedded in inline scripts.
+func extractJSON(page []byte) []tracks.Channel {
+	var chs []tracks.Channel
+	for _, raw := range jsonObjectRegexp.FindAll(page, -1) {
+		var jc jsonChannel
+		if err := json.Unmarshal(raw, &jc); err != nil || jc.Name == "" {
+			continue
+		}
+		chs = append(chs, tracks.Channel{
+			Name:        jc.Name,
+			DataId:      jc.Id,
+			OldId:       strings.Trim(string(jc.OldId), `"`),
+			Description: jc.Description,
+			Image:       firstNonEmpty(jc.Image, jc.Logo),
+		})
+	}
+	return dedupe(chs)
+}
+
+// extractRegexp is the original attribute order dependent match.
+func extractRegexp(page []byte) []tracks.Channel {
+	res := channelRegexp.FindAllSubmatch(page, -1)
+	chs := make([]tracks.Channel, 0, len(res))
+	for _, r := range res {
+		chs = append(chs, tracks.Channel{
+			Name:   html.UnescapeString(string(r[2])),
+			DataId: string(r[1]),
+		})
+	}
+	return dedupe(chs)
+}
+
+type link struct {
+	href string
+	text string
+}
+
+func extractLinks(page []byte) []link {
+	z := xhtml.NewTokenizer(bytes.NewReader(page))
+	var links []link
+	cur := -1
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return links
+		case xhtml.StartTagToken:
+			t := z.Token()
+			if t.Data != "a" {
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Key == "href" {
+					links = append(links, link{href: a.Val})
+					cur = len(links) - 1
+				}
+			}
+		case xhtml.TextToken:
+			if cur >= 0 {
+				links[cur].text += string(z.Text())
+			}
+		case xhtml.EndTagToken:
+			if t := z.Token(); t.Data == "a" && cur >= 0 {
+				links[cur].text = strings.TrimSpace(links[cur].text)
+				cur = -1
+			}
+		}
+	}
+}
+
+func dedupe(chs []tracks.Channel) []tracks.Channel {
+	uniq := map[string]struct{}{}
+	res := chs[:0]
+	for _, ch := range chs {
+		if _, ok := uniq[ch.DataId]; ok {
+			continue
+		}
+		uniq[ch.DataId] = struct{}{}
+		res = append(res, ch)
+	}
+	return res
+}
+
+func attrCategories(vals ...string) []tracks.Category {
+	var cs []tracks.Category
+	for _, v := range vals {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		cs = append(cs, tracks.Category{
+			Slug: slugify(v),
+			Name: v,
+		})
+	}
+	return cs
+}
+
+var nonSlugRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(s string) string {
+	return strings.Trim(nonSlugRegexp.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
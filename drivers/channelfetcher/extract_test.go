@@ -0,0 +1,132 @@
+package channelfetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"accu/tracks"
+)
+
+func TestExtractMarkup(t *testing.T) {
+	page := []byte(`<html><body>
+<div data-name="Indie &amp; Alt" data-id="5a1b" data-oldid="101" data-genre="Indie Rock" title="New indie"></div>
+<li data-id='5c2d' data-name=' Shoegaze ' data-img="/shoe.png"/>
+<span data-id="5a1b" data-name="Indie &amp; Alt"></span>
+<div data-id="not-hex" data-name="Bad id"></div>
+<div data-id="7e8f"></div>
+</body></html>`)
+	got := extractMarkup(page)
+	want := []tracks.Channel{
+		{
+			Name:        "Indie & Alt",
+			DataId:      "5a1b",
+			OldId:       "101",
+			Description: "New indie",
+			Categories:  []tracks.Category{{Slug: "indie-rock", Name: "Indie Rock"}},
+		},
+		{Name: "Shoegaze", DataId: "5c2d", Image: "/shoe.png"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	page := []byte(`<script>
+window.channels = [{"_id": "5a1b", "oldid": 101, "name": "Indie & Alt", "logo": "/indie.png"},
+	{"_id": "5c2d", "oldid": "102", "name": "Shoegaze", "description": "Walls of sound"},
+	{"_id": "9a9a", "name": ""}, {"_id": "5a1b", "name": "Indie again"}];
+</script>`)
+	got := extractJSON(page)
+	want := []tracks.Channel{
+		{Name: "Indie & Alt", DataId: "5a1b", OldId: "101", Image: "/indie.png"},
+		{Name: "Shoegaze", DataId: "5c2d", OldId: "102", Description: "Walls of sound"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestExtractRegexp(t *testing.T) {
+	page := []byte(`<a data-id="5a1b" data-oldid="101" data-name='Rock &#39;n&#39; Roll'>
+<a data-id='5c2d'  data-oldid="102" data-name="Jazz &amp; Blues">`)
+	got := extractRegexp(page)
+	want := []tracks.Channel{
+		{Name: "Rock 'n' Roll", DataId: "5a1b"},
+		{Name: "Jazz & Blues", DataId: "5c2d"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestExtractChannelsFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		page string
+		want []string
+	}{
+		{"markup first", `<div data-id="5a1b" data-name="Markup"></div><script>{"_id": "5c2d", "name": "JSON"}</script>`, []string{"Markup"}},
+		{"json", `<div data-id="5a1b"></div><script>{"_id": "5c2d", "name": "JSON"}</script>`, []string{"JSON"}},
+		{"nothing", `<p>maintenance</p>`, nil},
+	} {
+		var names []string
+		for _, ch := range extractChannels([]byte(tc.page)) {
+			names = append(names, ch.Name)
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, names, tc.want)
+		}
+	}
+}
+
+// knownChannels is a tracks.CategoryRepo holding the channels by category.
+type knownChannels map[string][]tracks.Channel
+
+func (k knownChannels) GetCategories(ctx context.Context) ([]tracks.Category, error) {
+	return nil, nil
+}
+
+func (k knownChannels) GetChannelsByCategory(ctx context.Context, slug string) ([]tracks.Channel, error) {
+	return k[slug], nil
+}
+
+func (k knownChannels) GetChannelCategories(ctx context.Context, dataId string) ([]tracks.Category, error) {
+	return nil, nil
+}
+
+func TestFetchChannelsNoChannels(t *testing.T) {
+	page := `<div data-id="5a1b" data-name="Indie"></div>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, page)
+	}))
+	defer srv.Close()
+	known := knownChannels{}
+	newFetcher := func() ChannelFetcher {
+		return NewChannelFetcher(http.DefaultTransport, Cfg{BaseURI: srv.URL + "/indie-rock/", Categories: known}, log.New(io.Discard, "", 0))
+	}
+	ctx := context.Background()
+	chs, err := newFetcher().FetchChannels(ctx, tracks.FetchChannelsParams{})
+	if err != nil || len(chs) != 1 {
+		t.Fatalf("first fetch: %v, %+v", err, chs)
+	}
+	// nothing known yet, an empty page is no drift
+	page = `<p>maintenance</p>`
+	if chs, err := newFetcher().FetchChannels(ctx, tracks.FetchChannelsParams{}); err != nil || len(chs) != 0 {
+		t.Fatalf("nothing known: %v, %+v", err, chs)
+	}
+	// the channels saved by an earlier run, a new fetcher notices too
+	known["indie-rock"] = []tracks.Channel{{DataId: "5a1b", Name: "Indie"}}
+	_, err = newFetcher().FetchChannels(ctx, tracks.FetchChannelsParams{})
+	var de *tracks.DecodeError
+	if !errors.Is(err, tracks.ErrNoChannels) || !errors.As(err, &de) {
+		t.Fatalf("known channels: %v", err)
+	}
+}
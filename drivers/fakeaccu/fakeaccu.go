@@ -0,0 +1,338 @@
+// Package fakeaccu is an in-process AccuRadio look-alike for end-to-end tests.
+// It serves a category page, per channel playlist JSON and small .m4a files
+// from a primary and a secondary audio host, with injectable faults.
+package fakeaccu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CategoryPath = "/indie-rock/"
+	PlaylistPath = "/playlist/json/"
+)
+
+type Song struct {
+	Artist   string
+	Album    string
+	Title    string
+	Year     int
+	Duration float64
+	Fn       string
+}
+
+type Channel struct {
+	DataId   string
+	OldId    int
+	Name     string
+	Rotation []Song
+}
+
+// Faults are applied to the requests of one host. Site faults only
+// apply to playlist requests so channel discovery keeps working.
+type Faults struct {
+	// RateLimitEvery answers every nth request with a 429.
+	RateLimitEvery int
+	RetryAfter     time.Duration
+	// ServerErrorEvery answers every nth request with a 503.
+	ServerErrorEvery int
+	// NotFoundFirst answers the first n requests with a 404.
+	NotFoundFirst int
+	// SlowBody delays every 512 byte chunk of the body.
+	SlowBody time.Duration
+	// Truncate announces the full length of audio bodies but sends half.
+	Truncate bool
+	// SchemaChange serves playlists with numeric years, string durations,
+	// unknown fields and items without links.
+	SchemaChange bool
+}
+
+type Cfg struct {
+	Channels []Channel
+	// PlaylistSize is the number of songs per playlist response.
+	PlaylistSize int
+	// Shuffle picks random songs of the rotation instead of walking it in order.
+	Shuffle bool
+	Seed    int64
+}
+
+type Server struct {
+	Site      *httptest.Server
+	Primary   *httptest.Server
+	Secondary *httptest.Server
+
+	cfg      Cfg
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	cursor   map[string]int
+	faults   map[string]Faults
+	requests map[string]int
+}
+
+func NewServer(cfg Cfg) *Server {
+	if cfg.PlaylistSize == 0 {
+		cfg.PlaylistSize = 4
+	}
+	s := &Server{
+		cfg:      cfg,
+		rnd:      rand.New(rand.NewSource(cfg.Seed)),
+		cursor:   map[string]int{},
+		faults:   map[string]Faults{},
+		requests: map[string]int{},
+	}
+	s.Site = httptest.NewServer(s.handler("site", s.serveSite))
+	s.Primary = httptest.NewServer(s.handler("primary", s.serveAudio))
+	s.Secondary = httptest.NewServer(s.handler("secondary", s.serveAudio))
+	return s
+}
+
+func (s *Server) Close() {
+	s.Site.Close()
+	s.Primary.Close()
+	s.Secondary.Close()
+}
+
+func (s *Server) CategoryURI() string {
+	return s.Site.URL + CategoryPath
+}
+
+func (s *Server) PlaylistURI() string {
+	return s.Site.URL + PlaylistPath
+}
+
+// SetFaults replaces the faults of "site", "primary" or "secondary".
+func (s *Server) SetFaults(host string, f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[host] = f
+	s.requests[host] = 0
+}
+
+// SetChannels replaces the channels listed on the category page and
+// served as playlists.
+func (s *Server) SetChannels(channels []Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.Channels = channels
+}
+
+func (s *Server) channels() []Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg.Channels
+}
+
+// Requests returns the number of requests a host received since its faults were last set.
+func (s *Server) Requests(host string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[host]
+}
+
+func (s *Server) handler(host string, serve func(w http.ResponseWriter, r *http.Request, f Faults)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		f := s.faults[host]
+		faulty := host != "site" || strings.HasPrefix(r.URL.Path, PlaylistPath)
+		var n int
+		if faulty {
+			s.requests[host]++
+			n = s.requests[host]
+		}
+		s.mu.Unlock()
+		if faulty {
+			if f.RateLimitEvery > 0 && n%f.RateLimitEvery == 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(f.RetryAfter.Seconds())))
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+			if f.ServerErrorEvery > 0 && n%f.ServerErrorEvery == 0 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if n <= f.NotFoundFirst {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		serve(w, r, f)
+	})
+}
+
+func (s *Server) serveSite(w http.ResponseWriter, r *http.Request, f Faults) {
+	switch {
+	case r.URL.Path == CategoryPath:
+		s.serveCategory(w)
+	case strings.HasPrefix(r.URL.Path, PlaylistPath):
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, PlaylistPath), "/")
+		s.servePlaylist(w, r, id, f)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveCategory(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var b strings.Builder
+	b.WriteString("<!doctype html><html><body><ul>\n")
+	for _, ch := range s.channels() {
+		fmt.Fprintf(&b, "<li class=\"channel\" data-id=\"%s\" data-oldid=\"%d\" data-name=\"%s\"><a href=\"#\">%s</a></li>\n",
+			ch.DataId, ch.OldId, html.EscapeString(ch.Name), html.EscapeString(ch.Name))
+	}
+	b.WriteString("</ul></body></html>\n")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, id string, f Faults) {
+	var ch *Channel
+	channels := s.channels()
+	for i := range channels {
+		if channels[i].DataId == id {
+			ch = &channels[i]
+		}
+	}
+	if ch == nil {
+		http.NotFound(w, r)
+		return
+	}
+	songs := s.pick(ch)
+	items := make([]map[string]any, 0, len(songs))
+	for _, song := range songs {
+		item := map[string]any{
+			"album": map[string]any{
+				"title": song.Album,
+				"year":  strconv.Itoa(song.Year),
+			},
+			"track_artist": song.Artist,
+			"title":        song.Title,
+			"primary":      s.Primary.URL + "/",
+			"secondary":    s.Secondary.URL + "/",
+			"fn":           song.Fn,
+			"duration":     song.Duration,
+		}
+		if f.SchemaChange {
+			item["album"].(map[string]any)["year"] = song.Year
+			item["duration"] = strconv.FormatFloat(song.Duration, 'f', -1, 64)
+			item["isrc"] = "XX" + song.Fn
+		}
+		items = append(items, item)
+	}
+	if f.SchemaChange {
+		items = append(items, map[string]any{"title": "station id", "primary": nil})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	raw, _ := json.Marshal(items)
+	writeBody(w, raw, f, false)
+}
+
+func (s *Server) pick(ch *Channel) []Song {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.cfg.PlaylistSize
+	if n > len(ch.Rotation) {
+		n = len(ch.Rotation)
+	}
+	songs := make([]Song, 0, n)
+	if s.cfg.Shuffle {
+		for _, i := range s.rnd.Perm(len(ch.Rotation))[:n] {
+			songs = append(songs, ch.Rotation[i])
+		}
+		return songs
+	}
+	c := s.cursor[ch.DataId]
+	for i := 0; i < n; i++ {
+		songs = append(songs, ch.Rotation[(c+i)%len(ch.Rotation)])
+	}
+	s.cursor[ch.DataId] = (c + n) % len(ch.Rotation)
+	return songs
+}
+
+func (s *Server) serveAudio(w http.ResponseWriter, r *http.Request, f Faults) {
+	fn := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m4a")
+	if !strings.HasSuffix(r.URL.Path, ".m4a") || !s.known(fn) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/mp4")
+	writeBody(w, M4A(fn), f, true)
+}
+
+func (s *Server) known(fn string) bool {
+	for _, ch := range s.channels() {
+		for _, song := range ch.Rotation {
+			if song.Fn == fn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeBody(w http.ResponseWriter, body []byte, f Faults, audio bool) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if audio && f.Truncate {
+		body = body[:len(body)/2]
+	}
+	flusher, _ := w.(http.Flusher)
+	const chunk = 512
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		body = body[n:]
+		if f.SlowBody > 0 {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			time.Sleep(f.SlowBody)
+		}
+	}
+}
+
+// M4A returns a small but structurally valid MPEG-4 audio file:
+// an ftyp box, a moov box holding a movie header and an mdat box
+// whose payload is derived from seed.
+func M4A(seed string) []byte {
+	box := func(typ string, payload []byte) []byte {
+		b := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+		copy(b[4:], typ)
+		return append(b, payload...)
+	}
+	ftyp := box("ftyp", []byte("M4A \x00\x00\x00\x00M4A mp42isom"))
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)       // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 1000)       // duration
+	binary.BigEndian.PutUint32(mvhd[20:], 0x10000)    // rate 1.0
+	binary.BigEndian.PutUint16(mvhd[24:], 0x100)      // volume 1.0
+	binary.BigEndian.PutUint32(mvhd[36:], 0x10000)    // matrix
+	binary.BigEndian.PutUint32(mvhd[52:], 0x10000)    // matrix
+	binary.BigEndian.PutUint32(mvhd[68:], 0x40000000) // matrix
+	binary.BigEndian.PutUint32(mvhd[96:], 2)          // next track id
+	moov := box("moov", box("mvhd", mvhd))
+	if seed == "" {
+		seed = "m4a"
+	}
+	payload := make([]byte, 2048)
+	rnd := rand.New(rand.NewSource(int64(len(seed))))
+	for i := range payload {
+		payload[i] = seed[i%len(seed)] ^ byte(rnd.Intn(256))
+	}
+	mdat := box("mdat", payload)
+	out := append(ftyp, moov...)
+	return append(out, mdat...)
+}
@@ -0,0 +1,173 @@
+// Package faults is an http.RoundTripper that injects failures into the
+// requests it passes on, to exercise retries and partial downloads locally.
+package faults
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Rule injects its faults into requests whose host and path match,
+// with the given probability. Faults of one rule are applied in field order:
+// the latency first, then the first of reset, throttle and status that is
+// set, otherwise the upstream response body is cut short.
+type Rule struct {
+	// Host and Path match any request when nil.
+	Host *regexp.Regexp
+	Path *regexp.Regexp
+	// Probability is between 0 and 1, a rule with 0 never fires.
+	Probability float64
+
+	Latency time.Duration
+	// Reset fails the request with a connection reset before it is sent.
+	Reset bool
+	// Throttle answers with a 429 asking to retry after the duration.
+	Throttle time.Duration
+	// Status answers with the status instead of calling the upstream.
+	Status int
+	// PartialBody is the fraction of the upstream body that is delivered
+	// before the read fails with io.ErrUnexpectedEOF, 0 disables it.
+	PartialBody float64
+}
+
+func (r Rule) matches(req *http.Request) bool {
+	if r.Host != nil && !r.Host.MatchString(req.URL.Host) {
+		return false
+	}
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	return true
+}
+
+type Cfg struct {
+	Rules []Rule
+	Seed  int64
+}
+
+type Transport struct {
+	next  http.RoundTripper
+	rules []Rule
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	fired []int
+}
+
+func New(next http.RoundTripper, cfg Cfg) *Transport {
+	return &Transport{
+		next:  next,
+		rules: cfg.Rules,
+		rnd:   rand.New(rand.NewSource(cfg.Seed)),
+		fired: make([]int, len(cfg.Rules)),
+	}
+}
+
+// Fired returns how many times each rule was applied, in rule order.
+func (t *Transport) Fired() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]int(nil), t.fired...)
+}
+
+// pick returns the first matching rule that fires for req.
+func (t *Transport) pick(req *http.Request) (Rule, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range t.rules {
+		if !r.matches(req) || t.rnd.Float64() >= r.Probability {
+			continue
+		}
+		t.fired[i]++
+		return r, true
+	}
+	return Rule{}, false
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, ok := t.pick(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if r.Latency > 0 {
+		timer := time.NewTimer(r.Latency)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	switch {
+	case r.Reset:
+		return nil, &net.OpError{
+			Op:  "read",
+			Net: "tcp",
+			Err: syscall.ECONNRESET,
+		}
+	case r.Throttle > 0:
+		resp := response(req, http.StatusTooManyRequests)
+		resp.Header.Set("Retry-After", strconv.Itoa(int(r.Throttle.Round(time.Second)/time.Second)))
+		return resp, nil
+	case r.Status != 0:
+		return response(req, r.Status), nil
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || r.PartialBody <= 0 {
+		return resp, err
+	}
+	limit := int64(1 << 10)
+	if resp.ContentLength > 0 {
+		limit = int64(float64(resp.ContentLength) * r.PartialBody)
+	}
+	resp.Body = &partialBody{
+		rc:   resp.Body,
+		left: limit,
+	}
+	return resp, nil
+}
+
+func response(req *http.Request, status int) *http.Response {
+	body := fmt.Sprintf("injected %d %s\n", status, http.StatusText(status))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// partialBody delivers left bytes and then fails as if the connection dropped.
+type partialBody struct {
+	rc   io.ReadCloser
+	left int64
+}
+
+func (p *partialBody) Read(b []byte) (int, error) {
+	if p.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(b)) > p.left {
+		b = b[:p.left]
+	}
+	n, err := p.rc.Read(b)
+	p.left -= int64(n)
+	return n, err
+}
+
+func (p *partialBody) Close() error {
+	return p.rc.Close()
+}
@@ -0,0 +1,83 @@
+package faults
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer srv.Close()
+	tr := New(http.DefaultTransport, Cfg{
+		Rules: []Rule{
+			{Path: regexp.MustCompile(`^/reset`), Probability: 1, Reset: true},
+			{Path: regexp.MustCompile(`^/throttle`), Probability: 1, Throttle: 3 * time.Second},
+			{Path: regexp.MustCompile(`^/status`), Probability: 1, Status: http.StatusBadGateway},
+			{Path: regexp.MustCompile(`^/partial`), Probability: 1, PartialBody: 0.25},
+			{Path: regexp.MustCompile(`^/never`), Probability: 0, Reset: true},
+			{Host: regexp.MustCompile(`^example\.invalid$`), Probability: 1, Reset: true},
+		},
+	})
+	c := &http.Client{Transport: tr}
+
+	if _, err := c.Get(srv.URL + "/reset"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("reset: got %v", err)
+	}
+	resp, err := c.Get(srv.URL + "/throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("throttle: got %d retry after %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	resp, err = c.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status: got %d", resp.StatusCode)
+	}
+	resp, err = c.Get(srv.URL + "/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(body) != 250 {
+		t.Errorf("partial: got %d bytes and %v", len(body), err)
+	}
+	resp, err = c.Get(srv.URL + "/never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("never: got %d", resp.StatusCode)
+	}
+	if got, want := tr.Fired(), []int{1, 1, 1, 1, 0, 0}; !equal(got, want) {
+		t.Errorf("fired %v, want %v", got, want)
+	}
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,254 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"accu/tracks"
+)
+
+var errNotAList = errors.New("playlist is not a list")
+
+// driftRecorder accumulates the drift of every decoded playlist.
+type driftRecorder struct {
+	sync.Mutex
+	r tracks.DriftReport
+}
+
+func newDriftRecorder() *driftRecorder {
+	return &driftRecorder{
+		r: tracks.DriftReport{
+			UnknownFields:  map[string]int{},
+			TypeMismatches: map[string]int{},
+			MissingFields:  map[string]int{},
+		},
+	}
+}
+
+func (d *driftRecorder) add(r tracks.DriftReport) {
+	d.Lock()
+	defer d.Unlock()
+	d.r.Items += r.Items
+	d.r.Skipped += r.Skipped
+	for k, v := range r.UnknownFields {
+		d.r.UnknownFields[k] += v
+	}
+	for k, v := range r.TypeMismatches {
+		d.r.TypeMismatches[k] += v
+	}
+	for k, v := range r.MissingFields {
+		d.r.MissingFields[k] += v
+	}
+}
+
+func (d *driftRecorder) report() tracks.DriftReport {
+	d.Lock()
+	defer d.Unlock()
+	r := d.r
+	r.UnknownFields = copyCounts(d.r.UnknownFields)
+	r.TypeMismatches = copyCounts(d.r.TypeMismatches)
+	r.MissingFields = copyCounts(d.r.MissingFields)
+	return r
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// decoder reads one playlist, accepting strings for numbers and the other
+// way round, nulls and missing fields. Items that can't produce a download
+// link are skipped instead of failing the whole playlist.
+type decoder struct {
+	report tracks.DriftReport
+}
+
+var knownFields = map[string]map[string]struct{}{
+	"": {
+		"album":        {},
+		"track_artist": {},
+		"title":        {},
+		"primary":      {},
+		"secondary":    {},
+		"fn":           {},
+		"duration":     {},
+	},
+	"album": {
+		"title": {},
+		"year":  {},
+	},
+}
+
+func decodePlaylist(r io.Reader) ([]rawTrack, tracks.DriftReport, error) {
+	d := decoder{
+		report: tracks.DriftReport{
+			UnknownFields:  map[string]int{},
+			TypeMismatches: map[string]int{},
+			MissingFields:  map[string]int{},
+		},
+	}
+	var items []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return nil, d.report, errNotAList
+		}
+		return nil, d.report, err
+	}
+	res := make([]rawTrack, 0, len(items))
+	for _, item := range items {
+		d.report.Items++
+		rt, ok := d.track(item)
+		if !ok {
+			d.report.Skipped++
+			continue
+		}
+		res = append(res, rt)
+	}
+	return res, d.report, nil
+}
+
+func (d *decoder) track(raw json.RawMessage) (rawTrack, bool) {
+	fields, ok := d.object("", raw)
+	if !ok {
+		return rawTrack{}, false
+	}
+	var rt rawTrack
+	rt.TrackArtist, _ = d.string("track_artist", fields)
+	rt.Title, _ = d.string("title", fields)
+	rt.Secondary, _ = d.string("secondary", fields)
+	rt.Duration, _ = d.number("duration", fields)
+	primary, okPrimary := d.string("primary", fields)
+	fn, okFn := d.string("fn", fields)
+	if !okPrimary || !okFn || primary == "" || fn == "" {
+		return rawTrack{}, false
+	}
+	rt.Primary, rt.Fn = primary, fn
+	rawAlbum, ok := d.field("album", fields)
+	switch {
+	case !ok:
+	case isString(rawAlbum):
+		d.report.TypeMismatches["album"]++
+		rt.Album.Title, _ = d.string("album", fields)
+	default:
+		album, ok := d.object("album", rawAlbum)
+		if !ok {
+			break
+		}
+		rt.Album.Title, _ = d.string("album.title", album)
+		if year, ok := d.string("album.year", album); ok && year != "" {
+			y, err := strconv.Atoi(strings.TrimSpace(year))
+			if err != nil {
+				d.report.TypeMismatches["album.year"]++
+			}
+			rt.Album.Year = y
+		}
+	}
+	return rt, true
+}
+
+func (d *decoder) object(path string, raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		if path == "" {
+			path = "$"
+		}
+		d.report.TypeMismatches[path]++
+		return nil, false
+	}
+	for k := range fields {
+		if _, ok := knownFields[path][strings.ToLower(k)]; !ok {
+			d.report.UnknownFields[join(path, k)]++
+		}
+	}
+	return fields, true
+}
+
+// string reads the last segment of path from fields, numbers are formatted.
+func (d *decoder) string(path string, fields map[string]json.RawMessage) (string, bool) {
+	raw, ok := d.field(path, fields)
+	if !ok {
+		return "", false
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, true
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		d.report.TypeMismatches[path]++
+		return n.String(), true
+	}
+	d.report.TypeMismatches[path]++
+	return "", false
+}
+
+// number reads the last segment of path from fields, numeric strings are parsed.
+func (d *decoder) number(path string, fields map[string]json.RawMessage) (float64, bool) {
+	raw, ok := d.field(path, fields)
+	if !ok {
+		return 0, false
+	}
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return f, true
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if s == "" {
+			return 0, false
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			d.report.TypeMismatches[path]++
+			return f, true
+		}
+	}
+	d.report.TypeMismatches[path]++
+	return 0, false
+}
+
+func (d *decoder) field(path string, fields map[string]json.RawMessage) (json.RawMessage, bool) {
+	key := path
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		key = path[i+1:]
+	}
+	raw, ok := fields[key]
+	if !ok {
+		for k, v := range fields {
+			if strings.EqualFold(k, key) {
+				raw, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok || isNull(raw) {
+		d.report.MissingFields[path]++
+		return nil, false
+	}
+	return raw, true
+}
+
+func isNull(raw json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
+
+func isString(raw json.RawMessage) bool {
+	raw = bytes.TrimSpace(raw)
+	return len(raw) > 0 && raw[0] == '"'
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return fmt.Sprintf("%s.%s", path, key)
+}
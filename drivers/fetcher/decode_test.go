@@ -0,0 +1,140 @@
+package fetcher
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodePlaylist(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    []rawTrack
+		skipped int
+		unknown map[string]int
+		types   map[string]int
+		missing map[string]int
+	}{
+		{
+			name:    "expected schema",
+			payload: `[{"album": {"title": "Loveless", "year": "1991"}, "track_artist": "MBV", "title": "Soon", "primary": "p/", "secondary": "s/", "fn": "abc", "duration": 420.5}]`,
+			want:    []rawTrack{{Album: rawAlbum{Title: "Loveless", Year: 1991}, TrackArtist: "MBV", Title: "Soon", Primary: "p/", Secondary: "s/", Fn: "abc", Duration: 420.5}},
+		},
+		{
+			name:    "numbers as strings",
+			payload: `[{"primary": "p/", "fn": "abc", "duration": " 180.5 ", "album": {"year": " 2001 "}}]`,
+			want:    []rawTrack{{Primary: "p/", Fn: "abc", Duration: 180.5, Album: rawAlbum{Year: 2001}}},
+			types:   map[string]int{"duration": 1},
+			missing: map[string]int{"track_artist": 1, "title": 1, "secondary": 1, "album.title": 1},
+		},
+		{
+			name:    "strings as numbers",
+			payload: `[{"primary": "p/", "fn": 123, "title": 7, "album": {"title": "A", "year": 1999}}]`,
+			want:    []rawTrack{{Primary: "p/", Fn: "123", Title: "7", Album: rawAlbum{Title: "A", Year: 1999}}},
+			types:   map[string]int{"fn": 1, "title": 1, "album.year": 1},
+			missing: map[string]int{"track_artist": 1, "secondary": 1, "duration": 1},
+		},
+		{
+			name:    "nulls",
+			payload: `[{"primary": "p/", "fn": "abc", "title": null, "album": null, "duration": null, "track_artist": null, "secondary": null}]`,
+			want:    []rawTrack{{Primary: "p/", Fn: "abc"}},
+			missing: map[string]int{"track_artist": 1, "title": 1, "secondary": 1, "duration": 1, "album": 1},
+		},
+		{
+			name:    "album as a string",
+			payload: `[{"primary": "p/", "fn": "abc", "album": "Loveless", "track_artist": "MBV", "title": "Soon", "secondary": "s/", "duration": 1}]`,
+			want:    []rawTrack{{Primary: "p/", Fn: "abc", Album: rawAlbum{Title: "Loveless"}, TrackArtist: "MBV", Title: "Soon", Secondary: "s/", Duration: 1}},
+			types:   map[string]int{"album": 1},
+		},
+		{
+			name: "skipped items",
+			payload: `[{"title": "station id", "primary": "p/"},
+				{"primary": "p/", "fn": ""},
+				{"primary": null, "fn": "abc"},
+				"not an object",
+				{"Primary": "p/", "FN": "kept", "track_artist": "a", "title": "t", "secondary": "s/", "duration": 1, "album": {"title": "x", "year": "2000"}}]`,
+			want:    []rawTrack{{Primary: "p/", Fn: "kept", TrackArtist: "a", Title: "t", Secondary: "s/", Duration: 1, Album: rawAlbum{Title: "x", Year: 2000}}},
+			skipped: 4,
+			types:   map[string]int{"$": 1},
+			missing: map[string]int{"fn": 1, "primary": 1, "track_artist": 3, "secondary": 3, "duration": 3, "title": 2},
+		},
+		{
+			name:    "unknown fields",
+			payload: `[{"primary": "p/", "fn": "abc", "track_artist": "a", "title": "t", "secondary": "s/", "duration": 1, "isrc": "XX1", "album": {"title": "x", "year": "2000", "label": "Creation"}}]`,
+			want:    []rawTrack{{Primary: "p/", Fn: "abc", TrackArtist: "a", Title: "t", Secondary: "s/", Duration: 1, Album: rawAlbum{Title: "x", Year: 2000}}},
+			unknown: map[string]int{"isrc": 1, "album.label": 1},
+		},
+	} {
+		got, report, err := decodePlaylist(strings.NewReader(tc.payload))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+		if items := tc.skipped + len(tc.want); report.Items != items {
+			t.Errorf("%s: %d items, want %d", tc.name, report.Items, items)
+		}
+		if report.Skipped != tc.skipped {
+			t.Errorf("%s: skipped %d, want %d", tc.name, report.Skipped, tc.skipped)
+		}
+		for _, c := range []struct {
+			kind      string
+			got, want map[string]int
+		}{
+			{"unknown fields", report.UnknownFields, tc.unknown},
+			{"type mismatches", report.TypeMismatches, tc.types},
+			{"missing fields", report.MissingFields, tc.missing},
+		} {
+			if len(c.got) == 0 && len(c.want) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(c.got, c.want) {
+				t.Errorf("%s: %s %v, want %v", tc.name, c.kind, c.got, c.want)
+			}
+		}
+		if drifted := len(tc.unknown)+len(tc.types)+len(tc.missing)+tc.skipped > 0; report.Drifted() != drifted {
+			t.Errorf("%s: drifted %t, want %t", tc.name, report.Drifted(), drifted)
+		}
+	}
+}
+
+func TestDecodePlaylistNotAList(t *testing.T) {
+	for _, payload := range []string{`{"error": "maintenance"}`, `"nope"`, `42`} {
+		if _, _, err := decodePlaylist(strings.NewReader(payload)); !errors.Is(err, errNotAList) {
+			t.Errorf("%s: %v, want errNotAList", payload, err)
+		}
+	}
+	if _, _, err := decodePlaylist(strings.NewReader(`[{"primary"`)); err == nil || errors.Is(err, errNotAList) {
+		t.Errorf("truncated payload: %v", err)
+	}
+	got, report, err := decodePlaylist(strings.NewReader(`null`))
+	if err != nil || len(got) != 0 || report.Items != 0 {
+		t.Errorf("null payload: %v, %+v, %+v", err, got, report)
+	}
+}
+
+func TestDriftRecorder(t *testing.T) {
+	d := newDriftRecorder()
+	for _, payload := range []string{
+		`[{"primary": "p/", "fn": "a", "isrc": "1"}]`,
+		`[{"primary": "p/", "fn": "b", "isrc": "2"}, {"title": "station id"}]`,
+	} {
+		_, report, err := decodePlaylist(strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.add(report)
+	}
+	r := d.report()
+	if r.Items != 3 || r.Skipped != 1 || r.UnknownFields["isrc"] != 2 {
+		t.Errorf("report %s", r)
+	}
+	r.UnknownFields["isrc"] = 0
+	if d.report().UnknownFields["isrc"] != 2 {
+		t.Error("report shares its counts with the recorder")
+	}
+}
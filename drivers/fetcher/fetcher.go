@@ -1,10 +1,9 @@
 package fetcher
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
-	"strconv"
 
 	"accu/tracks"
 )
@@ -14,8 +13,9 @@ type Cfg struct {
 }
 
 type TrackListFetcher struct {
-	cfg Cfg
-	c   *http.Client
+	cfg   Cfg
+	c     *http.Client
+	drift *driftRecorder
 }
 
 func NewTrackListFetcher(rt http.RoundTripper, cfg Cfg) TrackListFetcher {
@@ -23,26 +23,43 @@ func NewTrackListFetcher(rt http.RoundTripper, cfg Cfg) TrackListFetcher {
 		c: &http.Client{
 			Transport: rt,
 		},
-		cfg: cfg,
+		cfg:   cfg,
+		drift: newDriftRecorder(),
 	}
 }
 
-var _ tracks.TracksFetcher = TrackListFetcher{}
+var (
+	_ tracks.TracksFetcher = TrackListFetcher{}
+	_ tracks.DriftReporter = TrackListFetcher{}
+)
 
-func (tlf TrackListFetcher) FetchTracks(p tracks.FetchTracksParams) ([]tracks.Track, error) {
+func (tlf TrackListFetcher) FetchTracks(ctx context.Context, p tracks.FetchTracksParams) ([]tracks.Track, error) {
 	handleErr := func(err error) ([]tracks.Track, error) {
 		return nil, fmt.Errorf("fetch tracks: %w", err)
 	}
+	ctx, cancel := p.WithTimeout(ctx)
+	defer cancel()
 	uri := tlf.cfg.BaseURI + p.Channel + "/"
-	resp, err := tlf.c.Get(uri)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 	if err != nil {
 		return handleErr(err)
 	}
+	for k, v := range p.Metadata {
+		req.Header.Set(k, v)
+	}
+	resp, err := tlf.c.Do(req)
+	if err != nil {
+		return handleErr(&tracks.TransportError{URI: uri, Err: err})
+	}
 	defer resp.Body.Close()
-	var rawTracks []rawTrack
-	if err := json.NewDecoder(resp.Body).Decode(&rawTracks); err != nil {
+	if err := tracks.CheckStatus(resp); err != nil {
 		return handleErr(err)
 	}
+	rawTracks, report, err := decodePlaylist(resp.Body)
+	tlf.drift.add(report)
+	if err != nil {
+		return handleErr(&tracks.DecodeError{URI: uri, Err: err})
+	}
 	tracks := make([]tracks.Track, 0, len(rawTracks))
 	for _, rt := range rawTracks {
 		tracks = append(tracks, rt.toTrack(p.Channel))
@@ -50,14 +67,18 @@ func (tlf TrackListFetcher) FetchTracks(p tracks.FetchTracksParams) ([]tracks.Tr
 	return tracks, nil
 }
 
+func (tlf TrackListFetcher) DriftReport() tracks.DriftReport {
+	return tlf.drift.report()
+}
+
 type rawAlbum struct {
 	Title string
-	Year  string
+	Year  int
 }
 
 type rawTrack struct {
 	Album       rawAlbum
-	TrackArtist string `json:"track_artist"`
+	TrackArtist string
 	Title,
 	Primary,
 	Secondary,
@@ -66,15 +87,20 @@ type rawTrack struct {
 }
 
 func (r rawTrack) toTrack(channel string) tracks.Track {
-	year, _ := strconv.Atoi(r.Album.Year)
+	primaryLink := r.Primary + r.Fn + ".m4a"
+	secondaryLink := primaryLink
+	if r.Secondary != "" {
+		secondaryLink = r.Secondary + r.Fn + ".m4a"
+	}
 	return tracks.Track{
+		ID:            tracks.TrackID(r.Fn),
 		Channel:       channel,
 		Artist:        r.TrackArtist,
 		Album:         r.Album.Title,
 		Title:         r.Title,
 		Duration:      int(r.Duration),
-		Year:          year,
-		PrimaryLink:   r.Primary + r.Fn + ".m4a",
-		SecondaryLink: r.Secondary + r.Fn + ".m4a",
+		Year:          r.Album.Year,
+		PrimaryLink:   primaryLink,
+		SecondaryLink: secondaryLink,
 	}
 }
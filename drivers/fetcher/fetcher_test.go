@@ -0,0 +1,82 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"accu/drivers/cassette"
+	"accu/drivers/httpcache"
+	"accu/tracks"
+)
+
+func TestFetchTracksReplayed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(`[{"primary": "https://cdn/", "fn": "abc", "title": "t"}]`))
+	}))
+	defer srv.Close()
+	store, err := httpcache.NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	rec, err := cassette.NewRecorder(http.DefaultTransport, cassette.RecorderCfg{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(f TrackListFetcher) (bool, error) {
+		info := &tracks.FetchInfo{}
+		trcks, err := f.FetchTracks(tracks.WithFetchInfo(context.Background(), info), tracks.FetchTracksParams{Channel: "5a1b"})
+		if err == nil && len(trcks) != 1 {
+			err = fmt.Errorf("%d tracks", len(trcks))
+		}
+		return info.Replayed, err
+	}
+	for _, tc := range []struct {
+		name string
+		rt   func() http.RoundTripper
+		want []bool
+	}{
+		{"cache", func() http.RoundTripper { return httpcache.New(http.DefaultTransport, httpcache.Cfg{Store: store}) }, []bool{false, true}},
+		{"record", func() http.RoundTripper { return rec }, []bool{false}},
+		{"replay", func() http.RoundTripper {
+			rp, err := cassette.NewReplayer(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return rp
+		}, []bool{true, true}},
+	} {
+		f := NewTrackListFetcher(tc.rt(), Cfg{BaseURI: srv.URL + "/"})
+		for i, want := range tc.want {
+			replayed, err := fetch(f)
+			if err != nil {
+				t.Fatalf("%s fetch %d: %v", tc.name, i, err)
+			}
+			if replayed != want {
+				t.Errorf("%s fetch %d: replayed %t, want %t", tc.name, i, replayed, want)
+			}
+		}
+		// without a FetchInfo the fetch works all the same
+		if _, err := f.FetchTracks(context.Background(), tracks.FetchTracksParams{Channel: "5a1b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestToTrackID checks the ID from the playlist is the one the repos derive
+// from the links when backfilling.
+func TestToTrackID(t *testing.T) {
+	for fn, want := range map[string]string{"abc": "abc", "abc.v2": "abc.v2", "x/abc.v2": "x/abc.v2", "x/abc.m4a": "x/abc.m4a"} {
+		trk := rawTrack{Primary: "https://cdn/", Secondary: "https://cdn2/", Fn: fn}.toTrack("ch")
+		if trk.ID != want {
+			t.Errorf("fn %q got ID %q, want %q", fn, trk.ID, want)
+		}
+		if id := tracks.LinkTrackID(trk.PrimaryLink, trk.SecondaryLink); id != trk.ID {
+			t.Errorf("fn %q got ID %q, the links give %q", fn, trk.ID, id)
+		}
+	}
+}
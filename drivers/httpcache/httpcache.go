@@ -0,0 +1,287 @@
+// Package httpcache is a private HTTP cache in the form of an
+// http.RoundTripper. It honours Cache-Control, Expires, ETag and
+// Last-Modified and revalidates stale entries with conditional requests.
+// Only 200 responses to GET requests are cached and Vary is ignored. A stale
+// entry is served when its revalidation fails with a 5xx or a transport
+// error, unless it must be revalidated.
+package httpcache
+
+import (
+	"accu/tracks"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultMaxBodySize = 2 << 20
+
+// TTLRule overrides the freshness the upstream advertises for matching
+// URLs, a negative TTL disables caching for them.
+type TTLRule struct {
+	Pattern *regexp.Regexp
+	TTL     time.Duration
+}
+
+type Cfg struct {
+	Store Store
+	// Rules are tried in order, the first match wins.
+	Rules []TTLRule
+	// MaxBodySize is the largest body that is cached, bigger responses,
+	// such as audio files, are passed through.
+	MaxBodySize int64
+}
+
+type Stats struct {
+	Hits        int
+	Revalidated int
+	// Stale counts the stale entries served because revalidation failed.
+	Stale       int
+	Misses      int
+	Bypassed    int
+	StoreErrors int
+}
+
+func (s Stats) String() string {
+	total := s.Hits + s.Revalidated + s.Stale + s.Misses
+	ratio := 0.0
+	if total > 0 {
+		ratio = float64(s.Hits+s.Revalidated+s.Stale) / float64(total) * 100
+	}
+	return fmt.Sprintf("%d hits, %d revalidated, %d stale, %d misses (%.1f%% served from cache), %d bypassed, %d store errors",
+		s.Hits, s.Revalidated, s.Stale, s.Misses, ratio, s.Bypassed, s.StoreErrors)
+}
+
+type Transport struct {
+	next  http.RoundTripper
+	cfg   Cfg
+	mu    sync.Mutex
+	stats Stats
+}
+
+func New(next http.RoundTripper, cfg Cfg) *Transport {
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+	return &Transport{
+		next: next,
+		cfg:  cfg,
+	}
+}
+
+func (t *Transport) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+func (t *Transport) count(f func(s *Stats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.stats)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqCC := parseCacheControl(req.Header.Get("Cache-Control"))
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || reqCC.has("no-store") {
+		t.count(func(s *Stats) { s.Bypassed++ })
+		return t.next.RoundTrip(req)
+	}
+	key := req.URL.String()
+	e, ok, err := t.cfg.Store.Get(req.Context(), key)
+	if err != nil {
+		t.count(func(s *Stats) { s.StoreErrors++ })
+		ok = false
+	}
+	if !ok {
+		t.count(func(s *Stats) { s.Misses++ })
+		return t.fetch(req, key)
+	}
+	if !reqCC.has("no-cache") && time.Since(e.StoredAt) < e.Lifetime {
+		t.count(func(s *Stats) { s.Hits++ })
+		tracks.MarkReplayed(req.Context())
+		return e.response(req, "HIT"), nil
+	}
+	// without validators the stale entry is fetched again unconditionally
+	creq := req.Clone(req.Context())
+	if etag := e.Header.Get("ETag"); etag != "" {
+		creq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		creq.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := t.next.RoundTrip(creq)
+	if t.serveStale(req, e, resp, err) {
+		t.count(func(s *Stats) { s.Stale++ })
+		tracks.MarkReplayed(req.Context())
+		return e.response(req, "STALE"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		t.count(func(s *Stats) { s.Misses++ })
+		return t.store(req, key, resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	t.count(func(s *Stats) { s.Revalidated++ })
+	for _, h := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			e.Header.Set(h, v)
+		}
+	}
+	if lifetime, ok := t.lifetime(key, e.Header); ok {
+		e.Lifetime = lifetime
+	}
+	e.StoredAt = time.Now()
+	if err := t.cfg.Store.Set(req.Context(), key, e); err != nil {
+		t.count(func(s *Stats) { s.StoreErrors++ })
+	}
+	tracks.MarkReplayed(req.Context())
+	return e.response(req, "REVALIDATED"), nil
+}
+
+// serveStale reports whether e is served in place of a failed
+// revalidation, the failed response is closed then.
+func (t *Transport) serveStale(req *http.Request, e Entry, resp *http.Response, err error) bool {
+	if err != nil && req.Context().Err() != nil {
+		return false
+	}
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		return false
+	}
+	if parseCacheControl(e.Header.Get("Cache-Control")).has("must-revalidate") {
+		return false
+	}
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return true
+}
+
+func (t *Transport) fetch(req *http.Request, key string) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.store(req, key, resp)
+}
+
+// store caches resp if it is cacheable and returns it with a replayable body.
+func (t *Transport) store(req *http.Request, key string, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > t.cfg.MaxBodySize {
+		return resp, nil
+	}
+	lifetime, ok := t.lifetime(key, resp.Header)
+	if !ok {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.cfg.MaxBodySize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.cfg.MaxBodySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	e := Entry{
+		URL:      key,
+		Header:   resp.Header.Clone(),
+		Body:     body,
+		StoredAt: time.Now(),
+		Lifetime: lifetime,
+	}
+	if err := t.cfg.Store.Set(req.Context(), key, e); err != nil {
+		t.count(func(s *Stats) { s.StoreErrors++ })
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+// lifetime returns how long a response is fresh and whether it may be stored.
+// Responses without a lifetime are only stored when they can be revalidated.
+func (t *Transport) lifetime(key string, h http.Header) (time.Duration, bool) {
+	for _, r := range t.cfg.Rules {
+		if r.Pattern.MatchString(key) {
+			return r.TTL, r.TTL >= 0
+		}
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if cc.has("no-store") {
+		return 0, false
+	}
+	revalidatable := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	if cc.has("no-cache") {
+		return 0, revalidatable
+	}
+	if v, ok := cc["max-age"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+		return 0, revalidatable
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, revalidatable
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if d := expires.Sub(date); d > 0 {
+			return d, true
+		}
+	}
+	return 0, revalidatable
+}
+
+func (e Entry) response(req *http.Request, status string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("X-Cache", status)
+	h.Set("Age", strconv.Itoa(int(time.Since(e.StoredAt)/time.Second)))
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(v string) cacheControl {
+	cc := cacheControl{}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		k, val, _ := strings.Cut(d, "=")
+		cc[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(val), `"`)
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
@@ -0,0 +1,294 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v9"
+)
+
+// upstream serves "<path> #<hit>" with the headers set for the path, the
+// failing paths answer with status once the first hit is cached.
+type upstream struct {
+	mu      sync.Mutex
+	hits    map[string]int
+	headers map[string]http.Header
+	failing map[string]int
+}
+
+func newUpstream(t *testing.T, headers map[string]http.Header) (*upstream, *httptest.Server) {
+	t.Helper()
+	u := &upstream{
+		hits:    map[string]int{},
+		headers: headers,
+		failing: map[string]int{},
+	}
+	srv := httptest.NewServer(u)
+	t.Cleanup(srv.Close)
+	return u, srv
+}
+
+func (u *upstream) fail(path string, status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failing[path] = status
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.hits[r.URL.Path]++
+	hit, status := u.hits[r.URL.Path], u.failing[r.URL.Path]
+	u.mu.Unlock()
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	for k, vs := range u.headers[r.URL.Path] {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	if etag := w.Header().Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprintf(w, "%s #%d", r.URL.Path, hit)
+}
+
+type step struct {
+	path  string
+	want  string
+	cache string
+}
+
+func run(t *testing.T, c *http.Client, base string, steps []step) {
+	t.Helper()
+	for _, s := range steps {
+		resp, err := c.Get(base + s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != s.want || resp.Header.Get("X-Cache") != s.cache {
+			t.Errorf("%s: got %q %q, want %q %q", s.path, body, resp.Header.Get("X-Cache"), s.want, s.cache)
+		}
+	}
+}
+
+func newTransport(t *testing.T, next http.RoundTripper, rules ...TTLRule) *Transport {
+	t.Helper()
+	store, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(next, Cfg{Store: store, Rules: rules})
+}
+
+func TestTransportFreshness(t *testing.T) {
+	_, srv := newUpstream(t, map[string]http.Header{
+		"/max-age":  {"Cache-Control": {"max-age=60"}},
+		"/no-store": {"Cache-Control": {"no-store"}},
+		"/expires": {
+			"Date":    {time.Now().UTC().Format(http.TimeFormat)},
+			"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+		},
+	})
+	tr := newTransport(t, http.DefaultTransport, TTLRule{Pattern: regexp.MustCompile(`/override$`), TTL: time.Minute})
+	run(t, &http.Client{Transport: tr}, srv.URL, []step{
+		{"/max-age", "/max-age #1", ""},
+		{"/max-age", "/max-age #1", "HIT"},
+		{"/expires", "/expires #1", ""},
+		{"/expires", "/expires #1", "HIT"},
+		{"/no-store", "/no-store #1", ""},
+		{"/no-store", "/no-store #2", ""},
+		// no freshness and no validator, never stored
+		{"/plain", "/plain #1", ""},
+		{"/plain", "/plain #2", ""},
+		{"/override", "/override #1", ""},
+		{"/override", "/override #1", "HIT"},
+	})
+	want := Stats{Hits: 3, Misses: 7}
+	if got := tr.Stats(); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
+
+func TestTransportRevalidate(t *testing.T) {
+	_, srv := newUpstream(t, map[string]http.Header{
+		"/etag": {"Cache-Control": {"no-cache"}, "ETag": {`"v1"`}},
+	})
+	tr := newTransport(t, http.DefaultTransport)
+	run(t, &http.Client{Transport: tr}, srv.URL, []step{
+		{"/etag", "/etag #1", ""},
+		{"/etag", "/etag #1", "REVALIDATED"},
+		{"/etag", "/etag #1", "REVALIDATED"},
+	})
+	want := Stats{Revalidated: 2, Misses: 1}
+	if got := tr.Stats(); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
+
+func TestTransportBypass(t *testing.T) {
+	_, srv := newUpstream(t, map[string]http.Header{
+		"/max-age": {"Cache-Control": {"max-age=60"}},
+	})
+	tr := newTransport(t, http.DefaultTransport)
+	c := &http.Client{Transport: tr}
+	run(t, c, srv.URL, []step{{"/max-age", "/max-age #1", ""}})
+	for _, h := range []http.Header{
+		{"Range": {"bytes=0-1"}},
+		{"Cache-Control": {"no-store"}},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/max-age", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = h
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Cache") != "" {
+			t.Errorf("%v served from cache", h)
+		}
+	}
+	want := Stats{Misses: 1, Bypassed: 2}
+	if got := tr.Stats(); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
+
+// failing fails every request once fail is set.
+type failing struct {
+	next http.RoundTripper
+	mu   sync.Mutex
+	fail bool
+}
+
+func (f *failing) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	fail := f.fail
+	f.mu.Unlock()
+	if fail {
+		return nil, errors.New("connection refused")
+	}
+	return f.next.RoundTrip(req)
+}
+
+func TestTransportStale(t *testing.T) {
+	up, srv := newUpstream(t, map[string]http.Header{
+		"/etag":      {"Cache-Control": {"no-cache"}, "ETag": {`"v1"`}},
+		"/modified":  {"Cache-Control": {"max-age=0"}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+		"/must":      {"Cache-Control": {"no-cache, must-revalidate"}, "ETag": {`"v1"`}},
+		"/not-found": {"Cache-Control": {"no-cache"}, "ETag": {`"v1"`}},
+	})
+	next := &failing{next: http.DefaultTransport}
+	tr := newTransport(t, next)
+	c := &http.Client{Transport: tr}
+	run(t, c, srv.URL, []step{
+		{"/etag", "/etag #1", ""},
+		{"/modified", "/modified #1", ""},
+		{"/must", "/must #1", ""},
+		{"/not-found", "/not-found #1", ""},
+	})
+	up.fail("/etag", http.StatusServiceUnavailable)
+	up.fail("/modified", http.StatusInternalServerError)
+	up.fail("/must", http.StatusBadGateway)
+	up.fail("/not-found", http.StatusNotFound)
+	run(t, c, srv.URL, []step{
+		{"/etag", "/etag #1", "STALE"},
+		{"/modified", "/modified #1", "STALE"},
+		{"/must", "", ""},
+		{"/not-found", "", ""},
+	})
+	next.mu.Lock()
+	next.fail = true
+	next.mu.Unlock()
+	run(t, c, srv.URL, []step{{"/etag", "/etag #1", "STALE"}})
+	if _, err := c.Get(srv.URL + "/must"); err == nil {
+		t.Error("must-revalidate entry served without the upstream")
+	}
+	if got := tr.Stats(); got.Stale != 3 {
+		t.Errorf("stats %+v, want 3 stale", got)
+	}
+
+	// a cancelled request is no upstream failure
+	next.mu.Lock()
+	next.fail = false
+	next.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/etag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled request: %v", err)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	ctx := context.Background()
+	s := NewRedisStore(client, time.Hour)
+	if _, ok, err := s.Get(ctx, "http://up.example/a"); err != nil || ok {
+		t.Fatalf("empty store: %v, %v", ok, err)
+	}
+	e := Entry{
+		URL:      "http://up.example/a",
+		Header:   http.Header{"Etag": {`"v1"`}},
+		Body:     []byte("body"),
+		StoredAt: time.Now().Truncate(time.Second),
+		Lifetime: time.Minute,
+	}
+	if err := s.Set(ctx, e.URL, e); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := s.Get(ctx, e.URL)
+	if err != nil || !ok {
+		t.Fatalf("get: %v, %v", ok, err)
+	}
+	if got.URL != e.URL || string(got.Body) != "body" || got.Header.Get("ETag") != `"v1"` ||
+		!got.StoredAt.Equal(e.StoredAt) || got.Lifetime != e.Lifetime {
+		t.Errorf("got %+v, want %+v", got, e)
+	}
+	if ttl := mr.TTL(s.key(e.URL)); ttl != time.Hour+time.Minute {
+		t.Errorf("ttl %s, want the lifetime and the retention", ttl)
+	}
+	// expired once stale for the retention
+	mr.FastForward(time.Hour + time.Minute)
+	if _, ok, err := s.Get(ctx, e.URL); err != nil || ok {
+		t.Errorf("after retention: %v, %v", ok, err)
+	}
+
+	// kept until evicted without a retention
+	s = NewRedisStore(client, 0)
+	if err := s.Set(ctx, e.URL, e); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(s.key(e.URL)); ttl != 0 {
+		t.Errorf("ttl %s without retention", ttl)
+	}
+
+	mr.Set(s.key("http://up.example/bad"), "{")
+	if _, _, err := s.Get(ctx, "http://up.example/bad"); err == nil {
+		t.Error("corrupt entry decoded")
+	}
+}
@@ -0,0 +1,148 @@
+package httpcache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	goredis "github.com/go-redis/redis/v9"
+)
+
+// Entry is a cached 200 response.
+type Entry struct {
+	URL      string
+	Header   http.Header
+	Body     []byte
+	StoredAt time.Time
+	// Lifetime is how long the entry is fresh after StoredAt.
+	Lifetime time.Duration
+}
+
+type Store interface {
+	// Get returns ok false when key is not cached.
+	Get(ctx context.Context, key string) (e Entry, ok bool, err error)
+	Set(ctx context.Context, key string, e Entry) error
+}
+
+func hashKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DiskStore keeps one JSON file per entry in a directory.
+type DiskStore struct {
+	dir string
+}
+
+func NewDiskStore(dir string) (DiskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return DiskStore{}, fmt.Errorf("new disk store: %w", err)
+	}
+	return DiskStore{
+		dir: dir,
+	}, nil
+}
+
+func (s DiskStore) path(key string) string {
+	return filepath.Join(s.dir, hashKey(key)+".json")
+}
+
+func (s DiskStore) Get(ctx context.Context, key string) (Entry, bool, error) {
+	raw, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("disk store get: %w", err)
+	}
+	var e Entry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return Entry{}, false, fmt.Errorf("disk store get: %w", err)
+	}
+	return e, true, nil
+}
+
+// Set writes to a temporary file first so concurrent readers never see
+// a partially written entry.
+func (s DiskStore) Set(ctx context.Context, key string, e Entry) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("disk store set: %w", err)
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return handleErr(err)
+	}
+	f, err := os.CreateTemp(s.dir, "*.tmp")
+	if err != nil {
+		return handleErr(err)
+	}
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return handleErr(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return handleErr(err)
+	}
+	if err := os.Rename(f.Name(), s.path(key)); err != nil {
+		os.Remove(f.Name())
+		return handleErr(err)
+	}
+	return nil
+}
+
+// RedisStore keeps entries as JSON strings under httpcache:<sha1 of key>.
+// Entries are expired by Redis once they have been stale for retain.
+type RedisStore struct {
+	client *goredis.Client
+	retain time.Duration
+}
+
+func NewRedisStore(client *goredis.Client, retain time.Duration) RedisStore {
+	return RedisStore{
+		client: client,
+		retain: retain,
+	}
+}
+
+func (s RedisStore) key(key string) string {
+	return "httpcache:" + hashKey(key)
+}
+
+func (s RedisStore) Get(ctx context.Context, key string) (Entry, bool, error) {
+	raw, err := s.client.Get(ctx, s.key(key)).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("redis store get: %w", err)
+	}
+	var e Entry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return Entry{}, false, fmt.Errorf("redis store get: %w", err)
+	}
+	return e, true, nil
+}
+
+func (s RedisStore) Set(ctx context.Context, key string, e Entry) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("redis store set: %w", err)
+	}
+	var exp time.Duration
+	if s.retain > 0 {
+		exp = e.Lifetime + s.retain
+	}
+	if err := s.client.Set(ctx, s.key(key), raw, exp).Err(); err != nil {
+		return fmt.Errorf("redis store set: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+// Package polite is an http.RoundTripper that keeps the load on upstream
+// hosts down: a global request rate, a per host concurrency cap, robots.txt
+// crawl delays and a per host pause shared by every caller after a 429.
+package polite
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"accu/tracks"
+)
+
+type Cfg struct {
+	// RPS caps requests per second across all hosts, 0 disables the cap.
+	RPS float64
+	// MaxPerHost caps concurrent requests to one host, 0 disables the cap.
+	MaxPerHost int
+	// UserAgent replaces the User-Agent of every request when set.
+	UserAgent string
+	// Robots fetches /robots.txt of every host once and honours its Crawl-delay.
+	Robots bool
+	// MinDelay is the delay between the starts of two requests to one host,
+	// a longer robots.txt crawl delay wins.
+	MinDelay time.Duration
+	// MinBackoff and MaxBackoff bound the pause after a 429 without a
+	// Retry-After, it doubles with every consecutive 429.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultCfg = Cfg{
+	MinBackoff: time.Second,
+	MaxBackoff: time.Minute,
+}
+
+func (c Cfg) withDefaults() Cfg {
+	if c.MinBackoff == 0 {
+		c.MinBackoff = DefaultCfg.MinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultCfg.MaxBackoff
+	}
+	return c
+}
+
+type host struct {
+	sem    chan struct{}
+	robots sync.Once
+
+	mu          sync.Mutex
+	delay       time.Duration
+	next        time.Time
+	pausedUntil time.Time
+	strikes     int
+}
+
+type Transport struct {
+	next http.RoundTripper
+	cfg  Cfg
+
+	mu     sync.Mutex
+	every  time.Duration
+	at     time.Time
+	hosts  map[string]*host
+	paused int
+}
+
+func New(next http.RoundTripper, cfg Cfg) *Transport {
+	cfg = cfg.withDefaults()
+	t := &Transport{
+		next:  next,
+		cfg:   cfg,
+		hosts: map[string]*host{},
+	}
+	if cfg.RPS > 0 {
+		t.every = time.Duration(float64(time.Second) / cfg.RPS)
+	}
+	return t
+}
+
+// Paused returns how many times a host was paused after a 429.
+func (t *Transport) Paused() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+func (t *Transport) host(name string) *host {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[name]
+	if !ok {
+		h = &host{
+			delay: t.cfg.MinDelay,
+		}
+		if t.cfg.MaxPerHost > 0 {
+			h.sem = make(chan struct{}, t.cfg.MaxPerHost)
+		}
+		t.hosts[name] = h
+	}
+	return h
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if t.cfg.UserAgent != "" {
+		req = req.Clone(ctx)
+		req.Header.Set("User-Agent", t.cfg.UserAgent)
+	}
+	h := t.host(req.URL.Host)
+	if t.cfg.Robots {
+		h.robots.Do(func() {
+			t.fetchRobots(req, h)
+		})
+	}
+	release := func() {}
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		once := sync.Once{}
+		release = func() {
+			once.Do(func() { <-h.sem })
+		}
+	}
+	if err := t.waitHost(ctx, h); err != nil {
+		release()
+		return nil, err
+	}
+	if err := t.waitGlobal(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	t.observe(h, resp)
+	// the slot is held while the body streams, audio bodies take far
+	// longer than the headers
+	resp.Body = &slotBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// slotBody gives the host slot back once the body is read to its end or
+// closed.
+type slotBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *slotBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// waitHost blocks until the host is neither paused nor within its delay.
+// It checks again after sleeping as a 429 may have paused the host meanwhile.
+func (t *Transport) waitHost(ctx context.Context, h *host) error {
+	for {
+		h.mu.Lock()
+		now := time.Now()
+		at := h.next
+		if h.pausedUntil.After(at) {
+			at = h.pausedUntil
+		}
+		if !at.After(now) {
+			h.next = now.Add(h.delay)
+			h.mu.Unlock()
+			return nil
+		}
+		h.mu.Unlock()
+		if err := sleep(ctx, at.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *Transport) waitGlobal(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	at := t.at
+	if at.Before(now) {
+		at = now
+	}
+	t.at = at.Add(t.every)
+	t.mu.Unlock()
+	return sleep(ctx, at.Sub(now))
+}
+
+func (t *Transport) observe(h *host, resp *http.Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		h.strikes = 0
+		return
+	}
+	h.strikes++
+	d, ok := tracks.RetryAfter(tracks.CheckStatus(resp))
+	if !ok {
+		d = t.cfg.MinBackoff
+		for i := 1; i < h.strikes && d < t.cfg.MaxBackoff; i++ {
+			d *= 2
+		}
+		if d > t.cfg.MaxBackoff {
+			d = t.cfg.MaxBackoff
+		}
+	}
+	if until := time.Now().Add(d); until.After(h.pausedUntil) {
+		h.pausedUntil = until
+	}
+	t.mu.Lock()
+	t.paused++
+	t.mu.Unlock()
+}
+
+// fetchRobots reads the crawl delay for our user agent, falling back to
+// the * group. Failures leave the delay unchanged.
+func (t *Transport) fetchRobots(req *http.Request, h *host) {
+	rreq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, req.URL.Scheme+"://"+req.URL.Host+"/robots.txt", nil)
+	if err != nil {
+		return
+	}
+	rreq.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	resp, err := t.next.RoundTrip(rreq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	delay, ok := crawlDelay(bufio.NewScanner(resp.Body), t.cfg.UserAgent)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	if delay > h.delay {
+		h.delay = delay
+	}
+	h.mu.Unlock()
+}
+
+func crawlDelay(s *bufio.Scanner, userAgent string) (time.Duration, bool) {
+	ua := strings.ToLower(userAgent)
+	var (
+		agents          []string
+		inRules         bool
+		own, star       time.Duration
+		hasOwn, hasStar bool
+	)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		switch k {
+		case "user-agent":
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agents = append(agents, strings.ToLower(v))
+		case "crawl-delay":
+			inRules = true
+			secs, err := strconv.ParseFloat(v, 64)
+			if err != nil || secs < 0 {
+				continue
+			}
+			d := time.Duration(secs * float64(time.Second))
+			for _, a := range agents {
+				switch {
+				case a == "*":
+					star, hasStar = d, true
+				case ua != "" && strings.Contains(ua, a):
+					own, hasOwn = d, true
+				}
+			}
+		default:
+			inRules = true
+		}
+	}
+	if hasOwn {
+		return own, true
+	}
+	return star, hasStar
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,118 @@
+package polite
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	var (
+		inFlight, maxInFlight int32
+		throttled             int32
+		mu                    sync.Mutex
+		starts                []time.Time
+		agents                = map[string]bool{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents[r.Header.Get("User-Agent")] = true
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			_, _ = w.Write([]byte("User-agent: *\nCrawl-delay: 0.01\n\nUser-agent: other\nCrawl-delay: 10\n"))
+			return
+		case "/throttle":
+			if atomic.AddInt32(&throttled, 1) == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		// the headers come back at once, the body streams for a while as
+		// audio files do
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 10; i++ {
+			time.Sleep(5 * time.Millisecond)
+			_, _ = w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	tr := New(http.DefaultTransport, Cfg{
+		MaxPerHost: 2,
+		UserAgent:  "accu-test",
+		Robots:     true,
+		MinBackoff: 100 * time.Millisecond,
+	})
+	c := &http.Client{Transport: tr}
+	get := func(path string) int {
+		resp, err := c.Get(srv.URL + path)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer resp.Body.Close()
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			t.Error(err)
+		}
+		return resp.StatusCode
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get("/")
+		}()
+	}
+	wg.Wait()
+	if maxInFlight > 2 {
+		t.Errorf("%d concurrent requests, want at most 2", maxInFlight)
+	}
+	for i := 1; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[i-1]); d < 9*time.Millisecond {
+			t.Errorf("requests %s apart, want the 10ms crawl delay", d)
+		}
+	}
+	// bodies closed before their end give their slot back too
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(agents) != 1 || !agents["accu-test"] {
+		t.Errorf("user agents %v", agents)
+	}
+
+	if got := get("/throttle"); got != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", got)
+	}
+	start := time.Now()
+	if got := get("/"); got != http.StatusOK {
+		t.Fatalf("got %d, want 200", got)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("host resumed after %s, want the 100ms backoff", d)
+	}
+	if tr.Paused() != 1 {
+		t.Errorf("paused %d times, want 1", tr.Paused())
+	}
+}
@@ -0,0 +1,268 @@
+package repo
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+
+	"accu/tracks"
+)
+
+type CachedCfg struct {
+	// ExpectedTracks and FalsePositiveRate size the Bloom filter, more tracks
+	// than expected only raise the false positive rate.
+	ExpectedTracks    int
+	FalsePositiveRate float64
+	// LRUSize is the number of recent ID lookups kept.
+	LRUSize int
+}
+
+var DefaultCachedCfg = CachedCfg{
+	ExpectedTracks:    200000,
+	FalsePositiveRate: 0.01,
+	LRUSize:           10000,
+}
+
+func (c CachedCfg) withDefaults() CachedCfg {
+	if c.ExpectedTracks == 0 {
+		c.ExpectedTracks = DefaultCachedCfg.ExpectedTracks
+	}
+	if c.FalsePositiveRate == 0 {
+		c.FalsePositiveRate = DefaultCachedCfg.FalsePositiveRate
+	}
+	if c.LRUSize == 0 {
+		c.LRUSize = DefaultCachedCfg.LRUSize
+	}
+	return c
+}
+
+type CachedStats struct {
+	Lookups int
+	// BloomMisses were answered as unknown without asking the store.
+	BloomMisses int
+	LRUHits     int
+	// FalsePositives passed the Bloom filter but were unknown to the store.
+	FalsePositives int
+	StoreLookups   int
+}
+
+func (s CachedStats) String() string {
+	ratio := 0.0
+	if s.Lookups > 0 {
+		ratio = float64(s.BloomMisses+s.LRUHits) / float64(s.Lookups) * 100
+	}
+	return fmt.Sprintf("%d lookups, %d bloom misses, %d lru hits (%.1f%% without the store), %d false positives",
+		s.Lookups, s.BloomMisses, s.LRUHits, ratio, s.FalsePositives)
+}
+
+// Cached is a tracks.Repo decorator that answers ID lookups from a Bloom
+// filter of every known track ID and an LRU of recent lookups. It is
+// consistent with the writes made through it, tracks saved by other
+// processes after warm up look unknown until the next warm up.
+type Cached struct {
+	tracks.Repo
+	mu    sync.Mutex
+	bloom *bloom
+	lru   *lru
+	stats CachedStats
+	// saves counts SaveTracks calls, lookups that raced with a save
+	// don't cache what the store reported unknown.
+	saves int
+}
+
+var _ tracks.Repo = (*Cached)(nil)
+
+// NewCached warms the Bloom filter with every track ID of r.
+func NewCached(ctx context.Context, r tracks.Repo, cfg CachedCfg) (*Cached, error) {
+	cfg = cfg.withDefaults()
+	c := &Cached{
+		Repo:  r,
+		bloom: newBloom(cfg.ExpectedTracks, cfg.FalsePositiveRate),
+		lru:   newLRU(cfg.LRUSize),
+	}
+	if err := r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		c.mu.Lock()
+		c.bloom.add(withID(t).ID)
+		c.mu.Unlock()
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("new cached repo: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Cached) Stats() CachedStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Cached) SaveTracks(ctx context.Context, trks ...tracks.Track) error {
+	if err := c.Repo.SaveTracks(ctx, trks...); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saves++
+	for _, t := range trks {
+		id := withID(t).ID
+		c.bloom.add(id)
+		c.lru.put(lruKey("", id), true)
+		c.lru.put(lruKey(t.Channel, id), true)
+	}
+	return nil
+}
+
+// lruKey scopes the lookups of a channel, the Bloom filter only knows
+// whether a track was seen on any channel.
+func lruKey(channel, id string) string {
+	return channel + "\x00" + id
+}
+
+func (c *Cached) UnknownIDs(ctx context.Context, channel string, ids ...string) ([]string, error) {
+	known := make(map[string]bool, len(ids))
+	var ask []string
+	c.mu.Lock()
+	for _, l := range ids {
+		c.stats.Lookups++
+		if !c.bloom.has(l) {
+			c.stats.BloomMisses++
+			known[l] = false
+			continue
+		}
+		if k, ok := c.lru.get(lruKey(channel, l)); ok {
+			c.stats.LRUHits++
+			known[l] = k
+			continue
+		}
+		ask = append(ask, l)
+	}
+	c.stats.StoreLookups += len(ask)
+	saves := c.saves
+	c.mu.Unlock()
+	if len(ask) > 0 {
+		unknown, err := c.Repo.UnknownIDs(ctx, channel, ask...)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range ask {
+			known[l] = true
+		}
+		for _, l := range unknown {
+			known[l] = false
+		}
+		c.mu.Lock()
+		if channel == "" {
+			c.stats.FalsePositives += len(unknown)
+		}
+		for _, l := range ask {
+			if known[l] || saves == c.saves {
+				c.lru.put(lruKey(channel, l), known[l])
+			}
+		}
+		c.mu.Unlock()
+	}
+	unknown := make([]string, 0, len(ids))
+	for _, l := range ids {
+		if !known[l] {
+			unknown = append(unknown, l)
+		}
+	}
+	return unknown, nil
+}
+
+type bloom struct {
+	bits []uint64
+	m    uint64
+	k    int
+}
+
+func newBloom(n int, p float64) *bloom {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloom{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// positions uses double hashing of a 64 bit FNV-1a hash.
+func (b *bloom) positions(s string, f func(pos uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	for i := 0; i < b.k; i++ {
+		if !f((h1 + uint64(i)*h2) % b.m) {
+			return
+		}
+	}
+}
+
+func (b *bloom) add(s string) {
+	b.positions(s, func(pos uint64) bool {
+		b.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+func (b *bloom) has(s string) bool {
+	found := true
+	b.positions(s, func(pos uint64) bool {
+		found = b.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+type lruEntry struct {
+	key   string
+	known bool
+}
+
+type lru struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (l *lru) get(key string) (bool, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return false, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(lruEntry).known, true
+}
+
+func (l *lru) put(key string, known bool) {
+	if e, ok := l.items[key]; ok {
+		e.Value = lruEntry{key, known}
+		l.order.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.order.PushFront(lruEntry{key, known})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(lruEntry).key)
+	}
+}
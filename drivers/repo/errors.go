@@ -0,0 +1,61 @@
+package repo
+
+import (
+	"accu/tracks"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	goredis "github.com/go-redis/redis/v9"
+	"github.com/mattn/go-sqlite3"
+)
+
+// storageErr wraps err into a tracks.StorageError unless it is already
+// classified or comes from the caller's context.
+func storageErr(backend string, err error, transient func(error) bool) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		se *tracks.StorageError
+		nf *tracks.NotFoundError
+		de *tracks.DuplicateError
+		fe *tracks.FencedError
+	)
+	if errors.As(err, &se) || errors.As(err, &nf) || errors.As(err, &de) || errors.As(err, &fe) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &tracks.StorageError{
+		Backend:   backend,
+		Err:       err,
+		Transient: transient(err),
+	}
+}
+
+func sqliteErr(err error) error {
+	return storageErr("sqlite", err, func(err error) bool {
+		var se sqlite3.Error
+		if errors.As(err, &se) {
+			return se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked
+		}
+		return false
+	})
+}
+
+func redisErr(err error) error {
+	return storageErr("redis", err, func(err error) bool {
+		var ne net.Error
+		if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, goredis.ErrClosed) {
+			return true
+		}
+		for _, prefix := range []string{"LOADING", "READONLY", "BUSY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN"} {
+			if strings.HasPrefix(err.Error(), prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
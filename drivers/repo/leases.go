@@ -0,0 +1,317 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/go-redis/redis/v9"
+)
+
+type LeasesCfg struct {
+	// Instance names this ripper, the host name and the process id by
+	// default. Instances with the same name share their leases.
+	Instance string
+	// TTL is how long the membership of a ripper and its leases last
+	// without renewal, a ripper that dies loses its channels after TTL.
+	TTL time.Duration
+}
+
+var DefaultLeasesCfg = LeasesCfg{
+	TTL: 30 * time.Second,
+}
+
+func (c LeasesCfg) withDefaults() LeasesCfg {
+	if c.Instance == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "ripper"
+		}
+		c.Instance = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if c.TTL == 0 {
+		c.TTL = DefaultLeasesCfg.TTL
+	}
+	return c
+}
+
+// The live rippers are kept in the rippers sorted set scored by the unix
+// millisecond their membership expires. lease:channel:<channel> holds
+// "<instance> <token>" and expires with the lease, lease:fence:<channel>
+// counts the leases given out and is never dropped, so tokens only grow.
+const rippersKey = "rippers"
+
+func leaseKey(channel string) string {
+	return fmt.Sprintf("lease:channel:%s", channel)
+}
+
+// FenceKey holds the newest fencing token given out for the lease of
+// channel, the writes made under an older token are refused.
+func FenceKey(channel string) string {
+	return fmt.Sprintf("lease:fence:%s", channel)
+}
+
+// acquireLeaseScript renews the lease held by ARGV[1] or takes it when it
+// is free, for ARGV[2] milliseconds. It returns the fencing token, or 0
+// when another instance holds the lease.
+var acquireLeaseScript = goredis.NewScript(`
+local held = redis.call('GET', KEYS[1])
+if held then
+	local owner, token = string.match(held, '^(.*) (%d+)$')
+	if owner ~= ARGV[1] then
+		return 0
+	end
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return tonumber(token)
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ' ' .. token, 'PX', ARGV[2])
+return token
+`)
+
+// releaseLeaseScript drops the lease when ARGV[1] holds it.
+var releaseLeaseScript = goredis.NewScript(`
+local held = redis.call('GET', KEYS[1])
+if held and string.match(held, '^(.*) %d+$') == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// RedisLeases is a tracks.ChannelLeases. Each channel is assigned to one of
+// the live rippers by rendezvous hashing, so when a ripper joins or dies
+// only the channels it gets or had move. A channel changes hands once its
+// old owner released it on its next Sync, or once the lease expired.
+type RedisLeases struct {
+	client *goredis.Client
+	cfg    LeasesCfg
+}
+
+func NewLeases(client *goredis.Client, cfg LeasesCfg) RedisLeases {
+	return RedisLeases{
+		client: client,
+		cfg:    cfg.withDefaults(),
+	}
+}
+
+func (r RedisLeases) Instance() string {
+	return r.cfg.Instance
+}
+
+func (r RedisLeases) Sync(ctx context.Context, channels []string) (map[string]int64, error) {
+	handleErr := func(err error) (map[string]int64, error) {
+		return nil, fmt.Errorf("sync leases: %w", redisErr(err))
+	}
+	live, err := r.join(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	ttl := strconv.FormatInt(r.cfg.TTL.Milliseconds(), 10)
+	acquired := map[string]*goredis.Cmd{}
+	run := func() error {
+		_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			for _, ch := range channels {
+				keys := []string{leaseKey(ch), FenceKey(ch)}
+				if assign(ch, live) == r.cfg.Instance {
+					acquired[ch] = acquireLeaseScript.EvalSha(ctx, pipe, keys, r.cfg.Instance, ttl)
+				} else {
+					_ = releaseLeaseScript.EvalSha(ctx, pipe, keys[:1], r.cfg.Instance)
+				}
+			}
+			return nil
+		})
+		return err
+	}
+	err = run()
+	if goredis.HasErrorPrefix(err, "NOSCRIPT") {
+		if err := acquireLeaseScript.Load(ctx, r.client).Err(); err != nil {
+			return handleErr(err)
+		}
+		if err := releaseLeaseScript.Load(ctx, r.client).Err(); err != nil {
+			return handleErr(err)
+		}
+		err = run()
+	}
+	if err != nil {
+		return handleErr(err)
+	}
+	held := map[string]int64{}
+	for ch, cmd := range acquired {
+		token, err := cmd.Int64()
+		if err != nil {
+			return handleErr(err)
+		}
+		if token > 0 {
+			held[ch] = token
+		}
+	}
+	return held, nil
+}
+
+// join renews the membership of this instance, drops the expired ones and
+// returns the live instances.
+func (r RedisLeases) join(ctx context.Context) ([]string, error) {
+	now := time.Now()
+	var live *goredis.StringSliceCmd
+	cmds, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		_ = pipe.ZAdd(ctx, rippersKey, goredis.Z{
+			Score:  float64(now.Add(r.cfg.TTL).UnixMilli()),
+			Member: r.cfg.Instance,
+		})
+		_ = pipe.ZRemRangeByScore(ctx, rippersKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		live = pipe.ZRange(ctx, rippersKey, 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return live.Val(), nil
+}
+
+// assign picks the instance with the highest hash of itself and channel.
+func assign(channel string, instances []string) string {
+	var best string
+	var bestScore uint64
+	for _, instance := range instances {
+		h := fnv.New64a()
+		h.Write([]byte(instance))
+		h.Write([]byte{0})
+		h.Write([]byte(channel))
+		if score := mix(h.Sum64()); best == "" || score > bestScore {
+			best, bestScore = instance, score
+		}
+	}
+	return best
+}
+
+// mix is the splitmix64 finalizer, names that differ in a few bytes have
+// FNV hashes too close to be ranked fairly.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (r RedisLeases) Release(ctx context.Context) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("release leases: %w", redisErr(err))
+	}
+	leases, err := r.Leases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	if err := r.client.ZRem(ctx, rippersKey, r.cfg.Instance).Err(); err != nil {
+		return handleErr(err)
+	}
+	for _, l := range leases {
+		if l.Instance != r.cfg.Instance {
+			continue
+		}
+		if err := releaseLeaseScript.Run(ctx, r.client, []string{leaseKey(l.Channel)}, r.cfg.Instance).Err(); err != nil {
+			return handleErr(err)
+		}
+	}
+	return nil
+}
+
+// Ripper is a live ripper and the time its membership expires.
+type Ripper struct {
+	Instance string
+	Expires  time.Time
+}
+
+// Lease is a channel held by a ripper until it expires.
+type Lease struct {
+	Channel  string
+	Instance string
+	Token    int64
+	Expires  time.Time
+}
+
+func (r RedisLeases) Rippers(ctx context.Context) ([]Ripper, error) {
+	zs, err := r.client.ZRangeByScoreWithScores(ctx, rippersKey, &goredis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rippers: %w", redisErr(err))
+	}
+	rippers := make([]Ripper, len(zs))
+	for i, z := range zs {
+		rippers[i] = Ripper{
+			Instance: fmt.Sprint(z.Member),
+			Expires:  time.UnixMilli(int64(z.Score)),
+		}
+	}
+	return rippers, nil
+}
+
+// Leases returns the leases held, by channel.
+func (r RedisLeases) Leases(ctx context.Context) ([]Lease, error) {
+	handleErr := func(err error) ([]Lease, error) {
+		return nil, fmt.Errorf("leases: %w", redisErr(err))
+	}
+	var keys []string
+	iter := r.client.Scan(ctx, 0, leaseKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return handleErr(err)
+	}
+	sort.Strings(keys)
+	values := make([]*goredis.StringCmd, len(keys))
+	ttls := make([]*goredis.DurationCmd, len(keys))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, key := range keys {
+			values[i] = pipe.Get(ctx, key)
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		return nil
+	}); err != nil && err != goredis.Nil {
+		return handleErr(err)
+	}
+	now := time.Now()
+	leases := make([]Lease, 0, len(keys))
+	for i, key := range keys {
+		// expired since the scan
+		held, err := values[i].Result()
+		if err == goredis.Nil {
+			continue
+		} else if err != nil {
+			return handleErr(err)
+		}
+		ttl, err := ttls[i].Result()
+		if err != nil {
+			return handleErr(err)
+		}
+		sep := strings.LastIndexByte(held, ' ')
+		if sep < 0 {
+			continue
+		}
+		token, err := strconv.ParseInt(held[sep+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		leases = append(leases, Lease{
+			Channel:  strings.TrimPrefix(key, leaseKey("")),
+			Instance: held[:sep],
+			Token:    token,
+			Expires:  now.Add(ttl),
+		})
+	}
+	return leases, nil
+}
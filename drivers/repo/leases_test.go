@@ -0,0 +1,32 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAssign(t *testing.T) {
+	channels := make([]string, 300)
+	for i := range channels {
+		channels[i] = fmt.Sprintf("%x", 0x5a1b+i)
+	}
+	two := []string{"a-1", "b-2"}
+	three := []string{"c-3", "a-1", "b-2"}
+	counts := map[string]int{}
+	for _, ch := range channels {
+		before, after := assign(ch, two), assign(ch, three)
+		// only the channels of the new ripper move
+		if before != after && after != "c-3" {
+			t.Errorf("%s moved from %s to %s", ch, before, after)
+		}
+		counts[after]++
+	}
+	for _, instance := range three {
+		if counts[instance] < 50 {
+			t.Errorf("%s got %d of %d channels", instance, counts[instance], len(channels))
+		}
+	}
+	if got := assign("5a1b", nil); got != "" {
+		t.Errorf("assigned to %q without rippers", got)
+	}
+}
@@ -3,10 +3,15 @@ package repo
 import (
 	"accu/drivers/repo/protos"
 	"accu/tracks"
+	"accu/tracks/artists"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	goredis "github.com/go-redis/redis/v9"
@@ -47,6 +52,12 @@ func NewRedisClient(ctx context.Context, host string, port int, l *log.Logger) (
 	}, nil
 }
 
+var (
+	_ tracks.Repo         = Redis{}
+	_ tracks.CategoryRepo = Redis{}
+	_ tracks.ArtistRepo   = Redis{}
+)
+
 func NewRedis(client *goredis.Client, l *log.Logger) Redis {
 	return Redis{
 		client,
@@ -54,71 +65,566 @@ func NewRedis(client *goredis.Client, l *log.Logger) Redis {
 	}
 }
 
+// Tracks are stored by ID: the tracksbyid hash holds the track messages,
+// tracklinks maps every link to its track ID and trackids is the set of
+// saved IDs.
+const (
+	tracksByIDKey = "tracksbyid"
+	trackLinksKey = "tracklinks"
+	trackIDsKey   = "trackids"
+)
+
+// channel:trackids:<channel> is the set of tracks seen on a channel,
+// track:channels:<id> holds the first and last time a track was seen on each
+// of its channels as <channel>:first and <channel>:last unix times.
+func channelTrackIDsKey(channel string) string {
+	return fmt.Sprintf("channel:trackids:%s", channel)
+}
+
+func trackChannelsKey(id string) string {
+	return fmt.Sprintf("track:channels:%s", id)
+}
+
+func hashMemberships(fields map[string]string) []tracks.Membership {
+	byChannel := map[string]*tracks.Membership{}
+	var mm []*tracks.Membership
+	for field, v := range fields {
+		i := strings.LastIndexByte(field, ':')
+		if i < 0 {
+			continue
+		}
+		unix, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		channel := field[:i]
+		m, ok := byChannel[channel]
+		if !ok {
+			m = &tracks.Membership{Channel: channel}
+			byChannel[channel] = m
+			mm = append(mm, m)
+		}
+		switch field[i+1:] {
+		case "first":
+			m.FirstSeen = time.Unix(unix, 0)
+		case "last":
+			m.LastSeen = time.Unix(unix, 0)
+		}
+	}
+	if len(mm) == 0 {
+		return nil
+	}
+	memberships := make([]tracks.Membership, len(mm))
+	for i, m := range mm {
+		memberships[i] = *m
+	}
+	sortMemberships(memberships)
+	return memberships
+}
+
+func trackToMsg(trk tracks.Track) *protos.Track {
+	return &protos.Track{
+		Id:            trk.ID,
+		Channel:       trk.Channel,
+		Artist:        trk.Artist,
+		Album:         trk.Album,
+		Title:         trk.Title,
+		Year:          int32(trk.Year),
+		PrimaryLink:   trk.PrimaryLink,
+		SecondaryLink: trk.SecondaryLink,
+		Duration:      int32(trk.Duration),
+	}
+}
+
+// The indexes are sorted sets of track IDs scored by the unix time the
+// track was first seen: channel:tracks:<channel>, year:tracks:<year>,
+// artist:tracks:<artist>, artist:album:tracks:<artist>:<album> and
+// artist:year:tracks:<artist>:<year>, keyed by artists.Key. The tracks
+// crediting an artist as featured are in its indexes too and in the
+// artist:featured:<artist> set.
+func channelTracksKey(channel string) string {
+	return fmt.Sprintf("channel:tracks:%s", channel)
+}
+
+// indexPatterns match every sorted set index.
+var indexPatterns = [...]string{
+	"channel:tracks:*",
+	"year:tracks:*",
+	"artist:tracks:*",
+	"artist:album:tracks:*",
+	"artist:year:tracks:*",
+}
+
+// trackIndexes are the keys a new track is added to, besides its channel.
+type trackIndexes struct {
+	year string
+	// artistScored are the scored indexes of the artists.
+	artistScored []string
+	// artistKeys and artistNames are the credited artists, main one first.
+	artistKeys  []string
+	artistNames []string
+	featured    []string
+}
+
+func indexesOf(trk tracks.Track) trackIndexes {
+	ix := trackIndexes{year: fmt.Sprintf("year:tracks:%d", trk.Year)}
+	main, featured := artists.Credits(trk.Artist, trk.Title)
+	for i, name := range append([]string{main}, featured...) {
+		key := artists.Key(name)
+		if key == "" {
+			continue
+		}
+		ix.artistKeys = append(ix.artistKeys, key)
+		ix.artistNames = append(ix.artistNames, name)
+		ix.artistScored = append(ix.artistScored,
+			fmt.Sprintf("artist:tracks:%s", key),
+			fmt.Sprintf("artist:album:tracks:%s:%s", key, trk.Album),
+			fmt.Sprintf("artist:year:tracks:%s:%d", key, trk.Year),
+		)
+		if i > 0 {
+			ix.featured = append(ix.featured, fmt.Sprintf("artist:featured:%s", key))
+		}
+	}
+	return ix
+}
+
+// indexArtists adds trk to the indexes of its artists outside of
+// saveTrackScript, for the migrations.
+func indexArtists(ctx context.Context, pipe goredis.Pipeliner, trk tracks.Track, score int64) {
+	ix := indexesOf(trk)
+	for _, key := range ix.artistScored {
+		_ = pipe.ZAddNX(ctx, key, goredis.Z{Score: float64(score), Member: trk.ID})
+	}
+	for i, key := range ix.artistKeys {
+		_ = pipe.SAdd(ctx, "artists", key)
+		_ = pipe.HSetNX(ctx, fmt.Sprintf("artist:%s", key), "name", ix.artistNames[i])
+	}
+	for _, key := range ix.featured {
+		_ = pipe.SAdd(ctx, key, trk.ID)
+	}
+}
+
+// saveTrackScript saves one track unless its stored message changed since
+// SaveTracks read it, or the lease it is saved under was given a newer
+// token. It returns 0 when it changed, 1 for a new track, 2 when only the
+// links and the membership were refreshed and -1 when it was fenced.
+//
+// KEYS: tracksbyid, tracklinks, trackids, channel:trackids:<channel>,
+// track:channels:<id>, channel:tracks:<channel>, artists, the lease fence,
+// the scored indexes, the artist hashes and the featured sets.
+// ARGV: id, channel, now, the message read, the message to save, the links,
+// the links read, the number of scored indexes and of artists, the fencing
+// token or 0, the artist keys and the artist names.
+var saveTrackScript = goredis.NewScript(`
+local id, channel, now = ARGV[1], ARGV[2], ARGV[3]
+local token = tonumber(ARGV[12])
+if token > 0 and tonumber(redis.call('GET', KEYS[8]) or '0') > token then
+	return -1
+end
+local read = redis.call('HGET', KEYS[1], id)
+if not read then
+	read = ''
+end
+if read ~= ARGV[4] then
+	return 0
+end
+redis.call('SADD', KEYS[4], id)
+redis.call('HSETNX', KEYS[5], channel .. ':first', now)
+redis.call('HSET', KEYS[5], channel .. ':last', now)
+redis.call('ZADD', KEYS[6], 'NX', now, id)
+if read ~= '' then
+	redis.call('HDEL', KEYS[2], ARGV[8], ARGV[9])
+end
+redis.call('HSET', KEYS[1], id, ARGV[5])
+redis.call('HSET', KEYS[2], ARGV[6], id, ARGV[7], id)
+if read ~= '' then
+	return 2
+end
+redis.call('SADD', KEYS[3], id)
+local scored, named = tonumber(ARGV[10]), tonumber(ARGV[11])
+local k = 9
+for i = 1, scored do
+	redis.call('ZADD', KEYS[k], 'NX', now, id)
+	k = k + 1
+end
+for i = 1, named do
+	redis.call('SADD', KEYS[7], ARGV[12 + i])
+	redis.call('HSETNX', KEYS[k], 'name', ARGV[12 + named + i])
+	k = k + 1
+end
+for i = k, #KEYS do
+	redis.call('SADD', KEYS[i], id)
+end
+return 1
+`)
+
+// maxSaveRounds caps the rounds in a row that save no track because others
+// changed them meanwhile.
+const maxSaveRounds = 5
+
+// SaveTracks adds new tracks to the indexes, tracks saved before only get
+// their links refreshed. Every track is recorded as seen on its channel.
+// Each track is saved atomically by saveTrackScript, saving a track again
+// leaves the indexes as they are.
 func (r Redis) SaveTracks(ctx context.Context, trks ...tracks.Track) error {
 	handleErr := func(err error) error {
-		return fmt.Errorf("save tracks: %w", err)
+		return fmt.Errorf("save tracks: %w", redisErr(err))
 	}
-	cmds, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
-		for _, trk := range trks {
-			trackMsg := protos.Track{
-				Channel:       trk.Channel,
-				Artist:        trk.Artist,
-				Album:         trk.Album,
-				Title:         trk.Title,
-				Year:          int32(trk.Year),
-				PrimaryLink:   trk.PrimaryLink,
-				SecondaryLink: trk.SecondaryLink,
-				Duration:      int32(trk.Duration),
-			}
-			rawTrackMsg, err := proto.Marshal(&trackMsg)
-			if err != nil {
-				return handleErr(err)
-			}
-			_ = pipe.HSet(ctx, "tracks", trk.PrimaryLink, rawTrackMsg)
-			_ = pipe.HSet(ctx, "tracks", trk.SecondaryLink, rawTrackMsg)
-			_ = pipe.SAdd(ctx, "trackprimarylinks", trk.PrimaryLink)
-			_ = pipe.SAdd(ctx, "tracksecondsarylinks", trk.SecondaryLink)
-			_ = pipe.LPush(ctx, fmt.Sprintf("channel:tracks:%s", trk.Channel), trk.PrimaryLink)
-			_ = pipe.LPush(ctx, fmt.Sprintf("artist:tracks:%s", trk.Artist), trk.PrimaryLink)
-			_ = pipe.LPush(ctx, fmt.Sprintf("artist:album:tracks:%s:%s", trk.Artist, trk.Album), trk.PrimaryLink)
-			_ = pipe.LPush(ctx, fmt.Sprintf("year:tracks:%d", trk.Year), trk.PrimaryLink)
-			_ = pipe.LPush(ctx, fmt.Sprintf("artist:year:tracks:%s:%d", trk.Artist, trk.Year), trk.PrimaryLink)
+	pending := make([]tracks.Track, len(trks))
+	for i, trk := range trks {
+		pending[i] = withID(trk)
+	}
+	for stalled := 0; len(pending) > 0; {
+		if stalled == maxSaveRounds {
+			return handleErr(fmt.Errorf("%d tracks kept changing while saved", len(pending)))
 		}
-		return nil
-	})
-	for _, cmd := range cmds {
-		if cmd.Err(); err != nil {
+		changed, err := r.saveTracks(ctx, pending)
+		if err != nil {
 			return handleErr(err)
 		}
+		if len(changed) == len(pending) {
+			stalled++
+		} else {
+			stalled = 0
+		}
+		pending = changed
 	}
 	return nil
 }
 
+// saveTracks runs saveTrackScript for trks in one round trip and returns
+// the tracks that changed since they were read. A track that comes twice is
+// saved once and returned, the second time it is a known track.
+func (r Redis) saveTracks(ctx context.Context, trks []tracks.Track) ([]tracks.Track, error) {
+	ids := make([]string, len(trks))
+	for i, trk := range trks {
+		ids[i] = trk.ID
+	}
+	saved, err := r.client.HMGet(ctx, tracksByIDKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	fence, _ := tracks.FenceOf(ctx)
+	now := time.Now().Unix()
+	keys := make([][]string, len(trks))
+	args := make([][]any, len(trks))
+	for i, trk := range trks {
+		read, _ := saved[i].(string)
+		if keys[i], args[i], err = saveTrackArgs(trk, read, fence, now); err != nil {
+			return nil, err
+		}
+	}
+	run := func() ([]*goredis.Cmd, error) {
+		cmds := make([]*goredis.Cmd, len(trks))
+		_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			for i := range trks {
+				cmds[i] = saveTrackScript.EvalSha(ctx, pipe, keys[i], args[i]...)
+			}
+			return nil
+		})
+		return cmds, err
+	}
+	cmds, err := run()
+	if goredis.HasErrorPrefix(err, "NOSCRIPT") {
+		if err := saveTrackScript.Load(ctx, r.client).Err(); err != nil {
+			return nil, err
+		}
+		cmds, err = run()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var changed []tracks.Track
+	for i, cmd := range cmds {
+		result, err := cmd.Int()
+		if err != nil {
+			return nil, err
+		}
+		switch result {
+		case -1:
+			return nil, &tracks.FencedError{Channel: fence.Channel, Token: fence.Token}
+		case 0:
+			changed = append(changed, trks[i])
+		}
+	}
+	return changed, nil
+}
+
+// saveTrackArgs are the keys and the arguments of saveTrackScript for trk,
+// read is its stored message or empty for a new track.
+func saveTrackArgs(trk tracks.Track, read string, fence tracks.Fence, now int64) ([]string, []any, error) {
+	msg := trackToMsg(trk)
+	var readPrimary, readSecondary string
+	if read != "" {
+		var old protos.Track
+		if err := proto.Unmarshal([]byte(read), &old); err != nil {
+			return nil, nil, err
+		}
+		readPrimary, readSecondary = old.PrimaryLink, old.SecondaryLink
+		old.PrimaryLink, old.SecondaryLink = trk.PrimaryLink, trk.SecondaryLink
+		msg = &old
+	}
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ix := indexesOf(trk)
+	keys := append([]string{
+		tracksByIDKey, trackLinksKey, trackIDsKey,
+		channelTrackIDsKey(trk.Channel), trackChannelsKey(trk.ID),
+		channelTracksKey(trk.Channel), "artists", FenceKey(fence.Channel), ix.year,
+	}, ix.artistScored...)
+	args := []any{
+		trk.ID, trk.Channel, now, read, raw,
+		trk.PrimaryLink, trk.SecondaryLink, readPrimary, readSecondary,
+		1 + len(ix.artistScored), len(ix.artistKeys), fence.Token,
+	}
+	for _, key := range ix.artistKeys {
+		keys = append(keys, fmt.Sprintf("artist:%s", key))
+		args = append(args, key)
+	}
+	for _, name := range ix.artistNames {
+		args = append(args, name)
+	}
+	keys = append(keys, ix.featured...)
+	return keys, args, nil
+}
+
+// Channels are kept in the channels set of data ids, each with a
+// channel:<data id> hash.
+const channelsKey = "channels"
+
+func channelKey(dataId string) string {
+	return fmt.Sprintf("channel:%s", dataId)
+}
+
 func (r Redis) SaveChannels(ctx context.Context, chs ...tracks.Channel) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("save channels: %w", redisErr(err))
+	}
 	cmds, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
 		for _, ch := range chs {
-			_ = pipe.HSet(ctx, "channels", map[string]any{
-				"name":   ch.Name,
-				"dataId": ch.DataId,
+			_ = pipe.SAdd(ctx, channelsKey, ch.DataId)
+			_ = pipe.HSet(ctx, channelKey(ch.DataId), map[string]any{
+				"name":        ch.Name,
+				"dataId":      ch.DataId,
+				"oldId":       ch.OldId,
+				"description": ch.Description,
+				"image":       ch.Image,
 			})
+			for _, c := range ch.Categories {
+				_ = pipe.SAdd(ctx, "categories", c.Slug)
+				_ = pipe.HSet(ctx, fmt.Sprintf("category:%s", c.Slug), "name", c.Name)
+				// a page crawled on its own doesn't know the parent, keep the one
+				// recorded before
+				if c.Parent != "" {
+					_ = pipe.HSet(ctx, fmt.Sprintf("category:%s", c.Slug), "parent", c.Parent)
+					_ = pipe.SAdd(ctx, fmt.Sprintf("category:children:%s", c.Parent), c.Slug)
+				}
+				_ = pipe.SAdd(ctx, fmt.Sprintf("category:channels:%s", c.Slug), ch.DataId)
+				_ = pipe.SAdd(ctx, fmt.Sprintf("channel:categories:%s", ch.DataId), c.Slug)
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return handleErr(err)
+	}
 	for _, cmd := range cmds {
-		if cmd.Err(); err != nil {
-			return fmt.Errorf("save channels: %w", err)
+		if err := cmd.Err(); err != nil {
+			return handleErr(err)
 		}
 	}
 	return nil
 }
 
+func (r Redis) SetChannelEnabled(ctx context.Context, dataId string, enabled bool) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("set channel enabled: %w", redisErr(err))
+	}
+	exists, err := r.client.SIsMember(ctx, channelsKey, dataId).Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	if !exists {
+		return handleErr(&tracks.NotFoundError{Entity: "channel", Key: dataId})
+	}
+	if enabled {
+		err = r.client.SRem(ctx, "channels:disabled", dataId).Err()
+	} else {
+		err = r.client.SAdd(ctx, "channels:disabled", dataId).Err()
+	}
+	if err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+func (r Redis) IsChannelEnabled(ctx context.Context, dataId string) (bool, error) {
+	disabled, err := r.client.SIsMember(ctx, "channels:disabled", dataId).Result()
+	if err != nil {
+		return false, fmt.Errorf("is channel enabled: %w", redisErr(err))
+	}
+	return !disabled, nil
+}
+
+func (r Redis) GetCategories(ctx context.Context) ([]tracks.Category, error) {
+	handleErr := func(err error) ([]tracks.Category, error) {
+		return nil, fmt.Errorf("get categories: %w", redisErr(err))
+	}
+	slugs, err := r.client.SMembers(ctx, "categories").Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	cc, err := r.getCategories(ctx, slugs)
+	if err != nil {
+		return handleErr(err)
+	}
+	return cc, nil
+}
+
+func (r Redis) GetChannelCategories(ctx context.Context, dataId string) ([]tracks.Category, error) {
+	handleErr := func(err error) ([]tracks.Category, error) {
+		return nil, fmt.Errorf("get channel categories: %w", redisErr(err))
+	}
+	slugs, err := r.client.SMembers(ctx, fmt.Sprintf("channel:categories:%s", dataId)).Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	cc, err := r.getCategories(ctx, slugs)
+	if err != nil {
+		return handleErr(err)
+	}
+	return cc, nil
+}
+
+func (r Redis) getCategories(ctx context.Context, slugs []string) ([]tracks.Category, error) {
+	sort.Strings(slugs)
+	cmds := make([]*goredis.MapStringStringCmd, len(slugs))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, slug := range slugs {
+			cmds[i] = pipe.HGetAll(ctx, fmt.Sprintf("category:%s", slug))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	cc := make([]tracks.Category, 0, len(slugs))
+	for i, cmd := range cmds {
+		fields, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		cc = append(cc, tracks.Category{
+			Slug:   slugs[i],
+			Name:   fields["name"],
+			Parent: fields["parent"],
+		})
+	}
+	return cc, nil
+}
+
+func (r Redis) GetChannelsByCategory(ctx context.Context, slug string) ([]tracks.Channel, error) {
+	handleErr := func(err error) ([]tracks.Channel, error) {
+		return nil, fmt.Errorf("get channels by category: %w", redisErr(err))
+	}
+	dataIds := map[string]struct{}{}
+	visited := map[string]struct{}{}
+	queue := []string{slug}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[cur]; ok {
+			continue
+		}
+		visited[cur] = struct{}{}
+		ids, err := r.client.SMembers(ctx, fmt.Sprintf("category:channels:%s", cur)).Result()
+		if err != nil {
+			return handleErr(err)
+		}
+		for _, id := range ids {
+			dataIds[id] = struct{}{}
+		}
+		children, err := r.client.SMembers(ctx, fmt.Sprintf("category:children:%s", cur)).Result()
+		if err != nil {
+			return handleErr(err)
+		}
+		queue = append(queue, children...)
+	}
+	ids := make([]string, 0, len(dataIds))
+	for id := range dataIds {
+		ids = append(ids, id)
+	}
+	chs, err := r.getChannels(ctx, ids)
+	if err != nil {
+		return handleErr(err)
+	}
+	return chs, nil
+}
+
+func (r Redis) GetChannels(ctx context.Context) ([]tracks.Channel, error) {
+	handleErr := func(err error) ([]tracks.Channel, error) {
+		return nil, fmt.Errorf("get channels: %w", redisErr(err))
+	}
+	ids, err := r.client.SMembers(ctx, channelsKey).Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	chs, err := r.getChannels(ctx, ids)
+	if err != nil {
+		return handleErr(err)
+	}
+	return chs, nil
+}
+
+// getChannels reads the channel hashes of dataIds sorted by name, channels
+// without a hash are named by their data id only.
+func (r Redis) getChannels(ctx context.Context, dataIds []string) ([]tracks.Channel, error) {
+	cmds := make([]*goredis.MapStringStringCmd, len(dataIds))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, id := range dataIds {
+			cmds[i] = pipe.HGetAll(ctx, channelKey(id))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	chs := make([]tracks.Channel, 0, len(dataIds))
+	for i, cmd := range cmds {
+		fields, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		chs = append(chs, tracks.Channel{
+			Name:        fields["name"],
+			DataId:      dataIds[i],
+			OldId:       fields["oldId"],
+			Description: fields["description"],
+			Image:       fields["image"],
+		})
+	}
+	sort.Slice(chs, func(i, j int) bool {
+		if chs[i].Name != chs[j].Name {
+			return chs[i].Name < chs[j].Name
+		}
+		return chs[i].DataId < chs[j].DataId
+	})
+	return chs, nil
+}
+
 func (r Redis) GetTrackByLink(ctx context.Context, link string) (tracks.Track, error) {
 	handleErr := func(err error) (tracks.Track, error) {
-		return tracks.Track{}, fmt.Errorf("get track by link: %w", err)
+		return tracks.Track{}, fmt.Errorf("get track by link: %w", redisErr(err))
+	}
+	id, err := r.client.HGet(ctx, trackLinksKey, link).Result()
+	if errors.Is(err, goredis.Nil) {
+		return handleErr(&tracks.NotFoundError{Entity: "track", Key: link})
+	} else if err != nil {
+		return handleErr(err)
 	}
-	rawTrack, err := r.client.HGet(ctx, "tracks", link).Bytes()
+	rawTrack, err := r.client.HGet(ctx, tracksByIDKey, id).Bytes()
 	if errors.Is(err, goredis.Nil) {
-		return handleErr(tracks.ErrNotFound)
+		return handleErr(&tracks.NotFoundError{Entity: "track", Key: link})
 	} else if err != nil {
 		return handleErr(err)
 	}
@@ -126,12 +632,79 @@ func (r Redis) GetTrackByLink(ctx context.Context, link string) (tracks.Track, e
 	if err := proto.Unmarshal(rawTrack, &trackMsg); err != nil {
 		return handleErr(err)
 	}
-	trk := msgToTrack(&trackMsg)
+	fields, err := r.client.HGetAll(ctx, trackChannelsKey(id)).Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	trk := msgToTrack(id, &trackMsg)
+	trk.Channels = hashMemberships(fields)
 	return trk, nil
 }
 
-func msgToTrack(msg *protos.Track) tracks.Track {
+// UnknownIDs asks the ID set of the channel or of all tracks with SMISMEMBER, servers older than 6.2 are
+// asked with pipelined SISMEMBER instead.
+func (r Redis) UnknownIDs(ctx context.Context, channel string, ids ...string) ([]string, error) {
+	handleErr := func(err error) ([]string, error) {
+		return nil, fmt.Errorf("unknown ids: %w", redisErr(err))
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	members := make([]any, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	key := trackIDsKey
+	if channel != "" {
+		key = channelTrackIDsKey(channel)
+	}
+	known, err := r.client.SMIsMember(ctx, key, members...).Result()
+	if isUnknownCommand(err) {
+		known, err = r.isMember(ctx, key, ids)
+	}
+	if err != nil {
+		return handleErr(err)
+	}
+	unknown := make([]string, 0, len(ids))
+	for i, id := range ids {
+		if !known[i] {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown, nil
+}
+
+func (r Redis) isMember(ctx context.Context, key string, members []string) ([]bool, error) {
+	cmds := make([]*goredis.BoolCmd, len(members))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, m := range members {
+			cmds[i] = pipe.SIsMember(ctx, key, m)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	known := make([]bool, len(members))
+	for i, cmd := range cmds {
+		ok, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		known[i] = ok
+	}
+	return known, nil
+}
+
+func isUnknownCommand(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "ERR unknown command")
+}
+
+func msgToTrack(id string, msg *protos.Track) tracks.Track {
+	if msg.Id != "" {
+		id = msg.Id
+	}
 	return tracks.Track{
+		ID:            id,
 		Channel:       msg.Channel,
 		Artist:        msg.Artist,
 		Album:         msg.Album,
@@ -141,34 +714,1002 @@ func msgToTrack(msg *protos.Track) tracks.Track {
 		SecondaryLink: msg.SecondaryLink,
 		Duration:      int(msg.Duration),
 	}
-
 }
 
 func (r Redis) GetAllTracks(ctx context.Context, run func(ctx context.Context, t tracks.Track) error) error {
 	handleErr := func(err error) error {
-		return fmt.Errorf("get track by link: %w", err)
+		return fmt.Errorf("get all tracks: %w", redisErr(err))
 	}
-	const defaultCount = 10
+	const defaultCount = 100
 	var cursor uint64 = 0
 	for {
-		links, newCursor, err := r.client.SScan(ctx, "trackprimarylinks", cursor, "", defaultCount).Result()
+		ids, newCursor, err := r.client.SScan(ctx, trackIDsKey, cursor, "", defaultCount).Result()
 		if err != nil {
 			return handleErr(err)
 		}
-		for _, link := range links {
-			rawTrackMsg, err := r.client.HGet(ctx, "tracks", link).Bytes()
+		trks, err := r.getTracks(ctx, ids)
+		if err != nil {
+			return handleErr(err)
+		}
+		for _, trk := range trks {
+			if err := run(ctx, trk); err != nil {
+				return handleErr(err)
+			}
+		}
+		cursor = newCursor
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// getTracks reads the tracks of ids with their memberships in one round
+// trip, unknown ids are skipped.
+func (r Redis) getTracks(ctx context.Context, ids []string) ([]tracks.Track, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var rawTrackMsgs *goredis.SliceCmd
+	memberships := make([]*goredis.MapStringStringCmd, len(ids))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		rawTrackMsgs = pipe.HMGet(ctx, tracksByIDKey, ids...)
+		for i, id := range ids {
+			memberships[i] = pipe.HGetAll(ctx, trackChannelsKey(id))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	raws, err := rawTrackMsgs.Result()
+	if err != nil {
+		return nil, err
+	}
+	trks := make([]tracks.Track, 0, len(ids))
+	for i, raw := range raws {
+		raw, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var trackMsg protos.Track
+		if err := proto.Unmarshal([]byte(raw), &trackMsg); err != nil {
+			return nil, err
+		}
+		fields, err := memberships[i].Result()
+		if err != nil {
+			return nil, err
+		}
+		trk := msgToTrack(ids[i], &trackMsg)
+		trk.Channels = hashMemberships(fields)
+		trks = append(trks, trk)
+	}
+	return trks, nil
+}
+
+// FindTracks reads the candidates from the most specific index of f,
+// artist:album:tracks, artist:year:tracks, artist:tracks, channel:tracks and
+// year:tracks in that order, and filters them by the rest of f. The indexes
+// of the aliases of the artist are read too. Without an index to use all
+// tracks are read.
+func (r Redis) FindTracks(ctx context.Context, f tracks.TrackFilter) ([]tracks.Track, error) {
+	handleErr := func(err error) ([]tracks.Track, error) {
+		return nil, fmt.Errorf("find tracks: %w", redisErr(err))
+	}
+	aliases, err := r.aliases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	resolve := func(name string) string {
+		key := artists.Key(name)
+		if target, ok := aliases[key]; ok {
+			return target
+		}
+		return key
+	}
+	artist := ""
+	if f.Artist != "" {
+		if artist = resolve(f.Artist); artist == "" {
+			return handleErr(fmt.Errorf("empty artist %q", f.Artist))
+		}
+	}
+	var lists []string
+	switch {
+	case artist != "":
+		keys := []string{artist}
+		for alias, target := range aliases {
+			if target == artist {
+				keys = append(keys, alias)
+			}
+		}
+		for _, key := range keys {
+			switch {
+			case f.Album != "":
+				lists = append(lists, fmt.Sprintf("artist:album:tracks:%s:%s", key, f.Album))
+			case f.Year != 0:
+				lists = append(lists, fmt.Sprintf("artist:year:tracks:%s:%d", key, f.Year))
+			default:
+				lists = append(lists, fmt.Sprintf("artist:tracks:%s", key))
+			}
+		}
+	case f.Channel != "":
+		lists = append(lists, channelTracksKey(f.Channel))
+	case f.Year != 0:
+		lists = append(lists, fmt.Sprintf("year:tracks:%d", f.Year))
+	}
+	var ids []string
+	if lists == nil {
+		if ids, err = r.client.SMembers(ctx, trackIDsKey).Result(); err != nil {
+			return handleErr(err)
+		}
+	} else {
+		cmds := make([]*goredis.StringSliceCmd, len(lists))
+		if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			for i, key := range lists {
+				cmds[i] = pipe.ZRevRange(ctx, key, 0, -1)
+			}
+			return nil
+		}); err != nil {
+			return handleErr(err)
+		}
+		seen := map[string]bool{}
+		for _, cmd := range cmds {
+			listed, err := cmd.Result()
 			if err != nil {
 				return handleErr(err)
 			}
+			for _, id := range listed {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	const batch = 500
+	var found []tracks.Track
+	for start := 0; start < len(ids); start += batch {
+		end := start + batch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		trks, err := r.getTracks(ctx, ids[start:end])
+		if err != nil {
+			return handleErr(err)
+		}
+		for _, trk := range trks {
+			if matches(trk, f, artist, resolve) {
+				found = append(found, trk)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := firstSeen(found[i]), firstSeen(found[j])
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return found[i].ID < found[j].ID
+	})
+	if f.Limit > 0 && len(found) > f.Limit {
+		found = found[:f.Limit]
+	}
+	return found, nil
+}
+
+// matches checks trk against f, artist is the resolved key of f.Artist.
+func matches(trk tracks.Track, f tracks.TrackFilter, artist string, resolve func(string) string) bool {
+	if f.Album != "" && trk.Album != f.Album {
+		return false
+	}
+	if f.Year != 0 && trk.Year != f.Year {
+		return false
+	}
+	if f.Channel != "" {
+		seen := false
+		for _, m := range trk.Channels {
+			seen = seen || m.Channel == f.Channel
+		}
+		if !seen {
+			return false
+		}
+	}
+	if artist != "" {
+		main, featured := artists.Credits(trk.Artist, trk.Title)
+		credited := resolve(main) == artist
+		for _, name := range featured {
+			credited = credited || resolve(name) == artist
+		}
+		if !credited {
+			return false
+		}
+	}
+	return true
+}
+
+func firstSeen(trk tracks.Track) time.Time {
+	var first time.Time
+	for _, m := range trk.Channels {
+		if first.IsZero() || m.FirstSeen.Before(first) {
+			first = m.FirstSeen
+		}
+	}
+	return first
+}
+
+// Alias rules are kept in the artist:aliases hash from the alias key to the
+// artist key, artist:alias:names holds the alias as it was written.
+func (r Redis) aliases(ctx context.Context) (map[string]string, error) {
+	return r.client.HGetAll(ctx, "artist:aliases").Result()
+}
+
+func (r Redis) artistNames(ctx context.Context, keys []string) ([]string, error) {
+	cmds := make([]*goredis.StringCmd, len(keys))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGet(ctx, fmt.Sprintf("artist:%s", key), "name")
+		}
+		return nil
+	}); err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, cmd := range cmds {
+		name, err := cmd.Result()
+		if err != nil && !errors.Is(err, goredis.Nil) {
+			return nil, err
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+func (r Redis) GetArtists(ctx context.Context) ([]tracks.Artist, error) {
+	handleErr := func(err error) ([]tracks.Artist, error) {
+		return nil, fmt.Errorf("get artists: %w", redisErr(err))
+	}
+	keys, err := r.client.SMembers(ctx, "artists").Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	aliases, err := r.aliases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	aliasNames, err := r.client.HGetAll(ctx, "artist:alias:names").Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	canonical := keys[:0]
+	for _, key := range keys {
+		if _, ok := aliases[key]; !ok {
+			canonical = append(canonical, key)
+		}
+	}
+	sort.Strings(canonical)
+	names, err := r.artistNames(ctx, canonical)
+	if err != nil {
+		return handleErr(err)
+	}
+	byKey := map[string][]string{}
+	for alias, artist := range aliases {
+		byKey[artist] = append(byKey[artist], aliasNames[alias])
+	}
+	aa := make([]tracks.Artist, len(canonical))
+	for i, key := range canonical {
+		sort.Strings(byKey[key])
+		aa[i] = tracks.Artist{
+			ID:      key,
+			Name:    names[i],
+			Aliases: byKey[key],
+		}
+	}
+	return aa, nil
+}
+
+func (r Redis) GetAliasRules(ctx context.Context) ([]tracks.AliasRule, error) {
+	handleErr := func(err error) ([]tracks.AliasRule, error) {
+		return nil, fmt.Errorf("get alias rules: %w", redisErr(err))
+	}
+	aliases, err := r.aliases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	aliasNames, err := r.client.HGetAll(ctx, "artist:alias:names").Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	keys := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		keys = append(keys, alias)
+	}
+	sort.Strings(keys)
+	targets := make([]string, len(keys))
+	for i, alias := range keys {
+		targets[i] = aliases[alias]
+	}
+	names, err := r.artistNames(ctx, targets)
+	if err != nil {
+		return handleErr(err)
+	}
+	rules := make([]tracks.AliasRule, len(keys))
+	for i, alias := range keys {
+		rules[i] = tracks.AliasRule{Alias: aliasNames[alias], Artist: names[i]}
+	}
+	return rules, nil
+}
+
+// SaveAliasRule works like Sqlite.SaveAliasRule, rules never chain.
+func (r Redis) SaveAliasRule(ctx context.Context, rule tracks.AliasRule) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("save alias rule: %w", redisErr(err))
+	}
+	alias, artist := artists.Key(rule.Alias), artists.Key(rule.Artist)
+	if alias == "" || artist == "" {
+		return handleErr(fmt.Errorf("empty artist in alias rule %q -> %q", rule.Alias, rule.Artist))
+	}
+	aliases, err := r.aliases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	target, isAlias := aliases[artist]
+	if isAlias {
+		artist = target
+	}
+	if alias == artist {
+		return handleErr(fmt.Errorf("alias rule %q -> %q is a cycle", rule.Alias, rule.Artist))
+	}
+	cmds, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		_ = pipe.SAdd(ctx, "artists", artist, alias)
+		if isAlias {
+			_ = pipe.HSetNX(ctx, fmt.Sprintf("artist:%s", artist), "name", artists.Name(rule.Artist))
+		} else {
+			_ = pipe.HSet(ctx, fmt.Sprintf("artist:%s", artist), "name", artists.Name(rule.Artist))
+		}
+		_ = pipe.HSetNX(ctx, fmt.Sprintf("artist:%s", alias), "name", artists.Name(rule.Alias))
+		for a, target := range aliases {
+			if target == alias {
+				_ = pipe.HSet(ctx, "artist:aliases", a, artist)
+			}
+		}
+		_ = pipe.HSet(ctx, "artist:aliases", alias, artist)
+		_ = pipe.HSet(ctx, "artist:alias:names", alias, artists.Name(rule.Alias))
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return handleErr(err)
+		}
+	}
+	return nil
+}
+
+func (r Redis) DeleteAliasRule(ctx context.Context, alias string) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("delete alias rule: %w", redisErr(err))
+	}
+	key := artists.Key(alias)
+	var deleted *goredis.IntCmd
+	if _, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		deleted = pipe.HDel(ctx, "artist:aliases", key)
+		_ = pipe.HDel(ctx, "artist:alias:names", key)
+		return nil
+	}); err != nil {
+		return handleErr(err)
+	}
+	if deleted.Val() == 0 {
+		return handleErr(&tracks.NotFoundError{Entity: "alias rule", Key: alias})
+	}
+	return nil
+}
+
+// TopArtists counts the credits of the tracks indexed for the channel.
+func (r Redis) TopArtists(ctx context.Context, channel string, limit int) ([]tracks.ArtistCount, error) {
+	handleErr := func(err error) ([]tracks.ArtistCount, error) {
+		return nil, fmt.Errorf("top artists: %w", redisErr(err))
+	}
+	ids, err := r.client.ZRange(ctx, channelTracksKey(channel), 0, -1).Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	aliases, err := r.aliases(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	resolve := func(name string) string {
+		key := artists.Key(name)
+		if target, ok := aliases[key]; ok {
+			return target
+		}
+		return key
+	}
+	counts := map[string]*tracks.ArtistCount{}
+	count := func(key string) *tracks.ArtistCount {
+		c, ok := counts[key]
+		if !ok {
+			c = &tracks.ArtistCount{Artist: tracks.Artist{ID: key}}
+			counts[key] = c
+		}
+		return c
+	}
+	seen := map[string]bool{}
+	const batch = 500
+	for start := 0; start < len(ids); start += batch {
+		end := start + batch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		raws, err := r.client.HMGet(ctx, tracksByIDKey, ids[start:end]...).Result()
+		if err != nil {
+			return handleErr(err)
+		}
+		for i, raw := range raws {
+			raw, ok := raw.(string)
+			if !ok || seen[ids[start+i]] {
+				continue
+			}
+			seen[ids[start+i]] = true
 			var trackMsg protos.Track
-			if err := proto.Unmarshal(rawTrackMsg, &trackMsg); err != nil {
+			if err := proto.Unmarshal([]byte(raw), &trackMsg); err != nil {
 				return handleErr(err)
 			}
-			trk := msgToTrack(&trackMsg)
-			if err := run(ctx, trk); err != nil {
-				return handleErr(err)
+			main, featured := artists.Credits(trackMsg.Artist, trackMsg.Title)
+			credited := map[string]bool{}
+			if key := resolve(main); key != "" {
+				credited[key] = true
+				count(key).Tracks++
+			}
+			for _, f := range featured {
+				if key := resolve(f); key != "" && !credited[key] {
+					credited[key] = true
+					count(key).Featured++
+				}
+			}
+		}
+	}
+	top := make([]tracks.ArtistCount, 0, len(counts))
+	for _, c := range counts {
+		top = append(top, *c)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		a, b := top[i], top[j]
+		if a.Tracks+a.Featured != b.Tracks+b.Featured {
+			return a.Tracks+a.Featured > b.Tracks+b.Featured
+		}
+		if a.Tracks != b.Tracks {
+			return a.Tracks > b.Tracks
+		}
+		return a.Artist.ID < b.Artist.ID
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	keys := make([]string, len(top))
+	for i, c := range top {
+		keys[i] = c.Artist.ID
+	}
+	names, err := r.artistNames(ctx, keys)
+	if err != nil {
+		return handleErr(err)
+	}
+	for i := range top {
+		top[i].Artist.Name = names[i]
+	}
+	return top, nil
+}
+
+// Duplicate groups are kept in the duplicates set, each with a
+// duplicate:<id> hash and a duplicate:tracks:<id> set.
+func (r Redis) GetDuplicateGroups(ctx context.Context) ([]tracks.DuplicateGroup, error) {
+	handleErr := func(err error) ([]tracks.DuplicateGroup, error) {
+		return nil, fmt.Errorf("get duplicate groups: %w", redisErr(err))
+	}
+	ids, err := r.client.SMembers(ctx, "duplicates").Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	sort.Strings(ids)
+	fields := make([]*goredis.MapStringStringCmd, len(ids))
+	members := make([]*goredis.StringSliceCmd, len(ids))
+	if _, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, id := range ids {
+			fields[i] = pipe.HGetAll(ctx, fmt.Sprintf("duplicate:%s", id))
+			members[i] = pipe.SMembers(ctx, fmt.Sprintf("duplicate:tracks:%s", id))
+		}
+		return nil
+	}); err != nil {
+		return handleErr(err)
+	}
+	groups := make([]tracks.DuplicateGroup, 0, len(ids))
+	for i, id := range ids {
+		f, err := fields[i].Result()
+		if err != nil {
+			return handleErr(err)
+		}
+		trackIDs, err := members[i].Result()
+		if err != nil {
+			return handleErr(err)
+		}
+		sort.Strings(trackIDs)
+		groups = append(groups, tracks.DuplicateGroup{
+			ID:        id,
+			TrackIDs:  trackIDs,
+			Preferred: f["preferred"],
+			Reviewed:  f["reviewed"] == "1",
+		})
+	}
+	return groups, nil
+}
+
+func (r Redis) ReplaceDuplicateGroups(ctx context.Context, groups ...tracks.DuplicateGroup) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("replace duplicate groups: %w", redisErr(err))
+	}
+	old, err := r.client.SMembers(ctx, "duplicates").Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	cmds, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		keys := []string{"duplicates"}
+		for _, id := range old {
+			keys = append(keys, fmt.Sprintf("duplicate:%s", id), fmt.Sprintf("duplicate:tracks:%s", id))
+		}
+		_ = pipe.Del(ctx, keys...)
+		for _, g := range groups {
+			reviewed := 0
+			if g.Reviewed {
+				reviewed = 1
+			}
+			_ = pipe.SAdd(ctx, "duplicates", g.ID)
+			_ = pipe.HSet(ctx, fmt.Sprintf("duplicate:%s", g.ID), "preferred", g.Preferred, "reviewed", reviewed)
+			members := make([]any, len(g.TrackIDs))
+			for i, id := range g.TrackIDs {
+				members[i] = id
+			}
+			_ = pipe.SAdd(ctx, fmt.Sprintf("duplicate:tracks:%s", g.ID), members...)
+		}
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return handleErr(err)
+		}
+	}
+	return nil
+}
+
+// redisMigrations are applied in order, the number applied is kept in the
+// schema:version key.
+var redisMigrations = [...]func(ctx context.Context, r Redis) error{
+	migrateRedisTrackID,
+	migrateRedisArtists,
+	migrateRedisMemberships,
+	migrateRedisChannels,
+	migrateRedisSortedIndexes,
+	migrateRedisFeaturedIndexes,
+}
+
+// migrateLockKey holds the token of the ripper running the migrations for
+// migrateLockTTL, renewed while they run. The other rippers wait for it.
+const migrateLockKey = "schema:lock"
+
+var migrateLockTTL = 30 * time.Second
+
+// renewLockScript extends the lock ARGV[1] holds by ARGV[2] milliseconds.
+var renewLockScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// unlockScript drops the lock ARGV[1] holds.
+var unlockScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Migrate brings the keys written by older versions up to date. Rippers
+// starting together migrate one at a time, the later ones find the schema
+// up to date.
+func (r Redis) Migrate(ctx context.Context) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("migrate: %w", redisErr(err))
+	}
+	unlock, err := r.lockMigrate(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer unlock()
+	version, err := r.client.Get(ctx, "schema:version").Int()
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return handleErr(err)
+	}
+	for ; version < len(redisMigrations); version++ {
+		if err := redisMigrations[version](ctx, r); err != nil {
+			return handleErr(fmt.Errorf("migration %d: %w", version+1, err))
+		}
+		if err := r.client.Set(ctx, "schema:version", version+1, 0).Err(); err != nil {
+			return handleErr(err)
+		}
+	}
+	return nil
+}
+
+// lockMigrate waits until it holds migrateLockKey and renews it until
+// unlock is called.
+func (r Redis) lockMigrate(ctx context.Context) (func(), error) {
+	token := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	ttl := migrateLockTTL.Milliseconds()
+	for {
+		ok, err := r.client.SetNX(ctx, migrateLockKey, token, migrateLockTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(migrateLockTTL / 30):
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(migrateLockTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if err := renewLockScript.Run(ctx, r.client, []string{migrateLockKey}, token, ttl).Err(); err != nil {
+					r.l.Printf("renew migrate lock: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		// the lock expires anyway when the context is gone
+		if err := unlockScript.Run(context.Background(), r.client, []string{migrateLockKey}, token).Err(); err != nil {
+			r.l.Printf("unlock migrate lock: %v", err)
+		}
+	}, nil
+}
+
+// migrateRedisTrackID moves the tracks hash keyed by links to the ID keyed
+// layout. The per channel, artist and year lists held links and are rebuilt
+// with IDs. The tracks hash goes last, so a run that stopped halfway is
+// done again on the next start.
+func migrateRedisTrackID(ctx context.Context, r Redis) error {
+	// nothing to move, the indexes are in the new layout already
+	if n, err := r.client.Exists(ctx, "tracks").Result(); err != nil || n == 0 {
+		return err
+	}
+	byID := map[string]tracks.Track{}
+	var order []string
+	var merged []tracks.Track
+	var cursor uint64
+	for {
+		kvs, newCursor, err := r.client.HScan(ctx, "tracks", cursor, "", 100).Result()
+		if err != nil {
+			return err
+		}
+		for i := 1; i < len(kvs); i += 2 {
+			var trackMsg protos.Track
+			if err := proto.Unmarshal([]byte(kvs[i]), &trackMsg); err != nil {
+				return err
+			}
+			trk := withID(msgToTrack("", &trackMsg))
+			first, ok := byID[trk.ID]
+			if !ok {
+				order = append(order, trk.ID)
+				byID[trk.ID] = trk
+				continue
+			}
+			// the same track saved under another host, kept with the
+			// links of the first for its channel
+			if trk.Channel != first.Channel {
+				first.Channel = trk.Channel
+				merged = append(merged, first)
+			}
+		}
+		cursor = newCursor
+		if cursor == 0 {
+			break
+		}
+	}
+	for _, pattern := range indexPatterns {
+		iter := r.client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			if err := r.client.Del(ctx, iter.Val()).Err(); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	const batch = 500
+	for start := 0; start < len(order); start += batch {
+		end := start + batch
+		if end > len(order) {
+			end = len(order)
+		}
+		trks := make([]tracks.Track, 0, end-start)
+		for _, id := range order[start:end] {
+			trks = append(trks, byID[id])
+		}
+		if err := r.SaveTracks(ctx, trks...); err != nil {
+			return err
+		}
+		// the tracks saved by a run that stopped halfway are in tracksbyid,
+		// saving them again only refreshed their links
+		now := time.Now().Unix()
+		cmds, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			for _, trk := range trks {
+				_ = pipe.ZAddNX(ctx, indexesOf(trk).year, goredis.Z{Score: float64(now), Member: trk.ID})
+				indexArtists(ctx, pipe, trk, now)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.SaveTracks(ctx, merged...); err != nil {
+		return err
+	}
+	return r.client.Del(ctx, "tracks", "trackprimarylinks", "tracksecondsarylinks").Err()
+}
+
+// migrateRedisArtists rekeys the artist lists, they were keyed by the raw
+// artist string.
+func migrateRedisArtists(ctx context.Context, r Redis) error {
+	for _, pattern := range [...]string{
+		"artist:tracks:*",
+		"artist:album:tracks:*",
+		"artist:year:tracks:*",
+	} {
+		iter := r.client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			if err := r.client.Del(ctx, iter.Val()).Err(); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		score := time.Now().Unix()
+		if first := firstSeen(t); !first.IsZero() {
+			score = first.Unix()
+		}
+		_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			indexArtists(ctx, pipe, t, score)
+			return nil
+		})
+		return err
+	})
+}
+
+// migrateRedisMemberships records the saved tracks as seen on their channel.
+func migrateRedisMemberships(ctx context.Context, r Redis) error {
+	now := time.Now().Unix()
+	return r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			_ = pipe.SAdd(ctx, channelTrackIDsKey(t.Channel), t.ID)
+			_ = pipe.HSetNX(ctx, trackChannelsKey(t.ID), t.Channel+":first", now)
+			_ = pipe.HSetNX(ctx, trackChannelsKey(t.ID), t.Channel+":last", now)
+			return nil
+		})
+		return err
+	})
+}
+
+// migrateRedisChannels replaces the channels hash, every channel overwrote
+// the same fields of it, with the set of the channel:<data id> hashes.
+func migrateRedisChannels(ctx context.Context, r Redis) error {
+	if err := r.client.Del(ctx, channelsKey).Err(); err != nil {
+		return err
+	}
+	iter := r.client.Scan(ctx, 0, "channel:*", 100).Iterator()
+	for iter.Next(ctx) {
+		dataId := strings.TrimPrefix(iter.Val(), "channel:")
+		// channel:tracks:<data id> and the like are not channels
+		if strings.Contains(dataId, ":") {
+			continue
+		}
+		typ, err := r.client.Type(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+		if typ != "hash" {
+			continue
+		}
+		if err := r.client.SAdd(ctx, channelsKey, dataId).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// migrateRedisSortedIndexes turns the index lists into sorted sets, saves
+// would fail on the lists.
+func migrateRedisSortedIndexes(ctx context.Context, r Redis) error {
+	stats, err := r.compactIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	if stats.Lists > 0 {
+		r.l.Printf("migrate: %s", stats)
+	}
+	return nil
+}
+
+// migrateRedisFeaturedIndexes adds the tracks to the album and year indexes
+// of their featured artists, only the main artist had them.
+func migrateRedisFeaturedIndexes(ctx context.Context, r Redis) error {
+	now := time.Now()
+	return r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		score := now.Unix()
+		if first := firstSeen(t); !first.IsZero() {
+			score = first.Unix()
+		}
+		cmds, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			indexArtists(ctx, pipe, t, score)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r Redis) indexLists(ctx context.Context) ([]string, error) {
+	var lists []string
+	for _, pattern := range indexPatterns {
+		iter := r.client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			typ, err := r.client.Type(ctx, iter.Val()).Result()
+			if err != nil {
+				return nil, err
+			}
+			if typ == "list" {
+				lists = append(lists, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// CompactStats counts what CompactIndexes did.
+type CompactStats struct {
+	Lists   int
+	Tracks  int
+	Dropped int
+}
+
+func (s CompactStats) String() string {
+	return fmt.Sprintf("%d lists compacted into %d entries, %d duplicate or unknown entries dropped",
+		s.Lists, s.Tracks, s.Dropped)
+}
+
+// CompactIndexes turns the index lists written by older versions into sorted
+// sets without the duplicates and the unknown tracks. Each track is scored
+// by the time it was first seen on the channel of the index, or on any
+// channel. Nothing else should write meanwhile. The lists of a schema older
+// than the migrations hold links the compaction would drop as unknown, it
+// refuses to run before Migrate.
+func (r Redis) CompactIndexes(ctx context.Context) (CompactStats, error) {
+	handleErr := func(err error) (CompactStats, error) {
+		return CompactStats{}, fmt.Errorf("compact indexes: %w", redisErr(err))
+	}
+	version, err := r.client.Get(ctx, "schema:version").Int()
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return handleErr(err)
+	}
+	if version < len(redisMigrations) {
+		return handleErr(fmt.Errorf("schema version %d, want %d, migrate first", version, len(redisMigrations)))
+	}
+	stats, err := r.compactIndexes(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	return stats, nil
+}
+
+func (r Redis) compactIndexes(ctx context.Context) (CompactStats, error) {
+	lists, err := r.indexLists(ctx)
+	if err != nil {
+		return CompactStats{}, err
+	}
+	var stats CompactStats
+	now := time.Now()
+	for _, key := range lists {
+		ids, err := r.client.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return CompactStats{}, err
+		}
+		seen := map[string]bool{}
+		uniq := ids[:0:0]
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				uniq = append(uniq, id)
+			}
+		}
+		channel := ""
+		if strings.HasPrefix(key, "channel:tracks:") {
+			channel = strings.TrimPrefix(key, "channel:tracks:")
+		}
+		const batch = 500
+		var members []goredis.Z
+		for start := 0; start < len(uniq); start += batch {
+			end := start + batch
+			if end > len(uniq) {
+				end = len(uniq)
+			}
+			trks, err := r.getTracks(ctx, uniq[start:end])
+			if err != nil {
+				return CompactStats{}, err
+			}
+			for _, trk := range trks {
+				first := firstSeen(trk)
+				for _, m := range trk.Channels {
+					if m.Channel == channel {
+						first = m.FirstSeen
+					}
+				}
+				if first.IsZero() {
+					first = now
+				}
+				members = append(members, goredis.Z{Score: float64(first.Unix()), Member: trk.ID})
+			}
+		}
+		cmds, err := r.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			_ = pipe.Del(ctx, key)
+			if len(members) > 0 {
+				_ = pipe.ZAdd(ctx, key, members...)
+			}
+			return nil
+		})
+		if err != nil {
+			return CompactStats{}, err
+		}
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return CompactStats{}, err
 			}
-			cursor = newCursor
 		}
+		stats.Lists++
+		stats.Tracks += len(members)
+		stats.Dropped += len(ids) - len(members)
 	}
+	return stats, nil
 }
@@ -1,12 +1,23 @@
 package repo
 
 import (
-	"accu/drivers/repo/proto"
+	"accu/drivers/repo/protos"
+	"accu/tracks"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v9"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestRedis(t *testing.T) {
-	m := proto.Track{
+	m := protos.Track{
 		Channel:       "chan",
 		Artist:        "artist",
 		Album:         "album",
@@ -18,3 +29,457 @@ func TestRedis(t *testing.T) {
 	}
 	t.Log(m.String())
 }
+
+// newTestClient connects to an in-memory redis that lives as long as the
+// test.
+func newTestClient(t *testing.T) *goredis.Client {
+	t.Helper()
+	client := goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newTestRedis(t *testing.T) (Redis, *goredis.Client) {
+	t.Helper()
+	client := newTestClient(t)
+	return NewRedis(client, log.Default()), client
+}
+
+func testTrack(channel string, i int) tracks.Track {
+	fn := fmt.Sprintf("%s-%04d", channel, i)
+	return tracks.Track{
+		ID:            fn,
+		Channel:       channel,
+		Artist:        fmt.Sprintf("Artist %d", i%7),
+		Album:         fmt.Sprintf("Album %d", i%3),
+		Title:         fmt.Sprintf("Title %d", i),
+		Year:          2000 + i%5,
+		Duration:      180,
+		PrimaryLink:   "http://primary/" + fn + ".m4a",
+		SecondaryLink: "http://secondary/" + fn + ".m4a",
+	}
+}
+
+// TestRedisGetAllTracks covers several SSCAN pages and an empty set, a
+// cursor that never reaches 0 would keep scanning until the deadline.
+func TestRedisGetAllTracks(t *testing.T) {
+	r, _ := newTestRedis(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	count := func() map[string]int {
+		seen := map[string]int{}
+		if err := r.GetAllTracks(ctx, func(_ context.Context, trk tracks.Track) error {
+			seen[trk.ID]++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return seen
+	}
+	if seen := count(); len(seen) != 0 {
+		t.Fatalf("got %d tracks from an empty repo", len(seen))
+	}
+	trks := make([]tracks.Track, 250)
+	for i := range trks {
+		trks[i] = testTrack("ch", i)
+	}
+	if err := r.SaveTracks(ctx, trks...); err != nil {
+		t.Fatal(err)
+	}
+	seen := count()
+	if len(seen) != len(trks) {
+		t.Fatalf("got %d tracks, want %d", len(seen), len(trks))
+	}
+	for _, trk := range trks {
+		if seen[trk.ID] != 1 {
+			t.Errorf("%s seen %d times", trk.ID, seen[trk.ID])
+		}
+	}
+}
+
+// TestRedisMigrateTrackIDRerun runs the migration again over the tracks it
+// saved, as after a crash before schema:version was bumped.
+func TestRedisMigrateTrackIDRerun(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	old := map[string]any{}
+	for i := 0; i < 3; i++ {
+		trk := testTrack("ch", i)
+		trk.ID = ""
+		raw, err := proto.Marshal(trackToMsg(trk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old[trk.PrimaryLink] = raw
+	}
+	for run := 0; run < 2; run++ {
+		if err := client.HSet(ctx, "tracks", old).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := migrateRedisTrackID(ctx, r); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		trk := testTrack("ch", i)
+		for _, key := range append(indexesOf(trk).artistScored, indexesOf(trk).year, channelTracksKey("ch")) {
+			if _, err := client.ZScore(ctx, key, trk.ID).Result(); err != nil {
+				t.Errorf("%s not in %s: %v", trk.ID, key, err)
+			}
+		}
+	}
+	if n, err := client.Exists(ctx, "tracks").Result(); err != nil || n != 0 {
+		t.Errorf("tracks hash left: %d %v", n, err)
+	}
+	// nothing to move, the indexes stay
+	if err := migrateRedisTrackID(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.ZCard(ctx, channelTracksKey("ch")).Result(); err != nil || n != 3 {
+		t.Errorf("channel index has %d tracks after a run without tracks: %v", n, err)
+	}
+}
+
+func TestRedisMigrateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- r.Migrate(ctx)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	version, err := client.Get(ctx, "schema:version").Int()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(redisMigrations) {
+		t.Errorf("schema version %d, want %d", version, len(redisMigrations))
+	}
+	if n, err := client.Exists(ctx, migrateLockKey).Result(); err != nil || n != 0 {
+		t.Errorf("migrate lock left: %d %v", n, err)
+	}
+}
+
+func TestRedisChannels(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	chs := []tracks.Channel{
+		{Name: "Jazz", DataId: "a1", OldId: "1", Description: "smooth", Image: "jazz.png"},
+		{Name: "Blues", DataId: "b2", OldId: "2", Description: "slow", Image: "blues.png"},
+	}
+	if err := r.SaveChannels(ctx, chs...); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.GetChannels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sorted by name, each with its own fields
+	want := []tracks.Channel{chs[1], chs[0]}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := client.Set(ctx, channelKey("c3"), "not a hash", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SAdd(ctx, channelsKey, "c3").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetChannels(ctx); err == nil {
+		t.Error("GetChannels read a channel that is not a hash")
+	}
+	if err := r.SaveChannels(ctx, tracks.Channel{Name: "C", DataId: "c3"}); err == nil {
+		t.Error("SaveChannels wrote over a key that is not a hash")
+	}
+}
+
+func TestRedisFindTracks(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	trks := []tracks.Track{
+		testTrack("ch", 0),
+		testTrack("ch", 1),
+		testTrack("other", 2),
+	}
+	trks[0].Artist, trks[0].Album, trks[0].Year = "Main", "Solo", 2001
+	trks[1].Artist, trks[1].Title, trks[1].Album, trks[1].Year = "Other", "Song (feat. Main)", "Duets", 2002
+	trks[2].Artist, trks[2].Album, trks[2].Year = "Main feat. Guest", "Duets", 2002
+	if err := r.SaveTracks(ctx, trks...); err != nil {
+		t.Fatal(err)
+	}
+	ids := func(trks []tracks.Track) []string {
+		ids := make([]string, len(trks))
+		for i, trk := range trks {
+			ids[i] = trk.ID
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	for _, tc := range []struct {
+		f    tracks.TrackFilter
+		want []string
+	}{
+		{tracks.TrackFilter{Artist: "Main"}, ids(trks)},
+		// featured credits are found by album and year too
+		{tracks.TrackFilter{Artist: "Main", Album: "Duets"}, ids(trks[1:])},
+		{tracks.TrackFilter{Artist: "Main", Year: 2002}, ids(trks[1:])},
+		{tracks.TrackFilter{Artist: "Guest", Album: "Duets"}, ids(trks[2:])},
+		{tracks.TrackFilter{Artist: "Other", Album: "Solo"}, []string{}},
+		{tracks.TrackFilter{Channel: "other"}, ids(trks[2:])},
+		{tracks.TrackFilter{Year: 2002}, ids(trks[1:])},
+		{tracks.TrackFilter{}, ids(trks)},
+	} {
+		got, err := r.FindTracks(ctx, tc.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.f, ids(got), tc.want)
+		}
+	}
+
+	if err := client.Set(ctx, "year:tracks:1999", "not a sorted set", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.FindTracks(ctx, tracks.TrackFilter{Year: 1999}); err == nil {
+		t.Error("FindTracks read an index that is not a sorted set")
+	}
+}
+
+// indexes returns the members of every sorted set index with their scores.
+func indexes(t *testing.T, client *goredis.Client) map[string][]goredis.Z {
+	t.Helper()
+	ctx := context.Background()
+	got := map[string][]goredis.Z{}
+	for _, pattern := range indexPatterns {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			zs, err := client.ZRangeWithScores(ctx, iter.Val(), 0, -1).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[iter.Val()] = zs
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return got
+}
+
+func TestRedisSaveTracksTwice(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	trk := testTrack("ch", 1)
+	trk.Title = "Song (feat. Guest)"
+	if err := r.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	before := indexes(t, client)
+	// the artist, album and year indexes of both credits, the channel and the year
+	if len(before) != 8 {
+		t.Errorf("got %d indexes, want 8: %v", len(before), before)
+	}
+	if err := r.SaveTracks(ctx, trk, trk); err != nil {
+		t.Fatal(err)
+	}
+	after := indexes(t, client)
+	for key, zs := range after {
+		if len(zs) != 1 || zs[0].Member != trk.ID {
+			t.Errorf("%s holds %v, want %s once", key, zs, trk.ID)
+		}
+	}
+	if fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("indexes changed from %v to %v", before, after)
+	}
+}
+
+func TestRedisSaveTrackRefresh(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	trk := testTrack("ch", 1)
+	if err := r.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	before := indexes(t, client)
+	read, err := client.HGet(ctx, tracksByIDKey, trk.ID).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := trk
+	moved.PrimaryLink = "http://moved/" + trk.ID + ".m4a"
+	moved.SecondaryLink = "http://moved2/" + trk.ID + ".m4a"
+	keys, args, err := saveTrackArgs(moved, read, tracks.Fence{}, time.Now().Unix()+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := saveTrackScript.Run(ctx, client, keys, args...).Int()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 2 {
+		t.Errorf("got %d, want 2 for a refresh", result)
+	}
+	if after := indexes(t, client); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("indexes changed from %v to %v", before, after)
+	}
+	links, err := client.HGetAll(ctx, trackLinksKey).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{moved.PrimaryLink: trk.ID, moved.SecondaryLink: trk.ID}
+	if fmt.Sprint(links) != fmt.Sprint(want) {
+		t.Errorf("links %v, want %v", links, want)
+	}
+	// the message read is stale now
+	if result, err := saveTrackScript.Run(ctx, client, keys, args...).Int(); err != nil || result != 0 {
+		t.Errorf("got %d %v, want 0 for a changed track", result, err)
+	}
+}
+
+func TestRedisSaveTracksFenced(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	if err := client.Set(ctx, FenceKey("ch"), 5, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	trk := testTrack("ch", 1)
+	stale := tracks.Fence{Channel: "ch", Token: 4}
+	keys, args, err := saveTrackArgs(trk, "", stale, time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := saveTrackScript.Run(ctx, client, keys, args...).Int(); err != nil || result != -1 {
+		t.Errorf("got %d %v, want -1 for a stale token", result, err)
+	}
+	err = r.SaveTracks(tracks.WithFence(ctx, stale), trk)
+	var fenced *tracks.FencedError
+	if !errors.As(err, &fenced) || *fenced != (tracks.FencedError{Channel: "ch", Token: 4}) {
+		t.Fatalf("got %v, want a FencedError", err)
+	}
+	if n, err := client.Exists(ctx, tracksByIDKey).Result(); err != nil || n != 0 {
+		t.Errorf("fenced save wrote tracks: %d %v", n, err)
+	}
+	if len(indexes(t, client)) != 0 {
+		t.Error("fenced save wrote indexes")
+	}
+	if err := r.SaveTracks(tracks.WithFence(ctx, tracks.Fence{Channel: "ch", Token: 5}), trk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisCompactIndexes(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	a, b := testTrack("ch", 1), testTrack("ch", 2)
+	a.Year, b.Year = 2001, 2002
+	if err := r.SaveTracks(ctx, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HSet(ctx, trackChannelsKey(a.ID), "ch:first", 100, "other:first", 50).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HSet(ctx, trackChannelsKey(b.ID), "ch:first", 200).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the lists written by older versions
+	lists := map[string][]any{
+		channelTracksKey("ch"): {b.ID, a.ID, b.ID, "unknown"},
+		"year:tracks:2001":     {a.ID, a.ID},
+	}
+	for key, ids := range lists {
+		if err := client.Del(ctx, key).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.RPush(ctx, key, ids...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Set(ctx, "schema:version", len(redisMigrations), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := r.CompactIndexes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (CompactStats{Lists: 2, Tracks: 3, Dropped: 3}) {
+		t.Errorf("got %+v", stats)
+	}
+	got := indexes(t, client)
+	for key, want := range map[string][]goredis.Z{
+		// first seen on the channel of the index
+		channelTracksKey("ch"): {{Score: 100, Member: a.ID}, {Score: 200, Member: b.ID}},
+		// first seen on any channel
+		"year:tracks:2001": {{Score: 50, Member: a.ID}},
+	} {
+		if fmt.Sprint(got[key]) != fmt.Sprint(want) {
+			t.Errorf("%s holds %v, want %v", key, got[key], want)
+		}
+	}
+	if lists, err := r.indexLists(ctx); err != nil || len(lists) != 0 {
+		t.Errorf("lists left: %v %v", lists, err)
+	}
+}
+
+// TestRedisMigrateSortedIndexes checks that Migrate compacts the index lists
+// written by the versions before the sorted sets on its own.
+func TestRedisMigrateSortedIndexes(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	trk := testTrack("ch", 1)
+	if err := r.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	key := channelTracksKey("ch")
+	if err := client.Del(ctx, key).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RPush(ctx, key, trk.ID, trk.ID).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the migrations up to migrateRedisSortedIndexes were applied
+	if err := client.Set(ctx, "schema:version", 4, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lists, err := r.indexLists(ctx); err != nil || len(lists) != 0 {
+		t.Errorf("lists left: %v %v", lists, err)
+	}
+	if n, err := client.ZCard(ctx, key).Result(); err != nil || n != 1 {
+		t.Errorf("channel index has %d tracks: %v", n, err)
+	}
+	if version, err := client.Get(ctx, "schema:version").Int(); err != nil || version != len(redisMigrations) {
+		t.Errorf("schema version %d, want %d: %v", version, len(redisMigrations), err)
+	}
+}
+
+// TestRedisCompactIndexesUnmigrated checks that the lists of a schema older
+// than the migrations are left to Migrate, they hold links instead of IDs.
+func TestRedisCompactIndexesUnmigrated(t *testing.T) {
+	ctx := context.Background()
+	r, client := newTestRedis(t)
+	key := channelTracksKey("ch")
+	if err := client.RPush(ctx, key, "http://primary/a.m4a").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []int{0, len(redisMigrations) - 1} {
+		if err := client.Set(ctx, "schema:version", version, 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.CompactIndexes(ctx); err == nil {
+			t.Errorf("compacted at schema version %d", version)
+		}
+		if n, err := client.LLen(ctx, key).Result(); err != nil || n != 1 {
+			t.Errorf("schema version %d: list holds %d entries: %v", version, n, err)
+		}
+	}
+}
@@ -5,9 +5,14 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"accu/tracks"
+	"accu/tracks/artists"
 )
 
 type Sqlite struct {
@@ -15,6 +20,12 @@ type Sqlite struct {
 	db *sql.DB
 }
 
+var (
+	_ tracks.Repo         = (*Sqlite)(nil)
+	_ tracks.CategoryRepo = (*Sqlite)(nil)
+	_ tracks.ArtistRepo   = (*Sqlite)(nil)
+)
+
 func NewSqlite(db *sql.DB) *Sqlite {
 	return &Sqlite{
 		db: db,
@@ -24,7 +35,7 @@ func NewSqlite(db *sql.DB) *Sqlite {
 func (s *Sqlite) Create() error {
 	defer s.lock()()
 	handleErr := func(err error) error {
-		return fmt.Errorf("create sqlite db: %w", err)
+		return fmt.Errorf("create sqlite db: %w", sqliteErr(err))
 	}
 	qs := [...]string{
 		`PRAGMA foreign_keys = 1`,
@@ -44,20 +55,242 @@ func (s *Sqlite) Create() error {
 			name TEXT NOT NULL,
 			data_id TEXT NOT NULL UNIQUE
 		)`,
+		`CREATE TABLE IF NOT EXISTS category (
+			id INTEGER PRIMARY KEY,
+			slug TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			parent TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS channel_category (
+			channel TEXT NOT NULL REFERENCES channel (data_id),
+			category TEXT NOT NULL REFERENCES category (slug),
+			PRIMARY KEY (channel, category)
+		)`,
 	}
 	for _, q := range qs {
 		if _, err := s.db.Exec(q); err != nil {
 			return handleErr(err)
 		}
 	}
+	if err := s.migrate(); err != nil {
+		return handleErr(err)
+	}
 	return nil
 
 }
 
+// migrations are applied in order on top of the schema created by Create,
+// PRAGMA user_version holds the number of migrations already applied.
+var migrations = [...]func(tx *sql.Tx) error{
+	execMigration(`ALTER TABLE channel ADD COLUMN enabled INTEGER NOT NULL DEFAULT 1`),
+	execMigration(`ALTER TABLE channel ADD COLUMN old_id TEXT NOT NULL DEFAULT ''`),
+	execMigration(`ALTER TABLE channel ADD COLUMN description TEXT NOT NULL DEFAULT ''`),
+	execMigration(`ALTER TABLE channel ADD COLUMN image TEXT NOT NULL DEFAULT ''`),
+	migrateTrackID,
+	execMigration(`CREATE TABLE duplicate_group (
+		id TEXT PRIMARY KEY,
+		preferred TEXT NOT NULL REFERENCES track (id),
+		reviewed INTEGER NOT NULL DEFAULT 0
+	)`),
+	execMigration(`CREATE TABLE duplicate_track (
+		track TEXT PRIMARY KEY REFERENCES track (id),
+		duplicate_group TEXT NOT NULL REFERENCES duplicate_group (id)
+	)`),
+	migrateArtists,
+	execMigration(`CREATE TABLE track_channel (
+		track TEXT NOT NULL REFERENCES track (id),
+		channel TEXT NOT NULL REFERENCES channel (data_id),
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (track, channel)
+	)`),
+	execMigration(`CREATE INDEX track_channel_channel ON track_channel (channel)`),
+	// the tracks saved so far were seen on their channel at least once, and
+	// on the channels of the rows migrateTrackID merged into them
+	execMigration(`CREATE TABLE IF NOT EXISTS track_merged_channel (
+		track TEXT NOT NULL,
+		channel TEXT NOT NULL
+	)`),
+	execMigration(`
+		INSERT INTO track_channel (track, channel, first_seen, last_seen)
+		SELECT id, channel, strftime('%s', 'now'), strftime('%s', 'now') FROM track
+		UNION
+		SELECT track, channel, strftime('%s', 'now'), strftime('%s', 'now') FROM track_merged_channel`),
+	execMigration(`DROP TABLE track_merged_channel`),
+}
+
+func execMigration(q string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(q)
+		return err
+	}
+}
+
+// migrateTrackID rebuilds the track table around the canonical track ID,
+// backfilled from the links. Rows of the same track saved under different
+// hosts collapse into the first one, the channels of the others are kept in
+// track_merged_channel for the memberships.
+func migrateTrackID(tx *sql.Tx) error {
+	if _, err := tx.Exec(`CREATE TABLE track_new (
+		id TEXT PRIMARY KEY,
+		channel TEXT NOT NULL REFERENCES channel (data_id),
+		artist TEXT NOT NULL,
+		album TEXT NOT NULL,
+		title TEXT NOT NULL,
+		duration INTEGER NOT NULL,
+		year TEXT NOT NULL,
+		primary_link TEXT NOT NULL,
+		secondary_link TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE track_merged_channel (
+		track TEXT NOT NULL,
+		channel TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`
+		SELECT
+			channel, artist, album,
+			title, duration, year,
+			primary_link, secondary_link
+		FROM track
+		ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var trks []tracks.Track
+	for rows.Next() {
+		var t tracks.Track
+		if err := rows.Scan(
+			&t.Channel, &t.Artist, &t.Album,
+			&t.Title, &t.Duration, &t.Year,
+			&t.PrimaryLink, &t.SecondaryLink,
+		); err != nil {
+			rows.Close()
+			return err
+		}
+		trks = append(trks, t)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	const q = `
+		INSERT INTO track_new (
+			id, channel, artist, album,
+			title, duration, year,
+			primary_link, secondary_link
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	channel := map[string]string{}
+	for _, t := range trks {
+		id := tracks.LinkTrackID(t.PrimaryLink, t.SecondaryLink)
+		if first, ok := channel[id]; ok {
+			if t.Channel != first {
+				if _, err := tx.Exec(`INSERT INTO track_merged_channel (track, channel) VALUES ($1, $2)`, id, t.Channel); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		channel[id] = t.Channel
+		if _, err := tx.Exec(q, id, t.Channel, t.Artist, t.Album, t.Title, t.Duration, t.Year, t.PrimaryLink, t.SecondaryLink); err != nil {
+			return err
+		}
+	}
+	for _, q := range [...]string{
+		`DROP TABLE track`,
+		`ALTER TABLE track_new RENAME TO track`,
+		`CREATE INDEX track_primary_link ON track (primary_link)`,
+		`CREATE INDEX track_secondary_link ON track (secondary_link)`,
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateArtists creates the artist tables and credits the saved tracks.
+func migrateArtists(tx *sql.Tx) error {
+	for _, q := range [...]string{
+		`CREATE TABLE artist (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL
+		)`,
+		`CREATE TABLE artist_alias (
+			alias TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			artist TEXT NOT NULL REFERENCES artist (id)
+		)`,
+		`CREATE TABLE track_artist (
+			track TEXT NOT NULL REFERENCES track (id),
+			artist TEXT NOT NULL REFERENCES artist (id),
+			featured INTEGER NOT NULL,
+			PRIMARY KEY (track, artist)
+		)`,
+		`CREATE INDEX track_artist_artist ON track_artist (artist)`,
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	rows, err := tx.Query(`SELECT id, artist, title FROM track`)
+	if err != nil {
+		return err
+	}
+	var trks []tracks.Track
+	for rows.Next() {
+		var t tracks.Track
+		if err := rows.Scan(&t.ID, &t.Artist, &t.Title); err != nil {
+			rows.Close()
+			return err
+		}
+		trks = append(trks, t)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, t := range trks {
+		if err := saveCredits(context.Background(), tx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sqlite) migrate() error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("migrate: %w", sqliteErr(err))
+	}
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return handleErr(err)
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := s.tx(func(tx *sql.Tx) error {
+			if err := migrations[i](tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+			return err
+		}); err != nil {
+			return handleErr(fmt.Errorf("migration %d: %w", i+1, err))
+		}
+	}
+	return nil
+}
+
 func (s *Sqlite) SaveTracks(ctx context.Context, trks ...tracks.Track) error {
 	defer s.lock()()
 	handleErr := func(err error) error {
-		return fmt.Errorf("sqlite: save tracks: %w", err)
+		return fmt.Errorf("sqlite: save tracks: %w", sqliteErr(err))
 	}
 	if err := s.tx(func(tx *sql.Tx) error {
 		ctx = context.WithValue(ctx, ctxTxKey, tx)
@@ -76,7 +309,7 @@ func (s *Sqlite) SaveTracks(ctx context.Context, trks ...tracks.Track) error {
 func (s *Sqlite) SaveChannels(ctx context.Context, chs ...tracks.Channel) error {
 	defer s.lock()()
 	handleErr := func(err error) error {
-		return fmt.Errorf("sqlite: save channels: %w", err)
+		return fmt.Errorf("sqlite: save channels: %w", sqliteErr(err))
 	}
 	if err := s.tx(func(tx *sql.Tx) error {
 		ctx = context.WithValue(ctx, ctxTxKey, tx)
@@ -95,9 +328,9 @@ func (s *Sqlite) SaveChannels(ctx context.Context, chs ...tracks.Channel) error
 func (s *Sqlite) GetChannels(ctx context.Context) ([]tracks.Channel, error) {
 	defer s.lock()()
 	handleErr := func(err error) ([]tracks.Channel, error) {
-		return nil, fmt.Errorf("sqlite: get channels: %w", err)
+		return nil, fmt.Errorf("sqlite: get channels: %w", sqliteErr(err))
 	}
-	const q = "SELECT c.name, c.data_id FROM channel c"
+	const q = "SELECT c.name, c.data_id, c.old_id, c.description, c.image FROM channel c ORDER BY c.name, c.data_id"
 	rows, err := s.db.QueryContext(ctx, q)
 	if err != nil {
 		return handleErr(err)
@@ -111,7 +344,7 @@ func (s *Sqlite) GetChannels(ctx context.Context) ([]tracks.Channel, error) {
 		default:
 		}
 		var c tracks.Channel
-		if err := rows.Scan(&c.Name, &c.DataId); err != nil {
+		if err := rows.Scan(&c.Name, &c.DataId, &c.OldId, &c.Description, &c.Image); err != nil {
 			return handleErr(err)
 		}
 		cc = append(cc, c)
@@ -122,23 +355,48 @@ func (s *Sqlite) GetChannels(ctx context.Context) ([]tracks.Channel, error) {
 	return cc, nil
 }
 
+// selectTracks reads the tracks with their memberships, scanned by
+// scanTrack.
+const selectTracks = `SELECT
+		t.id,
+		t.channel,
+		t.artist,
+		t.album,
+		t.title,
+		t.duration,
+		t.year,
+		t.primary_link,
+		t.secondary_link,
+		COALESCE((
+			SELECT GROUP_CONCAT(tc.channel || char(31) || tc.first_seen || char(31) || tc.last_seen, char(30))
+			FROM track_channel tc
+			WHERE tc.track = t.id
+		), '')
+	FROM track t`
+
+func scanTrack(rows *sql.Rows) (tracks.Track, error) {
+	var t tracks.Track
+	var memberships string
+	if err := rows.Scan(
+		&t.ID, &t.Channel, &t.Artist, &t.Album,
+		&t.Title, &t.Duration, &t.Year,
+		&t.PrimaryLink, &t.SecondaryLink, &memberships,
+	); err != nil {
+		return tracks.Track{}, err
+	}
+	var err error
+	if t.Channels, err = parseMemberships(memberships); err != nil {
+		return tracks.Track{}, err
+	}
+	return t, nil
+}
+
 func (s *Sqlite) GetAllTracks(ctx context.Context, run func(ctx context.Context, t tracks.Track) error) error {
 	defer s.rlock()()
 	handleErr := func(err error) error {
-		return fmt.Errorf("sqlite: get all tracks: %w", err)
-	}
-	const q = `SELECT
-			c.name,
-			t.artist,
-			t.album,
-			t.title,
-			t.duration,
-			t.year,
-			t.primary_link,
-			t.secondary_link
-		FROM track t
-		JOIN channel c ON c.data_id = t.channel`
-	rows, err := s.db.QueryContext(ctx, q)
+		return fmt.Errorf("sqlite: get all tracks: %w", sqliteErr(err))
+	}
+	rows, err := s.db.QueryContext(ctx, selectTracks)
 	if err != nil {
 		return handleErr(err)
 	}
@@ -149,12 +407,8 @@ func (s *Sqlite) GetAllTracks(ctx context.Context, run func(ctx context.Context,
 			return handleErr(ctx.Err())
 		default:
 		}
-		var t tracks.Track
-		if err := rows.Scan(
-			&t.Channel, &t.Artist, &t.Album,
-			&t.Title, &t.Duration, &t.Year,
-			&t.PrimaryLink, &t.SecondaryLink,
-		); err != nil {
+		t, err := scanTrack(rows)
+		if err != nil {
 			return handleErr(err)
 		}
 		if err := run(ctx, t); err != nil {
@@ -167,60 +421,626 @@ func (s *Sqlite) GetAllTracks(ctx context.Context, run func(ctx context.Context,
 	return nil
 }
 
+// FindTracks resolves the artist of f through the alias rules, so the tracks
+// of the aliases of an artist are found too.
+func (s *Sqlite) FindTracks(ctx context.Context, f tracks.TrackFilter) ([]tracks.Track, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.Track, error) {
+		return nil, fmt.Errorf("sqlite: find tracks: %w", sqliteErr(err))
+	}
+	const q = selectTracks + `
+		WHERE ($1 = '' OR EXISTS (
+				SELECT 1 FROM track_channel tc WHERE tc.track = t.id AND tc.channel = $1
+			))
+			AND ($2 = '' OR EXISTS (
+				SELECT 1 FROM track_artist ta
+				LEFT JOIN artist_alias al ON al.alias = ta.artist
+				WHERE ta.track = t.id
+					AND COALESCE(al.artist, ta.artist) = COALESCE((SELECT artist FROM artist_alias WHERE alias = $2), $2)
+			))
+			AND ($3 = '' OR t.album = $3)
+			AND ($4 = 0 OR t.year = $4)
+		ORDER BY (SELECT MIN(first_seen) FROM track_channel WHERE track = t.id) DESC, t.id
+		LIMIT $5`
+	limit := -1
+	if f.Limit > 0 {
+		limit = f.Limit
+	}
+	artist := ""
+	if f.Artist != "" {
+		if artist = artists.Key(f.Artist); artist == "" {
+			return handleErr(fmt.Errorf("empty artist %q", f.Artist))
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, q, f.Channel, artist, f.Album, f.Year, limit)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer rows.Close()
+	var trks []tracks.Track
+	for rows.Next() {
+		t, err := scanTrack(rows)
+		if err != nil {
+			return handleErr(err)
+		}
+		trks = append(trks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return handleErr(err)
+	}
+	return trks, nil
+}
+
 func (s *Sqlite) saveChannel(ctx context.Context, ch tracks.Channel) error {
 	handleErr := func(err error) error {
-		return fmt.Errorf("sqlite: save channel: %w", err)
+		return fmt.Errorf("sqlite: save channel: %w", sqliteErr(err))
+	}
+	const q = `
+		INSERT INTO channel (name, data_id, old_id, description, image) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (data_id) DO UPDATE SET
+			name = excluded.name,
+			old_id = excluded.old_id,
+			description = excluded.description,
+			image = excluded.image`
+	if _, err := s.getExecer(ctx).ExecContext(ctx, q, ch.Name, ch.DataId, ch.OldId, ch.Description, ch.Image); err != nil {
+		return handleErr(err)
+	}
+	for _, c := range ch.Categories {
+		if err := s.saveCategory(ctx, c); err != nil {
+			return handleErr(err)
+		}
+		const q = "INSERT INTO channel_category (channel, category) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+		if _, err := s.getExecer(ctx).ExecContext(ctx, q, ch.DataId, c.Slug); err != nil {
+			return handleErr(err)
+		}
+	}
+	return nil
+}
+
+func (s *Sqlite) SetChannelEnabled(ctx context.Context, dataId string, enabled bool) error {
+	defer s.lock()()
+	handleErr := func(err error) error {
+		return fmt.Errorf("sqlite: set channel enabled: %w", sqliteErr(err))
+	}
+	const q = "UPDATE channel SET enabled = $1 WHERE data_id = $2"
+	res, err := s.db.ExecContext(ctx, q, enabled, dataId)
+	if err != nil {
+		return handleErr(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return handleErr(err)
+	} else if n == 0 {
+		return handleErr(&tracks.NotFoundError{Entity: "channel", Key: dataId})
+	}
+	return nil
+}
+
+func (s *Sqlite) IsChannelEnabled(ctx context.Context, dataId string) (bool, error) {
+	defer s.rlock()()
+	handleErr := func(err error) (bool, error) {
+		return false, fmt.Errorf("sqlite: is channel enabled: %w", sqliteErr(err))
+	}
+	const q = "SELECT enabled FROM channel WHERE data_id = $1"
+	var enabled bool
+	if err := s.db.QueryRowContext(ctx, q, dataId).Scan(&enabled); errors.Is(err, sql.ErrNoRows) {
+		return handleErr(&tracks.NotFoundError{Entity: "channel", Key: dataId})
+	} else if err != nil {
+		return handleErr(err)
+	}
+	return enabled, nil
+}
+
+func (s *Sqlite) saveCategory(ctx context.Context, c tracks.Category) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("sqlite: save category: %w", sqliteErr(err))
 	}
-	const q = "INSERT INTO channel (name, data_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
-	if _, err := s.getExecer(ctx).ExecContext(ctx, q, ch.Name, ch.DataId); err != nil {
+	const q = `
+		INSERT INTO category (slug, name, parent) VALUES ($1, $2, $3)
+		ON CONFLICT (slug) DO UPDATE SET name = excluded.name,
+			parent = COALESCE(NULLIF(excluded.parent, ''), category.parent)`
+	if _, err := s.getExecer(ctx).ExecContext(ctx, q, c.Slug, c.Name, c.Parent); err != nil {
 		return handleErr(err)
 	}
 	return nil
 }
 
+func (s *Sqlite) GetCategories(ctx context.Context) ([]tracks.Category, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.Category, error) {
+		return nil, fmt.Errorf("sqlite: get categories: %w", sqliteErr(err))
+	}
+	const q = "SELECT slug, name, parent FROM category ORDER BY parent, slug"
+	cc, err := s.queryCategories(ctx, q)
+	if err != nil {
+		return handleErr(err)
+	}
+	return cc, nil
+}
+
+func (s *Sqlite) GetChannelCategories(ctx context.Context, dataId string) ([]tracks.Category, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.Category, error) {
+		return nil, fmt.Errorf("sqlite: get channel categories: %w", sqliteErr(err))
+	}
+	const q = `
+		SELECT c.slug, c.name, c.parent
+		FROM category c
+		JOIN channel_category cc ON cc.category = c.slug
+		WHERE cc.channel = $1
+		ORDER BY c.slug`
+	cc, err := s.queryCategories(ctx, q, dataId)
+	if err != nil {
+		return handleErr(err)
+	}
+	return cc, nil
+}
+
+func (s *Sqlite) queryCategories(ctx context.Context, q string, args ...any) ([]tracks.Category, error) {
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cc []tracks.Category
+	for rows.Next() {
+		var c tracks.Category
+		if err := rows.Scan(&c.Slug, &c.Name, &c.Parent); err != nil {
+			return nil, err
+		}
+		cc = append(cc, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+func (s *Sqlite) GetChannelsByCategory(ctx context.Context, slug string) ([]tracks.Channel, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.Channel, error) {
+		return nil, fmt.Errorf("sqlite: get channels by category: %w", sqliteErr(err))
+	}
+	const q = `
+		WITH RECURSIVE sub (slug) AS (
+			SELECT $1
+			UNION
+			SELECT c.slug FROM category c JOIN sub ON c.parent = sub.slug
+		)
+		SELECT DISTINCT ch.name, ch.data_id
+		FROM channel ch
+		JOIN channel_category cc ON cc.channel = ch.data_id
+		JOIN sub ON sub.slug = cc.category
+		ORDER BY ch.name`
+	rows, err := s.db.QueryContext(ctx, q, slug)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer rows.Close()
+	var cc []tracks.Channel
+	for rows.Next() {
+		var c tracks.Channel
+		if err := rows.Scan(&c.Name, &c.DataId); err != nil {
+			return handleErr(err)
+		}
+		cc = append(cc, c)
+	}
+	if err := rows.Err(); err != nil {
+		return handleErr(err)
+	}
+	return cc, nil
+}
+
 func (s *Sqlite) saveTrack(ctx context.Context, track tracks.Track) error {
 	handleErr := func(err error) error {
-		return fmt.Errorf("sqlite: save track: %w", err)
+		return fmt.Errorf("sqlite: save track: %w", sqliteErr(err))
 	}
+	// links are refreshed, everything else is kept as first seen
 	const q = `
 		INSERT INTO track (
-			channel, artist, album,
+			id, channel, artist, album,
 			title, duration, year,
 			primary_link, secondary_link
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		ON CONFLICT DO NOTHING`
-	if _, err := s.getExecer(ctx).ExecContext(ctx, q, track.Channel, track.Artist, track.Album, track.Title, track.Duration, track.Year, track.PrimaryLink, track.SecondaryLink); err != nil {
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			primary_link = excluded.primary_link,
+			secondary_link = excluded.secondary_link`
+	track = withID(track)
+	if _, err := s.getExecer(ctx).ExecContext(ctx, q, track.ID, track.Channel, track.Artist, track.Album, track.Title, track.Duration, track.Year, track.PrimaryLink, track.SecondaryLink); err != nil {
 		return handleErr(err)
 	}
+	if err := saveCredits(ctx, s.getExecer(ctx), track); err != nil {
+		return handleErr(err)
+	}
+	const qm = `
+		INSERT INTO track_channel (track, channel, first_seen, last_seen) VALUES ($1, $2, $3, $3)
+		ON CONFLICT (track, channel) DO UPDATE SET last_seen = excluded.last_seen`
+	if _, err := s.getExecer(ctx).ExecContext(ctx, qm, track.ID, track.Channel, time.Now().Unix()); err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+// parseMemberships reads the channel, first seen and last seen triples
+// concatenated by the track queries.
+func parseMemberships(s string) ([]tracks.Membership, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var mm []tracks.Membership
+	for _, raw := range strings.Split(s, "\x1e") {
+		fields := strings.Split(raw, "\x1f")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("bad membership %q", raw)
+		}
+		first, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		last, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		mm = append(mm, tracks.Membership{
+			Channel:   fields[0],
+			FirstSeen: time.Unix(first, 0),
+			LastSeen:  time.Unix(last, 0),
+		})
+	}
+	sortMemberships(mm)
+	return mm, nil
+}
+
+func sortMemberships(mm []tracks.Membership) {
+	sort.Slice(mm, func(i, j int) bool {
+		if !mm[i].FirstSeen.Equal(mm[j].FirstSeen) {
+			return mm[i].FirstSeen.Before(mm[j].FirstSeen)
+		}
+		return mm[i].Channel < mm[j].Channel
+	})
+}
+
+// saveCredits links the track to its main and featured artists, an artist
+// keeps the name it was first seen under.
+func saveCredits(ctx context.Context, e execer, t tracks.Track) error {
+	main, featured := artists.Credits(t.Artist, t.Title)
+	for i, name := range append([]string{main}, featured...) {
+		key := artists.Key(name)
+		if key == "" {
+			continue
+		}
+		if _, err := e.ExecContext(ctx, `INSERT INTO artist (id, name) VALUES ($1, $2) ON CONFLICT DO NOTHING`, key, name); err != nil {
+			return err
+		}
+		if _, err := e.ExecContext(ctx, `
+			INSERT INTO track_artist (track, artist, featured) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`, t.ID, key, i > 0); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// withID fills in the ID of tracks built without one from their links.
+func withID(t tracks.Track) tracks.Track {
+	if t.ID == "" {
+		t.ID = tracks.LinkTrackID(t.PrimaryLink, t.SecondaryLink)
+	}
+	return t
+}
+
 func (s *Sqlite) GetTrackByLink(ctx context.Context, link string) (tracks.Track, error) {
 	defer s.rlock()()
 	handleErr := func(err error) (tracks.Track, error) {
-		return tracks.Track{}, fmt.Errorf("sqlite: get track: %w", err)
+		return tracks.Track{}, fmt.Errorf("sqlite: get track: %w", sqliteErr(err))
 	}
 	const q = `
 		SELECT
-			channel, artist, album,
-			title, duration, year,
-			primary_link, secondary_link
-		FROM track
-		WHERE primary_link = $1
-		OR secondary_link = $1`
+			t.id, t.channel, t.artist, t.album,
+			t.title, t.duration, t.year,
+			t.primary_link, t.secondary_link,
+			COALESCE((
+				SELECT GROUP_CONCAT(tc.channel || char(31) || tc.first_seen || char(31) || tc.last_seen, char(30))
+				FROM track_channel tc
+				WHERE tc.track = t.id
+			), '')
+		FROM track t
+		WHERE t.primary_link = $1
+		OR t.secondary_link = $1`
 	var t tracks.Track
+	var memberships string
 	if err := s.db.QueryRowContext(ctx, q, link).Scan(
-		&t.Channel, &t.Artist, &t.Album,
+		&t.ID, &t.Channel, &t.Artist, &t.Album,
 		&t.Title, &t.Duration, &t.Year,
-		&t.PrimaryLink, &t.SecondaryLink,
+		&t.PrimaryLink, &t.SecondaryLink, &memberships,
 	); errors.Is(err, sql.ErrNoRows) {
-		return handleErr(tracks.ErrNotFound)
+		return handleErr(&tracks.NotFoundError{Entity: "track", Key: link})
 	} else if err != nil {
 		return handleErr(err)
 	}
+	var err error
+	if t.Channels, err = parseMemberships(memberships); err != nil {
+		return handleErr(err)
+	}
 	return t, nil
 }
 
+// unknownIDsChunk keeps the IN lists below SQLITE_MAX_VARIABLE_NUMBER.
+const unknownIDsChunk = 800
+
+func (s *Sqlite) UnknownIDs(ctx context.Context, channel string, ids ...string) ([]string, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]string, error) {
+		return nil, fmt.Errorf("sqlite: unknown ids: %w", sqliteErr(err))
+	}
+	known := make(map[string]struct{}, len(ids))
+	for start := 0; start < len(ids); start += unknownIDsChunk {
+		end := start + unknownIDsChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+		args := make([]any, 0, len(chunk)+1)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		in := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		q := fmt.Sprintf(`SELECT id FROM track WHERE id IN (%s)`, in)
+		if channel != "" {
+			q = fmt.Sprintf(`SELECT track FROM track_channel WHERE track IN (%s) AND channel = ?`, in)
+			args = append(args, channel)
+		}
+		rows, err := s.db.QueryContext(ctx, q, args...)
+		if err != nil {
+			return handleErr(err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return handleErr(err)
+			}
+			known[id] = struct{}{}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return handleErr(err)
+		}
+	}
+	unknown := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := known[id]; !ok {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown, nil
+}
+
+func (s *Sqlite) GetDuplicateGroups(ctx context.Context) ([]tracks.DuplicateGroup, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.DuplicateGroup, error) {
+		return nil, fmt.Errorf("sqlite: get duplicate groups: %w", sqliteErr(err))
+	}
+	const q = `
+		SELECT g.id, g.preferred, g.reviewed, t.track
+		FROM duplicate_group g
+		JOIN duplicate_track t ON t.duplicate_group = g.id
+		ORDER BY g.id, t.track`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer rows.Close()
+	var groups []tracks.DuplicateGroup
+	for rows.Next() {
+		var g tracks.DuplicateGroup
+		var track string
+		if err := rows.Scan(&g.ID, &g.Preferred, &g.Reviewed, &track); err != nil {
+			return handleErr(err)
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ID != g.ID {
+			groups = append(groups, g)
+		}
+		last := &groups[len(groups)-1]
+		last.TrackIDs = append(last.TrackIDs, track)
+	}
+	if err := rows.Err(); err != nil {
+		return handleErr(err)
+	}
+	return groups, nil
+}
+
+func (s *Sqlite) ReplaceDuplicateGroups(ctx context.Context, groups ...tracks.DuplicateGroup) error {
+	defer s.lock()()
+	handleErr := func(err error) error {
+		return fmt.Errorf("sqlite: replace duplicate groups: %w", sqliteErr(err))
+	}
+	if err := s.tx(func(tx *sql.Tx) error {
+		for _, q := range [...]string{`DELETE FROM duplicate_track`, `DELETE FROM duplicate_group`} {
+			if _, err := tx.ExecContext(ctx, q); err != nil {
+				return err
+			}
+		}
+		for _, g := range groups {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO duplicate_group (id, preferred, reviewed) VALUES ($1, $2, $3)`, g.ID, g.Preferred, g.Reviewed); err != nil {
+				return err
+			}
+			for _, id := range g.TrackIDs {
+				if _, err := tx.ExecContext(ctx, `INSERT INTO duplicate_track (track, duplicate_group) VALUES ($1, $2)`, id, g.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+func (s *Sqlite) GetArtists(ctx context.Context) ([]tracks.Artist, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.Artist, error) {
+		return nil, fmt.Errorf("sqlite: get artists: %w", sqliteErr(err))
+	}
+	const q = `
+		SELECT a.id, a.name, COALESCE(al.name, '')
+		FROM artist a
+		LEFT JOIN artist_alias al ON al.artist = a.id
+		WHERE a.id NOT IN (SELECT alias FROM artist_alias)
+		ORDER BY a.id, al.name`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer rows.Close()
+	var aa []tracks.Artist
+	for rows.Next() {
+		var a tracks.Artist
+		var alias string
+		if err := rows.Scan(&a.ID, &a.Name, &alias); err != nil {
+			return handleErr(err)
+		}
+		if len(aa) == 0 || aa[len(aa)-1].ID != a.ID {
+			aa = append(aa, a)
+		}
+		if alias != "" {
+			last := &aa[len(aa)-1]
+			last.Aliases = append(last.Aliases, alias)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return handleErr(err)
+	}
+	return aa, nil
+}
+
+func (s *Sqlite) GetAliasRules(ctx context.Context) ([]tracks.AliasRule, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.AliasRule, error) {
+		return nil, fmt.Errorf("sqlite: get alias rules: %w", sqliteErr(err))
+	}
+	const q = `
+		SELECT al.name, a.name
+		FROM artist_alias al
+		JOIN artist a ON a.id = al.artist
+		ORDER BY al.alias`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer rows.Close()
+	var rules []tracks.AliasRule
+	for rows.Next() {
+		var r tracks.AliasRule
+		if err := rows.Scan(&r.Alias, &r.Artist); err != nil {
+			return handleErr(err)
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return handleErr(err)
+	}
+	return rules, nil
+}
+
+// SaveAliasRule names the canonical artist after rule.Artist. Rules never
+// chain: an alias of an alias points to the final artist, and the aliases
+// of rule.Alias move along to rule.Artist.
+func (s *Sqlite) SaveAliasRule(ctx context.Context, rule tracks.AliasRule) error {
+	defer s.lock()()
+	handleErr := func(err error) error {
+		return fmt.Errorf("sqlite: save alias rule: %w", sqliteErr(err))
+	}
+	alias, artist := artists.Key(rule.Alias), artists.Key(rule.Artist)
+	if alias == "" || artist == "" {
+		return handleErr(fmt.Errorf("empty artist in alias rule %q -> %q", rule.Alias, rule.Artist))
+	}
+	if err := s.tx(func(tx *sql.Tx) error {
+		// the name of rule.Artist names the artist unless it is an alias itself
+		name := `ON CONFLICT (id) DO UPDATE SET name = excluded.name`
+		if err := tx.QueryRowContext(ctx, `SELECT artist FROM artist_alias WHERE alias = $1`, artist).Scan(&artist); err == nil {
+			name = `ON CONFLICT DO NOTHING`
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if alias == artist {
+			return fmt.Errorf("alias rule %q -> %q is a cycle", rule.Alias, rule.Artist)
+		}
+		for _, q := range [...]struct {
+			q    string
+			args []any
+		}{
+			{`INSERT INTO artist (id, name) VALUES ($1, $2) ` + name, []any{artist, artists.Name(rule.Artist)}},
+			{`INSERT INTO artist (id, name) VALUES ($1, $2) ON CONFLICT DO NOTHING`, []any{alias, artists.Name(rule.Alias)}},
+			{`UPDATE artist_alias SET artist = $1 WHERE artist = $2`, []any{artist, alias}},
+			{`INSERT INTO artist_alias (alias, name, artist) VALUES ($1, $2, $3)
+				ON CONFLICT (alias) DO UPDATE SET name = excluded.name, artist = excluded.artist`, []any{alias, artists.Name(rule.Alias), artist}},
+		} {
+			if _, err := tx.ExecContext(ctx, q.q, q.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return handleErr(err)
+	}
+	return nil
+}
+
+func (s *Sqlite) DeleteAliasRule(ctx context.Context, alias string) error {
+	defer s.lock()()
+	handleErr := func(err error) error {
+		return fmt.Errorf("sqlite: delete alias rule: %w", sqliteErr(err))
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM artist_alias WHERE alias = $1`, artists.Key(alias))
+	if err != nil {
+		return handleErr(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return handleErr(err)
+	} else if n == 0 {
+		return handleErr(&tracks.NotFoundError{Entity: "alias rule", Key: alias})
+	}
+	return nil
+}
+
+func (s *Sqlite) TopArtists(ctx context.Context, channel string, limit int) ([]tracks.ArtistCount, error) {
+	defer s.rlock()()
+	handleErr := func(err error) ([]tracks.ArtistCount, error) {
+		return nil, fmt.Errorf("sqlite: top artists: %w", sqliteErr(err))
+	}
+	const q = `
+		SELECT a.id, a.name,
+			COUNT(DISTINCT CASE WHEN NOT ta.featured THEN ta.track END) AS tracks,
+			COUNT(DISTINCT CASE WHEN ta.featured THEN ta.track END) AS featured
+		FROM track_artist ta
+		JOIN track_channel tc ON tc.track = ta.track
+		LEFT JOIN artist_alias al ON al.alias = ta.artist
+		JOIN artist a ON a.id = COALESCE(al.artist, ta.artist)
+		WHERE tc.channel = $1
+		GROUP BY a.id
+		ORDER BY tracks + featured DESC, tracks DESC, a.id
+		LIMIT $2`
+	rows, err := s.db.QueryContext(ctx, q, channel, limit)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer rows.Close()
+	var top []tracks.ArtistCount
+	for rows.Next() {
+		var c tracks.ArtistCount
+		if err := rows.Scan(&c.Artist.ID, &c.Artist.Name, &c.Tracks, &c.Featured); err != nil {
+			return handleErr(err)
+		}
+		top = append(top, c)
+	}
+	if err := rows.Err(); err != nil {
+		return handleErr(err)
+	}
+	return top, nil
+}
+
 func (s *Sqlite) rlock() func() {
 	s.RLock()
 	return func() {
@@ -237,7 +1057,7 @@ func (s *Sqlite) lock() func() {
 
 func (s *Sqlite) tx(run func(tx *sql.Tx) error) error {
 	handleErr := func(err error) error {
-		return fmt.Errorf("sqlite tx: %w", err)
+		return fmt.Errorf("sqlite tx: %w", sqliteErr(err))
 	}
 	tx, err := s.db.Begin()
 	if err != nil {
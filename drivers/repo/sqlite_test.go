@@ -0,0 +1,498 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"accu/tracks"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestSqlite(t *testing.T) *Sqlite {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&cache=shared", filepath.Join(t.TempDir(), "test.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := NewSqlite(db)
+	if err := s.Create(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSqliteUnknownIDs(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "chan", DataId: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	var trks []tracks.Track
+	for i := 0; i < 2*unknownIDsChunk+10; i++ {
+		id := fmt.Sprintf("t%d", i)
+		ids = append(ids, id)
+		if i%2 == 0 {
+			trks = append(trks, tracks.Track{ID: id, Channel: "c1", PrimaryLink: "p/" + id, SecondaryLink: "s/" + id})
+		}
+	}
+	if err := s.SaveTracks(ctx, trks...); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := s.UnknownIDs(ctx, "", ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != len(ids)-len(trks) {
+		t.Fatalf("got %d unknown ids, want %d", len(unknown), len(ids)-len(trks))
+	}
+	for i, id := range unknown {
+		if want := fmt.Sprintf("t%d", 2*i+1); id != want {
+			t.Fatalf("unknown[%d] = %s, want %s", i, id, want)
+		}
+	}
+}
+
+func TestSqliteMovedLinks(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "chan", DataId: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	trk := tracks.Track{
+		ID:            "abc",
+		Channel:       "c1",
+		Title:         "first",
+		PrimaryLink:   "https://a.example/audio/abc.m4a",
+		SecondaryLink: "https://b.example/audio/abc.m4a",
+	}
+	if err := s.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	trk.Title = "second"
+	trk.PrimaryLink = "https://c.example/v2/abc.m4a"
+	if err := s.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetTrackByLink(ctx, "https://a.example/audio/abc.m4a"); !errors.Is(err, tracks.ErrNotFound) {
+		t.Errorf("got %v, want %v", err, tracks.ErrNotFound)
+	}
+	got, err := s.GetTrackByLink(ctx, "https://c.example/v2/abc.m4a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "abc" || got.Title != "first" {
+		t.Errorf("got %+v, want the first title under the new link", got)
+	}
+}
+
+func TestSqliteMigrateTrackID(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&cache=shared", filepath.Join(t.TempDir(), "test.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, q := range []string{
+		`CREATE TABLE channel (
+			id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			data_id TEXT NOT NULL UNIQUE
+		)`,
+		`INSERT INTO channel VALUES (1, 'chan', 'c1'), (2, 'other chan', 'c2')`,
+		`CREATE TABLE track (
+			id INTEGER PRIMARY KEY,
+			channel TEXT NOT NULL REFERENCES channel (data_id),
+			artist TEXT NOT NULL,
+			album TEXT NOT NULL,
+			title TEXT NOT NULL,
+			duration INTEGER NOT NULL,
+			year TEXT NOT NULL,
+			primary_link TEXT NOT NULL UNIQUE,
+			secondary_link TEXT NOT NULL UNIQUE
+		)`,
+		`INSERT INTO track VALUES
+			(1, 'c1', 'a', 'b', 'old cdn', 1, '2020', 'https://old.example/x/abc.m4a', 'https://old2.example/x/abc.m4a'),
+			(2, 'c1', 'a', 'b', 'new cdn', 1, '2020', 'https://new.example/y/abc.m4a', 'https://new2.example/y/abc.m4a'),
+			(3, 'c1', 'a', 'b', 'other', 1, '2020', 'https://old.example/x/def.m4a', 'https://old2.example/x/def.m4a'),
+			(4, 'c2', 'a', 'b', 'moved', 1, '2020', 'https://new.example/x/abc.m4a', 'https://new2.example/x/abc.m4a')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewSqlite(db)
+	if err := s.Create(); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	if err := s.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		got[t.ID] = t.Title
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "map[x/abc:old cdn x/def:other y/abc:new cdn]" {
+		t.Errorf("got %v", got)
+	}
+	// the row of another host merged into the first, its channel kept
+	merged, err := s.GetTrackByLink(ctx, "https://old.example/x/abc.m4a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chans []string
+	for _, m := range merged.Channels {
+		chans = append(chans, m.Channel)
+	}
+	if fmt.Sprint(chans) != "[c1 c2]" {
+		t.Errorf("merged track on %v, want [c1 c2]", chans)
+	}
+	top, err := s.TopArtists(ctx, "c1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(top) != "[{{a a []} 3 0}]" {
+		t.Errorf("top artists %v", top)
+	}
+}
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "chan", DataId: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveTracks(ctx, tracks.Track{ID: "t0", Channel: "c1", PrimaryLink: "p0", SecondaryLink: "s0"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCached(ctx, s, CachedCfg{ExpectedTracks: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(want []string, ids ...string) {
+		t.Helper()
+		got, err := c.UnknownIDs(ctx, "", ids...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("unknown ids %v, want %v", got, want)
+		}
+	}
+	check([]string{"t1", "t2"}, "t0", "t1", "t2")
+	check([]string{"t1", "t2"}, "t0", "t1", "t2")
+	if err := c.SaveTracks(ctx, tracks.Track{ID: "t1", Channel: "c1", PrimaryLink: "p1", SecondaryLink: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"t2"}, "t0", "t1", "t2")
+	st := c.Stats()
+	if st.Lookups != 9 || st.BloomMisses != 5 || st.LRUHits != 3 || st.StoreLookups != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestSqliteDuplicateGroups(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "chan", DataId: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := s.SaveTracks(ctx, tracks.Track{ID: id, Channel: "c1", PrimaryLink: "p/" + id, SecondaryLink: "s/" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups := []tracks.DuplicateGroup{
+		{ID: "a", TrackIDs: []string{"a", "b"}, Preferred: "b"},
+		{ID: "c", TrackIDs: []string{"c", "d"}, Preferred: "c", Reviewed: true},
+	}
+	if err := s.ReplaceDuplicateGroups(ctx, groups...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReplaceDuplicateGroups(ctx, groups[1:]...); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetDuplicateGroups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(groups[1:]) {
+		t.Errorf("got %v, want %v", got, groups[1:])
+	}
+	if err := s.ReplaceDuplicateGroups(ctx, tracks.DuplicateGroup{ID: "x", TrackIDs: []string{"x"}, Preferred: "x"}); err == nil {
+		t.Error("saved a group of an unknown track")
+	}
+}
+
+func TestSqliteArtists(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "chan", DataId: "c1"}, tracks.Channel{Name: "other", DataId: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	trks := []tracks.Track{
+		{ID: "1", Channel: "c1", Artist: "The National", Title: "Bloodbuzz Ohio"},
+		{ID: "2", Channel: "c1", Artist: "National, The", Title: "Fake Empire"},
+		{ID: "3", Channel: "c1", Artist: "The National feat. Taylor Swift", Title: "Gold Rush"},
+		{ID: "4", Channel: "c1", Artist: "Taylor Swift", Title: "Coney Island (feat. The National)"},
+		{ID: "5", Channel: "c1", Artist: "T. Swift", Title: "Willow"},
+		{ID: "6", Channel: "c2", Artist: "The National", Title: "Graceless"},
+	}
+	for i := range trks {
+		trks[i].PrimaryLink, trks[i].SecondaryLink = "p/"+trks[i].ID, "s/"+trks[i].ID
+	}
+	if err := s.SaveTracks(ctx, trks...); err != nil {
+		t.Fatal(err)
+	}
+	top := func() string {
+		t.Helper()
+		top, err := s.TopArtists(ctx, "c1", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(top)
+	}
+	if got := top(); got != "[{{national The National []} 3 1} {{taylor swift Taylor Swift []} 1 1} {{t swift T. Swift []} 1 0}]" {
+		t.Errorf("got %s", got)
+	}
+	if err := s.SaveAliasRule(ctx, tracks.AliasRule{Alias: "T. Swift", Artist: "Taylor Swift"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := top(); got != "[{{national The National []} 3 1} {{taylor swift Taylor Swift []} 2 1}]" {
+		t.Errorf("got %s", got)
+	}
+	if err := s.SaveAliasRule(ctx, tracks.AliasRule{Alias: "Swift, Taylor", Artist: "T. Swift"}); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := s.GetAliasRules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rules); got != "[{Swift, Taylor Taylor Swift} {T. Swift Taylor Swift}]" {
+		t.Errorf("got %s", got)
+	}
+	aa, err := s.GetArtists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(aa); got != "[{national The National []} {taylor swift Taylor Swift [Swift, Taylor T. Swift]}]" {
+		t.Errorf("got %s", got)
+	}
+	if err := s.DeleteAliasRule(ctx, "t swift"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteAliasRule(ctx, "t swift"); !errors.Is(err, tracks.ErrNotFound) {
+		t.Errorf("got %v, want %v", err, tracks.ErrNotFound)
+	}
+	if err := s.SaveAliasRule(ctx, tracks.AliasRule{Alias: "Taylor Swift", Artist: "Swift, Taylor"}); err == nil {
+		t.Error("saved a cycle")
+	}
+}
+
+func TestSqliteMemberships(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "first", DataId: "c1"}, tracks.Channel{Name: "second", DataId: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	trk := tracks.Track{ID: "a", Channel: "c1", Artist: "Artist", PrimaryLink: "p/a", SecondaryLink: "s/a"}
+	if err := s.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := s.UnknownIDs(ctx, "c2", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(unknown) != "[a]" {
+		t.Errorf("unknown on c2 %v, want [a]", unknown)
+	}
+	trk.Channel = "c2"
+	if err := s.SaveTracks(ctx, trk); err != nil {
+		t.Fatal(err)
+	}
+	if unknown, err = s.UnknownIDs(ctx, "c2", "a"); err != nil {
+		t.Fatal(err)
+	} else if len(unknown) != 0 {
+		t.Errorf("unknown on c2 %v, want none", unknown)
+	}
+	var got []tracks.Track
+	if err := s.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		got = append(got, t)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Channel != "c1" || len(got[0].Channels) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	for _, m := range got[0].Channels {
+		if m.FirstSeen.IsZero() || m.LastSeen.Before(m.FirstSeen) {
+			t.Errorf("membership %+v", m)
+		}
+	}
+	byLink, err := s.GetTrackByLink(ctx, "p/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both reads name the channels by data id
+	if !reflect.DeepEqual(byLink, got[0]) {
+		t.Errorf("by link got %+v, want %+v", byLink, got[0])
+	}
+	top, err := s.TopArtists(ctx, "c2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(top) != "[{{artist Artist []} 1 0}]" {
+		t.Errorf("top artists on c2 %v", top)
+	}
+}
+
+func TestSqliteFindTracks(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "second", DataId: "c2"}, tracks.Channel{Name: "first", DataId: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	chs, err := s.GetChannels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 2 || chs[0].DataId != "c1" || chs[1].DataId != "c2" {
+		t.Errorf("channels %+v", chs)
+	}
+	if err := s.SaveTracks(ctx,
+		tracks.Track{ID: "a", Channel: "c1", Artist: "Daft Punk", Album: "Discovery", Title: "One More Time", Year: 2001, PrimaryLink: "p/a"},
+		tracks.Track{ID: "b", Channel: "c1", Artist: "Daft Punk feat. Pharrell Williams", Album: "RAM", Title: "Get Lucky", Year: 2013, PrimaryLink: "p/b"},
+		tracks.Track{ID: "c", Channel: "c2", Artist: "Pharrell", Album: "Girl", Title: "Happy", Year: 2013, PrimaryLink: "p/c"},
+		tracks.Track{ID: "d", Channel: "c2", Artist: "Muse", Album: "Drones", Title: "Dead Inside", Year: 2015, PrimaryLink: "p/d"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveAliasRule(ctx, tracks.AliasRule{Alias: "Pharrell", Artist: "Pharrell Williams"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		f    tracks.TrackFilter
+		want string
+	}{
+		{tracks.TrackFilter{}, "[a b c d]"},
+		{tracks.TrackFilter{Limit: 2}, "[a b]"},
+		{tracks.TrackFilter{Channel: "c2"}, "[c d]"},
+		{tracks.TrackFilter{Artist: "daft punk"}, "[a b]"},
+		{tracks.TrackFilter{Artist: "Pharrell Williams"}, "[b c]"},
+		{tracks.TrackFilter{Artist: "Pharrell", Channel: "c2"}, "[c]"},
+		{tracks.TrackFilter{Artist: "Daft Punk", Album: "RAM"}, "[b]"},
+		{tracks.TrackFilter{Year: 2013}, "[b c]"},
+		{tracks.TrackFilter{Artist: "Nobody"}, "[]"},
+	} {
+		trks, err := s.FindTracks(ctx, c.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(trks))
+		for i, trk := range trks {
+			ids[i] = trk.ID
+		}
+		if got := fmt.Sprint(ids); got != c.want {
+			t.Errorf("%+v: got %s, want %s", c.f, got, c.want)
+		}
+	}
+}
+
+func TestSqliteChannelsByCategory(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	jazz := tracks.Category{Slug: "jazz", Name: "Jazz"}
+	smooth := tracks.Category{Slug: "smooth-jazz", Name: "Smooth Jazz", Parent: "jazz"}
+	if err := s.SaveChannels(ctx,
+		tracks.Channel{Name: "Big Band", DataId: "c1", Categories: []tracks.Category{jazz}},
+		tracks.Channel{Name: "Late Night", DataId: "c2", Categories: []tracks.Category{smooth, jazz}},
+		tracks.Channel{Name: "Indie", DataId: "c3", Categories: []tracks.Category{{Slug: "indie", Name: "Indie"}}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	// the smooth jazz page crawled on its own has no parent
+	orphan := tracks.Category{Slug: "smooth-jazz", Name: "Smooth Jazz"}
+	if err := s.SaveChannels(ctx, tracks.Channel{Name: "Quiet Storm", DataId: "c4", Categories: []tracks.Category{orphan}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		slug string
+		want string
+	}{
+		{"jazz", "[Big Band Late Night Quiet Storm]"},
+		{"smooth-jazz", "[Late Night Quiet Storm]"},
+		{"indie", "[Indie]"},
+		{"rock", "[]"},
+	} {
+		chs, err := s.GetChannelsByCategory(ctx, tc.slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(chs))
+		for _, ch := range chs {
+			names = append(names, ch.Name)
+		}
+		if got := fmt.Sprint(names); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.slug, got, tc.want)
+		}
+	}
+	cc, err := s.GetChannelCategories(ctx, "c4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc) != 1 || cc[0] != smooth {
+		t.Errorf("c4 categories %+v, want %+v", cc, smooth)
+	}
+}
+
+func TestSqliteSetChannelEnabled(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlite(t)
+	ch := tracks.Channel{Name: "first", DataId: "c1"}
+	if err := s.SaveChannels(ctx, ch); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		set     func() error
+		dataId  string
+		want    bool
+		wantErr bool
+	}{
+		{"saved channels are enabled", nil, "c1", true, false},
+		{"disable", func() error { return s.SetChannelEnabled(ctx, "c1", false) }, "c1", false, false},
+		{"disable again", func() error { return s.SetChannelEnabled(ctx, "c1", false) }, "c1", false, false},
+		{"saving again keeps it disabled", func() error { return s.SaveChannels(ctx, ch) }, "c1", false, false},
+		{"enable", func() error { return s.SetChannelEnabled(ctx, "c1", true) }, "c1", true, false},
+		{"unknown channel", func() error { return s.SetChannelEnabled(ctx, "c2", false) }, "c2", false, true},
+	} {
+		if tc.set != nil {
+			err := tc.set()
+			var nf *tracks.NotFoundError
+			if tc.wantErr != errors.As(err, &nf) || !tc.wantErr && err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+		enabled, err := s.IsChannelEnabled(ctx, tc.dataId)
+		if tc.wantErr {
+			if !tracks.IsPermanent(err) {
+				t.Errorf("%s: is enabled %v, want not found", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enabled != tc.want {
+			t.Errorf("%s: enabled %v, want %v", tc.name, enabled, tc.want)
+		}
+	}
+}
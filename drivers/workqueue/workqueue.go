@@ -0,0 +1,356 @@
+// Package workqueue hands the tracks to download out to several downloaders
+// through a Redis stream read by a consumer group.
+package workqueue
+
+import (
+	"accu/tracks"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v9"
+)
+
+type Cfg struct {
+	Stream string
+	Group  string
+	// DeadLetter is the stream of the deliveries that were handed out
+	// MaxDeliveries times without being acked.
+	DeadLetter string
+	// ClaimAfter is how long a delivery stays pending before any consumer
+	// may claim it, it should be longer than the slowest download.
+	ClaimAfter    time.Duration
+	MaxDeliveries int
+	// Block is how long Receive waits for new entries.
+	Block time.Duration
+	// FenceKey names the key of the newest fencing token of a channel lease.
+	// When set, publishing under a stale token fails with a
+	// tracks.FencedError and adds nothing.
+	FenceKey func(channel string) string
+}
+
+var DefaultCfg = Cfg{
+	Stream:        "queue:tracks",
+	Group:         "downloaders",
+	DeadLetter:    "queue:tracks:dead",
+	ClaimAfter:    10 * time.Minute,
+	MaxDeliveries: 5,
+	Block:         5 * time.Second,
+}
+
+func (c Cfg) withDefaults() Cfg {
+	if c.Stream == "" {
+		c.Stream = DefaultCfg.Stream
+	}
+	if c.Group == "" {
+		c.Group = DefaultCfg.Group
+	}
+	if c.DeadLetter == "" {
+		c.DeadLetter = DefaultCfg.DeadLetter
+	}
+	if c.ClaimAfter == 0 {
+		c.ClaimAfter = DefaultCfg.ClaimAfter
+	}
+	if c.MaxDeliveries == 0 {
+		c.MaxDeliveries = DefaultCfg.MaxDeliveries
+	}
+	if c.Block == 0 {
+		c.Block = DefaultCfg.Block
+	}
+	return c
+}
+
+// Streams is a tracks.TrackQueue. Entries hold the track as JSON, acked
+// entries are deleted from the stream. Dead lettered entries keep the track,
+// the reason and the number of deliveries.
+type Streams struct {
+	client *goredis.Client
+	cfg    Cfg
+	claim  *claimCursor
+}
+
+// claimCursor is where the next XAUTOCLAIM resumes the scan of the pending
+// entries, it is back to 0-0 once the scan reached their end.
+type claimCursor struct {
+	sync.Mutex
+	next string
+}
+
+func (c *claimCursor) get() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.next
+}
+
+func (c *claimCursor) set(next string) {
+	c.Lock()
+	defer c.Unlock()
+	c.next = next
+}
+
+// New creates the consumer group unless it exists. The group reads the
+// stream from its start, so the tracks published before the first
+// downloader came up are delivered too.
+func New(ctx context.Context, client *goredis.Client, cfg Cfg) (Streams, error) {
+	cfg = cfg.withDefaults()
+	err := client.XGroupCreateMkStream(ctx, cfg.Stream, cfg.Group, "0").Err()
+	if err != nil && !goredis.HasErrorPrefix(err, "BUSYGROUP") {
+		return Streams{}, fmt.Errorf("workqueue: new: %w", err)
+	}
+	return Streams{
+		client: client,
+		cfg:    cfg,
+		claim:  &claimCursor{next: "0-0"},
+	}, nil
+}
+
+// publishScript adds the tracks ARGV[2..] to the stream KEYS[1] unless the
+// lease fence KEYS[2] was given a newer token than ARGV[1], in which case
+// it returns -1.
+var publishScript = goredis.NewScript(`
+local token = tonumber(ARGV[1])
+if tonumber(redis.call('GET', KEYS[2]) or '0') > token then
+	return -1
+end
+for i = 2, #ARGV do
+	redis.call('XADD', KEYS[1], '*', 'track', ARGV[i])
+end
+return #ARGV - 1
+`)
+
+// Publish adds trks under the fence of ctx, when there is one and
+// Cfg.FenceKey is set, in one script so a ripper that lost its lease
+// publishes nothing.
+func (s Streams) Publish(ctx context.Context, trks ...tracks.Track) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("workqueue: publish: %w", err)
+	}
+	if len(trks) == 0 {
+		return nil
+	}
+	if fence, ok := tracks.FenceOf(ctx); ok && s.cfg.FenceKey != nil {
+		args := make([]any, 0, len(trks)+1)
+		args = append(args, fence.Token)
+		for _, t := range trks {
+			raw, err := json.Marshal(t)
+			if err != nil {
+				return handleErr(err)
+			}
+			args = append(args, raw)
+		}
+		n, err := publishScript.Run(ctx, s.client, []string{s.cfg.Stream, s.cfg.FenceKey(fence.Channel)}, args...).Int()
+		if err != nil {
+			return handleErr(err)
+		}
+		if n < 0 {
+			return handleErr(&tracks.FencedError{Channel: fence.Channel, Token: fence.Token})
+		}
+		return nil
+	}
+	cmds, err := s.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for _, t := range trks {
+			raw, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			_ = pipe.XAdd(ctx, &goredis.XAddArgs{
+				Stream: s.cfg.Stream,
+				Values: map[string]any{"track": raw},
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return handleErr(err)
+		}
+	}
+	return nil
+}
+
+// Receive claims the deliveries left pending for ClaimAfter by any consumer
+// first, then waits up to Block for new entries. Claimed deliveries that
+// were handed out more than MaxDeliveries times are dead lettered instead.
+// Each call resumes the scan of the pending entries where the last one
+// stopped.
+func (s Streams) Receive(ctx context.Context, consumer string, n int) ([]tracks.Delivery, error) {
+	handleErr := func(err error) ([]tracks.Delivery, error) {
+		return nil, fmt.Errorf("workqueue: receive: %w", err)
+	}
+	claimed, next, err := s.client.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+		Stream:   s.cfg.Stream,
+		Group:    s.cfg.Group,
+		MinIdle:  s.cfg.ClaimAfter,
+		Start:    s.claim.get(),
+		Count:    int64(n),
+		Consumer: consumer,
+	}).Result()
+	if err != nil {
+		return handleErr(err)
+	}
+	s.claim.set(next)
+	ds, err := s.claimed(ctx, claimed)
+	if err != nil {
+		return handleErr(err)
+	}
+	if len(ds) >= n {
+		return ds, nil
+	}
+	streams, err := s.client.XReadGroup(ctx, &goredis.XReadGroupArgs{
+		Group:    s.cfg.Group,
+		Consumer: consumer,
+		Streams:  []string{s.cfg.Stream, ">"},
+		Count:    int64(n - len(ds)),
+		Block:    s.cfg.Block,
+	}).Result()
+	if errors.Is(err, goredis.Nil) {
+		return ds, nil
+	} else if err != nil {
+		return handleErr(err)
+	}
+	for _, stream := range streams {
+		for _, m := range stream.Messages {
+			d, err := decode(m, 1)
+			if err != nil {
+				if err := s.deadLetter(ctx, m, 1, err); err != nil {
+					return handleErr(err)
+				}
+				continue
+			}
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+// claimed looks the number of deliveries of msgs up, entries deleted from
+// the stream meanwhile are acked.
+func (s Streams) claimed(ctx context.Context, msgs []goredis.XMessage) ([]tracks.Delivery, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	cmds := make([]*goredis.XPendingExtCmd, len(msgs))
+	if _, err := s.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, m := range msgs {
+			cmds[i] = pipe.XPendingExt(ctx, &goredis.XPendingExtArgs{
+				Stream: s.cfg.Stream,
+				Group:  s.cfg.Group,
+				Start:  m.ID,
+				End:    m.ID,
+				Count:  1,
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var ds []tracks.Delivery
+	for i, m := range msgs {
+		pending, err := cmds[i].Result()
+		if err != nil {
+			return nil, err
+		}
+		if m.Values == nil || len(pending) == 0 {
+			if err := s.client.XAck(ctx, s.cfg.Stream, s.cfg.Group, m.ID).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		deliveries := int(pending[0].RetryCount)
+		d, err := decode(m, deliveries)
+		if err == nil && deliveries > s.cfg.MaxDeliveries {
+			err = fmt.Errorf("not acked after %d deliveries", deliveries-1)
+		}
+		if err != nil {
+			if err := s.deadLetter(ctx, m, deliveries, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+func decode(m goredis.XMessage, deliveries int) (tracks.Delivery, error) {
+	raw, ok := m.Values["track"].(string)
+	if !ok {
+		return tracks.Delivery{}, fmt.Errorf("entry %s without a track", m.ID)
+	}
+	var t tracks.Track
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return tracks.Delivery{}, fmt.Errorf("entry %s: %w", m.ID, err)
+	}
+	return tracks.Delivery{
+		ID:         m.ID,
+		Track:      t,
+		Deliveries: deliveries,
+	}, nil
+}
+
+func (s Streams) Ack(ctx context.Context, d tracks.Delivery) error {
+	if err := s.remove(ctx, d.ID, nil); err != nil {
+		return fmt.Errorf("workqueue: ack %s: %w", d.ID, err)
+	}
+	return nil
+}
+
+// Fail leaves d pending, it is claimed again after ClaimAfter.
+func (s Streams) Fail(ctx context.Context, d tracks.Delivery, reason error) error {
+	if d.Deliveries < s.cfg.MaxDeliveries {
+		return nil
+	}
+	raw, err := json.Marshal(d.Track)
+	if err != nil {
+		return fmt.Errorf("workqueue: fail %s: %w", d.ID, err)
+	}
+	m := goredis.XMessage{ID: d.ID, Values: map[string]any{"track": string(raw)}}
+	if err := s.deadLetter(ctx, m, d.Deliveries, reason); err != nil {
+		return fmt.Errorf("workqueue: fail %s: %w", d.ID, err)
+	}
+	return nil
+}
+
+func (s Streams) deadLetter(ctx context.Context, m goredis.XMessage, deliveries int, reason error) error {
+	values := map[string]any{
+		"entry":      m.ID,
+		"reason":     reason.Error(),
+		"deliveries": strconv.Itoa(deliveries),
+	}
+	if raw, ok := m.Values["track"]; ok {
+		values["track"] = raw
+	}
+	return s.remove(ctx, m.ID, &goredis.XAddArgs{
+		Stream: s.cfg.DeadLetter,
+		Values: values,
+	})
+}
+
+// remove acks and deletes the entry id, after adding dead to the dead letter
+// stream when it is set, in one transaction.
+func (s Streams) remove(ctx context.Context, id string, dead *goredis.XAddArgs) error {
+	cmds, err := s.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		if dead != nil {
+			_ = pipe.XAdd(ctx, dead)
+		}
+		_ = pipe.XAck(ctx, s.cfg.Stream, s.cfg.Group, id)
+		_ = pipe.XDel(ctx, s.cfg.Stream, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package workqueue
+
+import (
+	"accu/tracks"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v9"
+)
+
+// newTestClient connects to an in-memory redis that lives as long as the
+// test.
+func newTestClient(t *testing.T) *goredis.Client {
+	t.Helper()
+	client := goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func ids(ds []tracks.Delivery) string {
+	s := make([]string, len(ds))
+	for i, d := range ds {
+		s[i] = fmt.Sprintf("%s/%d", d.Track.ID, d.Deliveries)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestStreams(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	q, err := New(ctx, client, Cfg{ClaimAfter: 50 * time.Millisecond, MaxDeliveries: 2, Block: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(ctx, client, Cfg{}); err != nil {
+		t.Fatalf("second group create: %v", err)
+	}
+	if err := q.Publish(ctx, tracks.Track{ID: "a"}, tracks.Track{ID: "b"}, tracks.Track{ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := q.Receive(ctx, "one", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ids(first); s != "[a/1 b/1]" {
+		t.Fatalf("one got %s", s)
+	}
+	if err := q.Ack(ctx, first[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Fail(ctx, first[1], errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is not claimed before ClaimAfter
+	second, err := q.Receive(ctx, "two", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ids(second); s != "[c/1]" {
+		t.Fatalf("two got %s", s)
+	}
+	time.Sleep(100 * time.Millisecond)
+	third, err := q.Receive(ctx, "two", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ids(third); s != "[b/2 c/2]" {
+		t.Fatalf("two claimed %s", s)
+	}
+	if err := q.Ack(ctx, third[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Fail(ctx, third[0], errors.New("bad gateway")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := client.XLen(ctx, DefaultCfg.Stream).Val(); n != 0 {
+		t.Errorf("%d entries left", n)
+	}
+	dead, err := client.XRange(ctx, DefaultCfg.DeadLetter, "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Values["reason"] != "bad gateway" || dead[0].Values["deliveries"] != "2" {
+		t.Fatalf("dead letters %v", dead)
+	}
+	if err := json.Unmarshal([]byte(dead[0].Values["track"].(string)), new(tracks.Track)); err != nil {
+		t.Error(err)
+	}
+
+	// a consumer that died is claimed from too, and dead lettered once it
+	// was handed out too many times
+	if err := q.Publish(ctx, tracks.Track{ID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"[d/1]", "[d/2]", "[]"} {
+		time.Sleep(100 * time.Millisecond)
+		got, err := q.Receive(ctx, fmt.Sprintf("dies%d", i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := ids(got); s != want {
+			t.Fatalf("receive %d got %s, want %s", i, s, want)
+		}
+	}
+	if n := client.XLen(ctx, DefaultCfg.DeadLetter).Val(); n != 2 {
+		t.Errorf("%d dead letters, want 2", n)
+	}
+}
+
+// TestStreamsClaimCursor checks that claims resume where the last one
+// stopped instead of scanning the pending entries from their start.
+func TestStreamsClaimCursor(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	q, err := New(ctx, client, Cfg{ClaimAfter: 50 * time.Millisecond, Block: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Publish(ctx, tracks.Track{ID: "a"}, tracks.Track{ID: "b"}, tracks.Track{ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := q.Receive(ctx, "dead", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i, want := range []string{"[a/2]", "[b/2]", "[c/2]"} {
+		got, err := q.Receive(ctx, "live", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := ids(got); s != want {
+			t.Fatalf("claim %d got %s, want %s", i, s, want)
+		}
+		if i < 2 && q.claim.get() != dead[i+1].ID {
+			t.Errorf("claim %d stopped at %s, want %s", i, q.claim.get(), dead[i+1].ID)
+		}
+	}
+	if next := q.claim.get(); next != "0-0" {
+		t.Errorf("cursor %s after the last pending entry, want 0-0", next)
+	}
+}
+
+func TestStreamsPublishFenced(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	fenceKey := func(channel string) string { return "fence:" + channel }
+	q, err := New(ctx, client, Cfg{FenceKey: fenceKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set(ctx, fenceKey("ch"), 5, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	err = q.Publish(tracks.WithFence(ctx, tracks.Fence{Channel: "ch", Token: 4}), tracks.Track{ID: "a"})
+	var fenced *tracks.FencedError
+	if !errors.As(err, &fenced) {
+		t.Fatalf("got %v, want a FencedError", err)
+	}
+	if n := client.XLen(ctx, DefaultCfg.Stream).Val(); n != 0 {
+		t.Fatalf("%d entries published under a stale token", n)
+	}
+	if err := q.Publish(tracks.WithFence(ctx, tracks.Fence{Channel: "ch", Token: 5}), tracks.Track{ID: "b"}, tracks.Track{ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Publish(ctx, tracks.Track{ID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.Receive(ctx, "one", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ids(got); s != "[b/1 c/1 d/1]" {
+		t.Errorf("got %s", s)
+	}
+}
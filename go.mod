@@ -3,12 +3,16 @@ module accu
 go 1.19
 
 require (
+	github.com/alicebob/miniredis/v2 v2.35.0
 	github.com/go-redis/redis/v9 v9.0.0-rc.2
 	github.com/mattn/go-sqlite3 v1.14.4
+	golang.org/x/net v0.17.0
+	golang.org/x/text v0.13.0
 	google.golang.org/protobuf v1.28.1
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
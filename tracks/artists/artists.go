@@ -0,0 +1,104 @@
+// Package artists parses the raw artist strings of tracks into canonical
+// artists and featured credits.
+package artists
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	fold = cases.Fold()
+	// featuring splits "A feat. B", "A ft B", "A featuring B" and "A (feat. B)".
+	featuring = regexp.MustCompile(`(?i)\s*[(\[]?\b(feat\.?|ft\.?|featuring)\s+`)
+	// credits splits a list of featured artists.
+	credits     = regexp.MustCompile(`\s*(,|&|\band\b)\s*`)
+	punctuation = regexp.MustCompile(`[^\pL\pN]+`)
+	// trailingArticle matches the sorted form "National, The".
+	trailingArticle = regexp.MustCompile(`(?i)^(.+),\s*(the|a|an)$`)
+)
+
+// Fold folds the case and strips the diacritics of s.
+func Fold(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return fold.String(folded)
+}
+
+// Name turns the sorted form "National, The" into "The National" and trims
+// the spaces.
+func Name(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if m := trailingArticle.FindStringSubmatch(name); m != nil {
+		return m[2] + " " + m[1]
+	}
+	return name
+}
+
+// Key is the identity of an artist name: folded, without punctuation and
+// without a leading "the", so that "The National", "National, The" and
+// "the national" are the same artist.
+func Key(name string) string {
+	s := Fold(Name(name))
+	s = strings.TrimSpace(punctuation.ReplaceAllString(s, " "))
+	return strings.TrimPrefix(s, "the ")
+}
+
+// Parse splits a raw artist into the main artist and the featured ones.
+// The main artist is kept whole, "Simon & Garfunkel" is one artist.
+func Parse(raw string) (main string, featured []string) {
+	loc := featuring.FindStringIndex(raw)
+	if loc == nil {
+		return Name(raw), nil
+	}
+	main = Name(raw[:loc[0]])
+	for _, f := range credits.Split(featuredPart(raw, loc), -1) {
+		if f = Name(f); f != "" {
+			featured = append(featured, f)
+		}
+	}
+	return main, featured
+}
+
+// featuredPart is the list of featured artists after the match at loc, up
+// to the closing bracket when the credit is in brackets.
+func featuredPart(s string, loc []int) string {
+	rest := s[loc[1]:]
+	if strings.ContainsAny(s[loc[0]:loc[1]], "([") {
+		if end := strings.IndexAny(rest, ")]"); end >= 0 {
+			return rest[:end]
+		}
+	}
+	return strings.TrimRight(rest, ")] ")
+}
+
+// Credits parses the artist and the featured credits of a track, from its
+// artist and from a "(feat. X)" in its title.
+func Credits(artist, title string) (main string, featured []string) {
+	main, featured = Parse(artist)
+	if loc := featuring.FindStringIndex(title); loc != nil {
+		for _, f := range credits.Split(featuredPart(title, loc), -1) {
+			if f = Name(f); f != "" {
+				featured = append(featured, f)
+			}
+		}
+	}
+	seen := map[string]bool{Key(main): true}
+	uniq := featured[:0]
+	for _, f := range featured {
+		if k := Key(f); !seen[k] {
+			seen[k] = true
+			uniq = append(uniq, f)
+		}
+	}
+	return main, uniq
+}
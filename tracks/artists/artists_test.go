@@ -0,0 +1,37 @@
+package artists
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	for _, name := range []string{"The National", "National, The", "the  national", "NATIONAL"} {
+		if got := Key(name); got != "national" {
+			t.Errorf("%q: got %q", name, got)
+		}
+	}
+	if got := Name("National, The"); got != "The National" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCredits(t *testing.T) {
+	for _, c := range []struct {
+		artist, title string
+		want          string
+	}{
+		{"The National", "Bloodbuzz Ohio", "The National []"},
+		{"National, The feat. Taylor Swift", "Gold Rush", "The National [Taylor Swift]"},
+		{"Simon & Garfunkel", "The Boxer", "Simon & Garfunkel []"},
+		{"Daft Punk", "Get Lucky (feat. Pharrell Williams & Nile Rodgers) - Radio Edit", "Daft Punk [Pharrell Williams Nile Rodgers]"},
+		{"Daft Punk ft. Pharrell Williams", "Get Lucky [feat. Pharrell Williams]", "Daft Punk [Pharrell Williams]"},
+		{"Mark Ronson (featuring Amy Winehouse)", "Valerie", "Mark Ronson [Amy Winehouse]"},
+		{"Santana featuring Rob Thomas, The Roots and Beyoncé", "Smooth", "Santana [Rob Thomas The Roots Beyoncé]"},
+	} {
+		main, featured := Credits(c.artist, c.title)
+		if got := fmt.Sprint(main, " ", featured); got != c.want {
+			t.Errorf("%q - %q: got %q, want %q", c.artist, c.title, got, c.want)
+		}
+	}
+}
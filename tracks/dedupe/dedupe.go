@@ -0,0 +1,264 @@
+// Package dedupe groups tracks that hold the same recording under different
+// fn values: remasters, live takes, feat. variants and compilations.
+package dedupe
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"accu/tracks"
+	"accu/tracks/artists"
+)
+
+type Cfg struct {
+	// Tolerance is how far apart the durations of duplicates may be.
+	Tolerance time.Duration
+}
+
+var DefaultCfg = Cfg{
+	Tolerance: 3 * time.Second,
+}
+
+func (c Cfg) withDefaults() Cfg {
+	if c.Tolerance == 0 {
+		c.Tolerance = DefaultCfg.Tolerance
+	}
+	return c
+}
+
+var (
+	// parenthetical drops "(Live)", "[2011 Remaster]" and the like.
+	parenthetical = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+	// featuring drops the credits from a feat. to the end.
+	featuring = regexp.MustCompile(`(^|\s)(feat|ft|featuring)(\.|\s).*$`)
+	// versionSuffix drops " - 2011 Remaster", " - Live at ..." and the like.
+	versionSuffix = regexp.MustCompile(`\s-\s.*\b(remaster|remastered|live|version|edit|mix|mono|stereo|demo|acoustic)\b.*$`)
+	punctuation   = regexp.MustCompile(`[^\pL\pN]+`)
+)
+
+func words(s string) string {
+	return strings.TrimSpace(punctuation.ReplaceAllString(s, " "))
+}
+
+// NormalizeArtist is the key of the main artist, without featured credits.
+func NormalizeArtist(artist string) string {
+	main, _ := artists.Parse(artist)
+	return artists.Key(main)
+}
+
+// NormalizeTitle folds the title and drops parentheticals, featured credits
+// and version suffixes.
+func NormalizeTitle(title string) string {
+	s := artists.Fold(title)
+	s = parenthetical.ReplaceAllString(s, " ")
+	s = versionSuffix.ReplaceAllString(s, "")
+	s = featuring.ReplaceAllString(s, "")
+	return words(s)
+}
+
+// Find groups the tracks with the same normalized artist and title and
+// durations within the tolerance, tracks without a duration join the first
+// group of their title. Reviewed groups of existing are kept, their tracks
+// are left out of detection. The returned groups include them.
+func Find(trks []tracks.Track, existing []tracks.DuplicateGroup, cfg Cfg) []tracks.DuplicateGroup {
+	cfg = cfg.withDefaults()
+	reviewed := map[string]bool{}
+	var groups []tracks.DuplicateGroup
+	for _, g := range existing {
+		if !g.Reviewed {
+			continue
+		}
+		groups = append(groups, g)
+		for _, id := range g.TrackIDs {
+			reviewed[id] = true
+		}
+	}
+	byKey := map[string][]tracks.Track{}
+	var keys []string
+	for _, t := range trks {
+		if t.ID == "" || reviewed[t.ID] {
+			continue
+		}
+		title := NormalizeTitle(t.Title)
+		if title == "" {
+			continue
+		}
+		key := NormalizeArtist(t.Artist) + "\x00" + title
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], t)
+	}
+	sort.Strings(keys)
+	tolerance := int(cfg.Tolerance.Round(time.Second) / time.Second)
+	for _, key := range keys {
+		same := byKey[key]
+		sort.SliceStable(same, func(i, j int) bool {
+			return same[i].Duration < same[j].Duration
+		})
+		var clusters [][]tracks.Track
+		var unknown []tracks.Track
+		for _, t := range same {
+			switch {
+			case t.Duration == 0:
+				unknown = append(unknown, t)
+			case len(clusters) == 0 || t.Duration-lastDuration(clusters) > tolerance:
+				clusters = append(clusters, []tracks.Track{t})
+			default:
+				clusters[len(clusters)-1] = append(clusters[len(clusters)-1], t)
+			}
+		}
+		if len(clusters) == 0 {
+			clusters = append(clusters, nil)
+		}
+		clusters[0] = append(clusters[0], unknown...)
+		for _, c := range clusters {
+			if len(c) > 1 {
+				groups = append(groups, newGroup(c))
+			}
+		}
+	}
+	sortGroups(groups)
+	return groups
+}
+
+func lastDuration(clusters [][]tracks.Track) int {
+	c := clusters[len(clusters)-1]
+	return c[len(c)-1].Duration
+}
+
+// newGroup prefers the track with the shortest title, the one without
+// version decorations most of the time.
+func newGroup(trks []tracks.Track) tracks.DuplicateGroup {
+	sort.Slice(trks, func(i, j int) bool {
+		return trks[i].ID < trks[j].ID
+	})
+	preferred := trks[0]
+	ids := make([]string, len(trks))
+	for i, t := range trks {
+		ids[i] = t.ID
+		if utf8.RuneCountInString(t.Title) < utf8.RuneCountInString(preferred.Title) {
+			preferred = t
+		}
+	}
+	return tracks.DuplicateGroup{
+		ID:        ids[0],
+		TrackIDs:  ids,
+		Preferred: preferred.ID,
+	}
+}
+
+func sortGroups(groups []tracks.DuplicateGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+}
+
+func find(groups []tracks.DuplicateGroup, id string) int {
+	for i, g := range groups {
+		for _, t := range g.TrackIDs {
+			if t == id {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Merge puts ids and the groups they belong to into one reviewed group,
+// the preferred track of the group of ids[0] stays preferred.
+func Merge(groups []tracks.DuplicateGroup, ids ...string) ([]tracks.DuplicateGroup, error) {
+	if len(ids) < 2 {
+		return nil, fmt.Errorf("merge: need at least two tracks")
+	}
+	merged := tracks.DuplicateGroup{
+		Preferred: ids[0],
+		Reviewed:  true,
+	}
+	if i := find(groups, ids[0]); i >= 0 {
+		merged.Preferred = groups[i].Preferred
+	}
+	seen := map[string]bool{}
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			merged.TrackIDs = append(merged.TrackIDs, id)
+		}
+	}
+	for _, id := range ids {
+		i := find(groups, id)
+		if i < 0 {
+			add(id)
+			continue
+		}
+		for _, t := range groups[i].TrackIDs {
+			add(t)
+		}
+		groups = append(groups[:i:i], groups[i+1:]...)
+	}
+	sort.Strings(merged.TrackIDs)
+	merged.ID = merged.TrackIDs[0]
+	groups = append(groups, merged)
+	sortGroups(groups)
+	return groups, nil
+}
+
+// Prefer makes id the downloaded track of its group.
+func Prefer(groups []tracks.DuplicateGroup, id string) ([]tracks.DuplicateGroup, error) {
+	i := find(groups, id)
+	if i < 0 || len(groups[i].TrackIDs) < 2 {
+		return nil, fmt.Errorf("prefer: %w", &tracks.NotFoundError{Entity: "duplicate", Key: id})
+	}
+	groups = append([]tracks.DuplicateGroup(nil), groups...)
+	groups[i].Preferred = id
+	groups[i].Reviewed = true
+	return groups, nil
+}
+
+// Split takes id out of its group and keeps it out of later detection.
+func Split(groups []tracks.DuplicateGroup, id string) ([]tracks.DuplicateGroup, error) {
+	i := find(groups, id)
+	if i < 0 || len(groups[i].TrackIDs) < 2 {
+		return nil, fmt.Errorf("split: %w", &tracks.NotFoundError{Entity: "duplicate", Key: id})
+	}
+	g := groups[i]
+	rest := make([]string, 0, len(g.TrackIDs)-1)
+	for _, t := range g.TrackIDs {
+		if t != id {
+			rest = append(rest, t)
+		}
+	}
+	g.TrackIDs = rest
+	g.ID = rest[0]
+	g.Reviewed = true
+	if g.Preferred == id {
+		g.Preferred = rest[0]
+	}
+	groups = append(groups[:i:i], groups[i+1:]...)
+	groups = append(groups, g, tracks.DuplicateGroup{
+		ID:        id,
+		TrackIDs:  []string{id},
+		Preferred: id,
+		Reviewed:  true,
+	})
+	sortGroups(groups)
+	return groups, nil
+}
+
+// Skipped returns the tracks that are not downloaded, the ones not
+// preferred in their group.
+func Skipped(groups []tracks.DuplicateGroup) map[string]bool {
+	skipped := map[string]bool{}
+	for _, g := range groups {
+		for _, id := range g.TrackIDs {
+			if id != g.Preferred {
+				skipped[id] = true
+			}
+		}
+	}
+	return skipped
+}
@@ -0,0 +1,74 @@
+package dedupe
+
+import (
+	"fmt"
+	"testing"
+
+	"accu/tracks"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		artist, title string
+		want          string
+	}{
+		{"Sigur Rós", "Hoppípolla", "sigur ros/hoppipolla"},
+		{"SIGUR ROS", "Hoppipolla (Live)", "sigur ros/hoppipolla"},
+		{"The Beatles", "Let It Be - Remastered 2009", "beatles/let it be"},
+		{"Beatles", "Let It Be [Naked Version]", "beatles/let it be"},
+		{"Daft Punk feat. Pharrell Williams", "Get Lucky", "daft punk/get lucky"},
+		{"Daft Punk", "Get Lucky (feat. Pharrell Williams) - Radio Edit", "daft punk/get lucky"},
+		{"Röyksopp", "What Else Is There? ft. Karin Dreijer", "royksopp/what else is there"},
+		{"Muse", "Live Forever", "muse/live forever"},
+		{"Oasis", "Don't Look Back in Anger", "oasis/don t look back in anger"},
+	} {
+		if got := NormalizeArtist(c.artist) + "/" + NormalizeTitle(c.title); got != c.want {
+			t.Errorf("%q - %q: got %q, want %q", c.artist, c.title, got, c.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	trks := []tracks.Track{
+		{ID: "a1", Artist: "Sigur Rós", Title: "Hoppípolla", Duration: 268},
+		{ID: "a2", Artist: "Sigur Ros", Title: "Hoppipolla (Remastered)", Duration: 270},
+		{ID: "a3", Artist: "Sigur Ros", Title: "Hoppipolla (Live)", Duration: 301},
+		{ID: "a4", Artist: "Sigur Ros", Title: "Hoppipolla - Live at Hammersmith", Duration: 303},
+		{ID: "a5", Artist: "Sigur Ros", Title: "Hoppipolla", Duration: 0},
+		{ID: "b1", Artist: "Muse", Title: "Uprising", Duration: 305},
+		{ID: "c1", Artist: "Daft Punk", Title: "Get Lucky", Duration: 248},
+		{ID: "c2", Artist: "Daft Punk feat. Pharrell Williams", Title: "Get Lucky", Duration: 250},
+		{ID: "c3", Artist: "Daft Punk", Title: "Get Lucky (feat. Pharrell Williams)", Duration: 249},
+	}
+	got := Find(trks, nil, Cfg{})
+	if s := fmt.Sprint(got); s != "[{a1 [a1 a2 a5] a1 false} {a3 [a3 a4] a3 false} {c1 [c1 c2 c3] c1 false}]" {
+		t.Fatalf("got %s", s)
+	}
+
+	reviewed, err := Split(got, "c3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reviewed, err = Prefer(reviewed, "a2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := Find(trks, reviewed, Cfg{})
+	if s := fmt.Sprint(again); s != "[{a1 [a1 a2 a5] a2 true} {a3 [a3 a4] a3 false} {c1 [c1 c2] c1 true} {c3 [c3] c3 true}]" {
+		t.Errorf("got %s", s)
+	}
+	if s := fmt.Sprint(Skipped(again)); s != "map[a1:true a4:true a5:true c2:true]" {
+		t.Errorf("skipped %s", s)
+	}
+
+	merged, err := Merge(again, "b1", "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(merged); s != "[{a1 [a1 a2 a5] a2 true} {a3 [a3 a4] a3 false} {b1 [b1 c1 c2] b1 true} {c3 [c3] c3 true}]" {
+		t.Errorf("got %s", s)
+	}
+	if _, err := Prefer(merged, "c3"); err == nil {
+		t.Error("preferred a track without duplicates")
+	}
+}
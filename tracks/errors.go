@@ -0,0 +1,215 @@
+package tracks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrDuplicateEntity = errors.New("duplicate entity")
+	ErrNoChannels      = errors.New("no channels found")
+)
+
+// Retryable errors may go away when the same operation is repeated.
+type Retryable interface {
+	Retryable() bool
+}
+
+// Temporary errors are caused by a condition that is expected to clear by itself.
+type Temporary interface {
+	Temporary() bool
+}
+
+func IsRetryable(err error) bool {
+	var r Retryable
+	return errors.As(err, &r) && r.Retryable()
+}
+
+// IsPermanent reports whether err is classified as not retryable,
+// unclassified errors are not permanent.
+func IsPermanent(err error) bool {
+	var r Retryable
+	return errors.As(err, &r) && !r.Retryable()
+}
+
+func IsTemporary(err error) bool {
+	var t Temporary
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// RetryAfter returns the delay the upstream asked for, if any.
+func RetryAfter(err error) (time.Duration, bool) {
+	var rl *RateLimitedError
+	if errors.As(err, &rl) && rl.RetryAfter > 0 {
+		return rl.RetryAfter, true
+	}
+	return 0, false
+}
+
+// UpstreamStatusError is an unexpected HTTP status from the upstream.
+type UpstreamStatusError struct {
+	URI        string
+	StatusCode int
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream %s: status %d %s", e.URI, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *UpstreamStatusError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout
+}
+
+func (e *UpstreamStatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// CheckStatus turns a non 200 response into an UpstreamStatusError
+// or a RateLimitedError.
+func CheckStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	uri := resp.Request.URL.String()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &RateLimitedError{
+			URI:        uri,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	return &UpstreamStatusError{
+		URI:        uri,
+		StatusCode: resp.StatusCode,
+	}
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// RateLimitedError is a 429 from the upstream. RetryAfter is zero when
+// the upstream did not say how long to wait.
+type RateLimitedError struct {
+	URI        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("upstream %s: rate limited, retry after %s", e.URI, e.RetryAfter)
+	}
+	return fmt.Sprintf("upstream %s: rate limited", e.URI)
+}
+
+func (e *RateLimitedError) Retryable() bool { return true }
+func (e *RateLimitedError) Temporary() bool { return true }
+
+// TransportError is a failure to talk to the upstream at all.
+type TransportError struct {
+	URI string
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("upstream %s: %v", e.URI, e.Err)
+}
+
+func (e *TransportError) Unwrap() error   { return e.Err }
+func (e *TransportError) Retryable() bool { return true }
+func (e *TransportError) Temporary() bool { return true }
+
+// DecodeError is an upstream payload that could not be parsed,
+// usually a sign that the upstream schema changed.
+type DecodeError struct {
+	URI string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %s: %v", e.URI, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error   { return e.Err }
+func (e *DecodeError) Retryable() bool { return false }
+func (e *DecodeError) Temporary() bool { return false }
+
+// StorageError is a repo failure. Transient is set for failures such as
+// lost connections or busy databases that are worth retrying.
+type StorageError struct {
+	Backend   string
+	Err       error
+	Transient bool
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("%s storage: %v", e.Backend, e.Err)
+}
+
+func (e *StorageError) Unwrap() error   { return e.Err }
+func (e *StorageError) Retryable() bool { return e.Transient }
+func (e *StorageError) Temporary() bool { return e.Transient }
+
+// NotFoundError matches ErrNotFound with errors.Is.
+type NotFoundError struct {
+	Entity string
+	Key    string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.Entity, e.Key)
+}
+
+func (e *NotFoundError) Is(target error) bool { return target == ErrNotFound }
+func (e *NotFoundError) Retryable() bool      { return false }
+func (e *NotFoundError) Temporary() bool      { return false }
+
+// DuplicateError matches ErrDuplicateEntity with errors.Is.
+type DuplicateError struct {
+	Entity string
+	Key    string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%s %q already exists", e.Entity, e.Key)
+}
+
+func (e *DuplicateError) Is(target error) bool { return target == ErrDuplicateEntity }
+func (e *DuplicateError) Retryable() bool      { return false }
+func (e *DuplicateError) Temporary() bool      { return false }
+
+// FencedError is returned by a write made under a channel lease that was
+// taken over since, Token is the stale fencing token.
+type FencedError struct {
+	Channel string
+	Token   int64
+}
+
+func (e *FencedError) Error() string {
+	return fmt.Sprintf("channel %s: fencing token %d is stale", e.Channel, e.Token)
+}
+
+func (e *FencedError) Retryable() bool { return false }
+func (e *FencedError) Temporary() bool { return false }
@@ -0,0 +1,125 @@
+package tracks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status     int
+		retryAfter string
+		want       error
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNotFound, want: &UpstreamStatusError{URI: "https://up.example/p", StatusCode: 404}},
+		{status: http.StatusServiceUnavailable, want: &UpstreamStatusError{URI: "https://up.example/p", StatusCode: 503}},
+		{status: http.StatusTooManyRequests, want: &RateLimitedError{URI: "https://up.example/p"}},
+		{status: http.StatusTooManyRequests, retryAfter: "7", want: &RateLimitedError{URI: "https://up.example/p", RetryAfter: 7 * time.Second}},
+		{status: http.StatusTooManyRequests, retryAfter: "soon", want: &RateLimitedError{URI: "https://up.example/p"}},
+	} {
+		resp := &http.Response{
+			StatusCode: tc.status,
+			Header:     http.Header{},
+			Request:    &http.Request{URL: &url.URL{Scheme: "https", Host: "up.example", Path: "/p"}},
+		}
+		if tc.retryAfter != "" {
+			resp.Header.Set("Retry-After", tc.retryAfter)
+		}
+		err := CheckStatus(resp)
+		if fmt.Sprintf("%#v", err) != fmt.Sprintf("%#v", tc.want) {
+			t.Errorf("status %d %q: got %#v, want %#v", tc.status, tc.retryAfter, err, tc.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		v        string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{"-5", 0, 0},
+		{"1.5", 0, 0},
+		{now.Add(90 * time.Second).UTC().Format(http.TimeFormat), 88 * time.Second, 90 * time.Second},
+		{now.Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+		{"Mon, 02 Jan 2006", 0, 0},
+	} {
+		if d := parseRetryAfter(tc.v); d < tc.min || d > tc.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s..%s", tc.v, d, tc.min, tc.max)
+		}
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	for _, tc := range []struct {
+		err                  error
+		retryable, permanent bool
+		temporary            bool
+	}{
+		{err: nil},
+		{err: errors.New("unclassified")},
+		{err: &TransportError{URI: "u", Err: errors.New("reset")}, retryable: true, temporary: true},
+		{err: &RateLimitedError{URI: "u"}, retryable: true, temporary: true},
+		{err: &UpstreamStatusError{URI: "u", StatusCode: 503}, retryable: true, temporary: true},
+		{err: &UpstreamStatusError{URI: "u", StatusCode: 500}, retryable: true},
+		{err: &UpstreamStatusError{URI: "u", StatusCode: 404}, permanent: true},
+		{err: &DecodeError{URI: "u", Err: errors.New("eof")}, permanent: true},
+		{err: &StorageError{Backend: "sqlite", Err: errors.New("busy"), Transient: true}, retryable: true, temporary: true},
+		{err: &StorageError{Backend: "sqlite", Err: errors.New("constraint")}, permanent: true},
+		{err: &NotFoundError{Entity: "track", Key: "k"}, permanent: true},
+		{err: &FencedError{Channel: "c", Token: 1}, permanent: true},
+		// the class survives wrapping
+		{err: fmt.Errorf("fetch: %w", &DecodeError{URI: "u", Err: errors.New("eof")}), permanent: true},
+		{err: fmt.Errorf("fetch: %w", &TransportError{URI: "u", Err: errors.New("reset")}), retryable: true, temporary: true},
+	} {
+		if got := IsRetryable(tc.err); got != tc.retryable {
+			t.Errorf("IsRetryable(%v) = %t", tc.err, got)
+		}
+		if got := IsPermanent(tc.err); got != tc.permanent {
+			t.Errorf("IsPermanent(%v) = %t", tc.err, got)
+		}
+		if got := IsTemporary(tc.err); got != tc.temporary {
+			t.Errorf("IsTemporary(%v) = %t", tc.err, got)
+		}
+	}
+}
+
+func TestUpstreamStatusErrorRetryable(t *testing.T) {
+	for status, want := range map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusForbidden:           false,
+		http.StatusNotFound:            false,
+		http.StatusGone:                false,
+		http.StatusRequestTimeout:      true,
+		http.StatusInternalServerError: true,
+		http.StatusNotImplemented:      true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	} {
+		if got := (&UpstreamStatusError{StatusCode: status}).Retryable(); got != want {
+			t.Errorf("status %d: retryable %t, want %t", status, got, want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	err := fmt.Errorf("fetch: %w", &RateLimitedError{URI: "u", RetryAfter: time.Minute})
+	if d, ok := RetryAfter(err); !ok || d != time.Minute {
+		t.Errorf("RetryAfter = %s, %t", d, ok)
+	}
+	if _, ok := RetryAfter(&RateLimitedError{URI: "u"}); ok {
+		t.Error("RetryAfter without a delay")
+	}
+	if _, ok := RetryAfter(&UpstreamStatusError{StatusCode: 503}); ok {
+		t.Error("RetryAfter of a status error")
+	}
+}
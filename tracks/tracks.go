@@ -2,10 +2,15 @@ package tracks
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type Track struct {
+	// ID is the canonical identity of the track, links may change.
+	ID            string
 	Channel       string
 	Artist        string
 	Album         string
@@ -14,34 +19,381 @@ type Track struct {
 	PrimaryLink   string
 	SecondaryLink string
 	Duration      int
+	// Channels are the channels the track was seen on in first seen order,
+	// Channel is the one it was fetched from. Both name channels by data id.
+	Channels []Membership
+}
+
+// Membership is a track seen on a channel.
+type Membership struct {
+	Channel   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// TrackID derives the canonical identity of a track from the fn of its
+// playlist item, the path of the file the links share whatever the CDN host.
+// The fn is taken whole, directories and dots included.
+func TrackID(fn string) string {
+	return strings.Trim(fn, "/")
+}
+
+// LinkTrackID recovers the TrackID of a track saved with its links only: the
+// path segments the two links end with, or the whole path of a single link,
+// without the .m4a suffix the links get.
+// The fn can't be told apart from a directory both hosts put it in, such
+// tracks get a longer ID than the fetchers give them.
+func LinkTrackID(primaryLink, secondaryLink string) string {
+	primary := strings.Split(linkPath(primaryLink), "/")
+	if secondaryLink == "" || secondaryLink == primaryLink {
+		return TrackID(strings.Join(primary, "/"))
+	}
+	secondary := strings.Split(linkPath(secondaryLink), "/")
+	n := 0
+	for n < len(primary) && n < len(secondary) && primary[len(primary)-1-n] == secondary[len(secondary)-1-n] {
+		n++
+	}
+	if n == 0 {
+		return TrackID(strings.Join(primary, "/"))
+	}
+	return TrackID(strings.Join(primary[len(primary)-n:], "/"))
+}
+
+func linkPath(link string) string {
+	if u, err := url.Parse(link); err == nil {
+		link = u.Path
+	}
+	return strings.TrimSuffix(strings.Trim(link, "/"), ".m4a")
 }
 
 type Channel struct {
+	Name        string
+	DataId      string
+	OldId       string
+	Description string
+	Image       string
+	Categories  []Category
+}
+
+// Category is a genre page on the site. Parent is the slug of the enclosing
+// genre, empty for top level genres.
+type Category struct {
+	Slug   string
 	Name   string
-	DataId string
+	Parent string
+}
+
+// FetchOptions are per call options understood by every fetcher.
+type FetchOptions struct {
+	// Timeout bounds a single call on top of the context deadline, zero disables it.
+	Timeout time.Duration
+	// Metadata is passed along with the request, HTTP fetchers send it as headers.
+	Metadata map[string]string
+}
+
+// WithTimeout derives a context bounded by o.Timeout.
+func (o FetchOptions) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
+
+// FetchInfo tells how a fetch was served, the transports fill the one
+// passed with WithFetchInfo.
+type FetchInfo struct {
+	// Replayed is set when the response came from a cache, it repeats an
+	// earlier response instead of being a new sample of the upstream.
+	Replayed bool
+}
+
+type fetchInfoKey struct{}
+
+func WithFetchInfo(ctx context.Context, info *FetchInfo) context.Context {
+	return context.WithValue(ctx, fetchInfoKey{}, info)
+}
+
+// FetchInfoOf returns the FetchInfo of ctx, nil when there is none.
+func FetchInfoOf(ctx context.Context) *FetchInfo {
+	info, _ := ctx.Value(fetchInfoKey{}).(*FetchInfo)
+	return info
+}
+
+// MarkReplayed sets Replayed on the FetchInfo of ctx, if any. Transports
+// call it when they answer with a stored response.
+func MarkReplayed(ctx context.Context) {
+	if info := FetchInfoOf(ctx); info != nil {
+		info.Replayed = true
+	}
 }
 
 type FetchTracksParams struct {
 	Channel string
+	FetchOptions
+}
+
+type FetchChannelsParams struct {
+	FetchOptions
 }
 
 type TracksFetcher interface {
-	FetchTracks(params FetchTracksParams) ([]Track, error)
+	FetchTracks(ctx context.Context, params FetchTracksParams) ([]Track, error)
 }
 
 type ChannelFetcher interface {
+	FetchChannels(ctx context.Context, params FetchChannelsParams) ([]Channel, error)
+}
+
+// LegacyTracksFetcher is the context unaware TracksFetcher, see AdaptTracksFetcher.
+type LegacyTracksFetcher interface {
+	FetchTracks(params FetchTracksParams) ([]Track, error)
+}
+
+// LegacyChannelFetcher is the context unaware ChannelFetcher, see AdaptChannelFetcher.
+type LegacyChannelFetcher interface {
 	FetchChannels() ([]Channel, error)
 }
 
+// DefaultLegacyCalls bounds the legacy calls an adapter runs at once.
+var DefaultLegacyCalls = 8
+
+// AdaptTracksFetcher turns a LegacyTracksFetcher into a TracksFetcher.
+// The legacy call can't be interrupted, when ctx is done first the call
+// is left running in the background and its result is dropped. It keeps
+// its slot among the DefaultLegacyCalls until it returns, so a hanging
+// upstream blocks new calls instead of piling up goroutines.
+func AdaptTracksFetcher(f LegacyTracksFetcher) TracksFetcher {
+	return legacyTracksFetcher{f, newLegacyCalls()}
+}
+
+type legacyTracksFetcher struct {
+	f     LegacyTracksFetcher
+	calls legacyCalls
+}
+
+func (a legacyTracksFetcher) FetchTracks(ctx context.Context, params FetchTracksParams) ([]Track, error) {
+	return runLegacy(ctx, a.calls, params.FetchOptions, func() ([]Track, error) {
+		return a.f.FetchTracks(params)
+	})
+}
+
+// AdaptChannelFetcher turns a LegacyChannelFetcher into a ChannelFetcher,
+// see AdaptTracksFetcher for the cancellation caveat.
+func AdaptChannelFetcher(f LegacyChannelFetcher) ChannelFetcher {
+	return legacyChannelFetcher{f, newLegacyCalls()}
+}
+
+type legacyChannelFetcher struct {
+	f     LegacyChannelFetcher
+	calls legacyCalls
+}
+
+func (a legacyChannelFetcher) FetchChannels(ctx context.Context, params FetchChannelsParams) ([]Channel, error) {
+	return runLegacy(ctx, a.calls, params.FetchOptions, a.f.FetchChannels)
+}
+
+// legacyCalls holds a slot per running legacy call.
+type legacyCalls chan struct{}
+
+func newLegacyCalls() legacyCalls {
+	n := DefaultLegacyCalls
+	if n < 1 {
+		n = 1
+	}
+	return make(legacyCalls, n)
+}
+
+func runLegacy[T any](ctx context.Context, calls legacyCalls, opts FetchOptions, call func() (T, error)) (T, error) {
+	ctx, cancel := opts.WithTimeout(ctx)
+	defer cancel()
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case calls <- struct{}{}:
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-calls }()
+		v, err := call()
+		done <- result{v, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case r := <-done:
+		return r.v, r.err
+	}
+}
+
 type Repo interface {
 	SaveTracks(ctx context.Context, trks ...Track) error
 	SaveChannels(ctx context.Context, chs ...Channel) error
+	// SetChannelEnabled persists whether a channel is ripped.
+	SetChannelEnabled(ctx context.Context, dataId string, enabled bool) error
+	IsChannelEnabled(ctx context.Context, dataId string) (bool, error)
 	GetTrackByLink(ctx context.Context, link string) (Track, error)
+	// UnknownIDs returns the track IDs that were not seen on the channel yet,
+	// or not saved at all when channel is empty, in input order.
+	UnknownIDs(ctx context.Context, channel string, ids ...string) ([]string, error)
 	GetAllTracks(ctx context.Context, run func(ctx context.Context, t Track) error) error
+	DuplicateRepo
 }
 
-// TODO error interfaces
-var (
-	ErrNotFound        = errors.New("not found")
-	ErrDuplicateEntity = errors.New("duplicate entity")
-)
+// DuplicateGroup is a set of tracks that hold the same recording, only the
+// Preferred one is downloaded. Reviewed groups were changed by hand and are
+// kept as they are by detection, a reviewed group of one track marks it as
+// no duplicate of anything.
+type DuplicateGroup struct {
+	ID        string
+	TrackIDs  []string
+	Preferred string
+	Reviewed  bool
+}
+
+type DuplicateRepo interface {
+	GetDuplicateGroups(ctx context.Context) ([]DuplicateGroup, error)
+	// ReplaceDuplicateGroups drops the stored groups and saves groups instead.
+	ReplaceDuplicateGroups(ctx context.Context, groups ...DuplicateGroup) error
+}
+
+// Artist is a canonical artist, ID is the artists.Key of its name. Aliases
+// are the other names it is credited under.
+type Artist struct {
+	ID      string
+	Name    string
+	Aliases []string
+}
+
+// AliasRule credits the tracks of Alias to Artist.
+type AliasRule struct {
+	Alias  string
+	Artist string
+}
+
+// ArtistCount is the number of tracks of a channel that credit an artist
+// as the main artist and as a featured one.
+type ArtistCount struct {
+	Artist   Artist
+	Tracks   int
+	Featured int
+}
+
+// ArtistRepo links the tracks to canonical artists parsed from Track.Artist
+// and Track.Title when they are saved, alias rules are applied when reading.
+type ArtistRepo interface {
+	GetArtists(ctx context.Context) ([]Artist, error)
+	GetAliasRules(ctx context.Context) ([]AliasRule, error)
+	SaveAliasRule(ctx context.Context, rule AliasRule) error
+	DeleteAliasRule(ctx context.Context, alias string) error
+	TopArtists(ctx context.Context, channel string, limit int) ([]ArtistCount, error)
+}
+
+// TrackFilter selects the tracks that match all of its set fields. Artist
+// matches the main and featured credits of its canonical artist, Album
+// matches exactly.
+type TrackFilter struct {
+	// Channel is a data id.
+	Channel string
+	Artist  string
+	Album   string
+	Year    int
+	// Limit caps the number of tracks, 0 returns all of them.
+	Limit int
+}
+
+// QueryRepo reads the channels and the tracks back, tracks come newest first
+// by the time they were first seen.
+type QueryRepo interface {
+	GetChannels(ctx context.Context) ([]Channel, error)
+	FindTracks(ctx context.Context, f TrackFilter) ([]Track, error)
+}
+
+// Delivery is a track handed out by a TrackQueue, Deliveries counts the
+// times it was handed out, this one included.
+type Delivery struct {
+	ID         string
+	Track      Track
+	Deliveries int
+}
+
+// TrackQueue hands the new tracks out to the downloaders. A delivery stays
+// pending until it is acked and is handed out again when it is not acked in
+// time, deliveries that failed too many times are dead lettered.
+type TrackQueue interface {
+	Publish(ctx context.Context, trks ...Track) error
+	// Receive waits for up to n deliveries for consumer.
+	Receive(ctx context.Context, consumer string, n int) ([]Delivery, error)
+	Ack(ctx context.Context, d Delivery) error
+	// Fail leaves d to be handed out again, or dead letters it with reason
+	// once it was handed out too many times.
+	Fail(ctx context.Context, d Delivery, reason error) error
+}
+
+// Fence is the fencing token of the lease a write is made under.
+type Fence struct {
+	Channel string
+	Token   int64
+}
+
+type fenceKey struct{}
+
+// WithFence makes the track writes of ctx fail with a FencedError once the
+// lease of f.Channel was given a newer token, for the repos that share the
+// leases.
+func WithFence(ctx context.Context, f Fence) context.Context {
+	return context.WithValue(ctx, fenceKey{}, f)
+}
+
+func FenceOf(ctx context.Context) (Fence, bool) {
+	f, ok := ctx.Value(fenceKey{}).(Fence)
+	return f, ok
+}
+
+// ChannelLeases assigns the channels to the live rippers, a channel is
+// leased to one of them at a time.
+type ChannelLeases interface {
+	// Sync renews the membership of this ripper and the leases it holds
+	// among channels, takes the free ones assigned to it and releases those
+	// assigned to another ripper. It returns the fencing tokens of the
+	// leases held by channel.
+	Sync(ctx context.Context, channels []string) (map[string]int64, error)
+	// Release gives all leases and the membership up.
+	Release(ctx context.Context) error
+}
+
+type CategoryRepo interface {
+	GetCategories(ctx context.Context) ([]Category, error)
+	// GetChannelsByCategory returns the channels of the category and all its subcategories.
+	GetChannelsByCategory(ctx context.Context, slug string) ([]Channel, error)
+	GetChannelCategories(ctx context.Context, dataId string) ([]Category, error)
+}
+
+// DriftReport counts how upstream payloads deviated from the expected schema.
+// Field maps are keyed by the JSON path of the field.
+type DriftReport struct {
+	Items          int
+	Skipped        int
+	UnknownFields  map[string]int
+	TypeMismatches map[string]int
+	MissingFields  map[string]int
+}
+
+// DriftReporter is implemented by fetchers that decode leniently.
+// DriftReport returns the totals since the fetcher was created.
+type DriftReporter interface {
+	DriftReport() DriftReport
+}
+
+func (r DriftReport) Drifted() bool {
+	return r.Skipped > 0 || len(r.UnknownFields) > 0 || len(r.TypeMismatches) > 0 || len(r.MissingFields) > 0
+}
+
+func (r DriftReport) String() string {
+	return fmt.Sprintf("%d items, %d skipped, unknown fields %v, type mismatches %v, missing fields %v",
+		r.Items, r.Skipped, r.UnknownFields, r.TypeMismatches, r.MissingFields)
+}
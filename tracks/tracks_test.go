@@ -0,0 +1,154 @@
+package tracks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrackID(t *testing.T) {
+	for _, tc := range []struct {
+		fn, want string
+	}{
+		{"abc", "abc"},
+		{"/x/abc", "x/abc"},
+		// dots belong to the fn
+		{"x/abc.v2", "x/abc.v2"},
+		{"abc.m4a", "abc.m4a"},
+		{"", ""},
+	} {
+		if got := TrackID(tc.fn); got != tc.want {
+			t.Errorf("TrackID(%q) = %q, want %q", tc.fn, got, tc.want)
+		}
+	}
+}
+
+func TestLinkTrackID(t *testing.T) {
+	for _, tc := range []struct {
+		primary, secondary, want string
+	}{
+		{"https://cdn.example/x/abc.m4a", "https://cdn2.example/x/abc.m4a", "x/abc"},
+		{"https://cdn.example/a/x/abc.m4a", "https://cdn2.example/b/x/abc.m4a", "x/abc"},
+		{"https://cdn.example/x/abc.m4a?token=1#t", "https://cdn2.example/x/abc.m4a", "x/abc"},
+		{"https://cdn.example/x/abc.v2", "https://cdn2.example/abc.v2", "abc.v2"},
+		// one link, the whole path
+		{"https://cdn.example/x/abc.m4a", "", "x/abc"},
+		{"https://cdn.example/x/abc.m4a", "https://cdn.example/x/abc.m4a", "x/abc"},
+		// nothing shared, the primary path
+		{"https://cdn.example/x/abc.m4a", "https://cdn2.example/def.m4a", "x/abc"},
+		{"https://cdn.example/x/abc.m4a.m4a", "https://cdn2.example/abc.m4a.m4a", "abc.m4a"},
+		{"", "", ""},
+	} {
+		if got := LinkTrackID(tc.primary, tc.secondary); got != tc.want {
+			t.Errorf("LinkTrackID(%q, %q) = %q, want %q", tc.primary, tc.secondary, got, tc.want)
+		}
+	}
+}
+
+// blockingFetcher is a legacy fetcher whose calls return once release is
+// closed, running counts the calls in flight.
+type blockingFetcher struct {
+	release chan struct{}
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (f *blockingFetcher) FetchTracks(params FetchTracksParams) ([]Track, error) {
+	f.mu.Lock()
+	f.running++
+	if f.running > f.peak {
+		f.peak = f.running
+	}
+	f.mu.Unlock()
+	<-f.release
+	f.mu.Lock()
+	f.running--
+	f.mu.Unlock()
+	if params.Channel == "" {
+		return nil, errors.New("no channel")
+	}
+	return []Track{{Channel: params.Channel}}, nil
+}
+
+func (f *blockingFetcher) inFlight() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running, f.peak
+}
+
+func TestAdaptFetchers(t *testing.T) {
+	f := &blockingFetcher{release: make(chan struct{})}
+	close(f.release)
+	ctx := context.Background()
+	trks, err := AdaptTracksFetcher(f).FetchTracks(ctx, FetchTracksParams{Channel: "c1"})
+	if err != nil || len(trks) != 1 || trks[0].Channel != "c1" {
+		t.Errorf("fetch tracks: %+v, %v", trks, err)
+	}
+	if _, err := AdaptTracksFetcher(f).FetchTracks(ctx, FetchTracksParams{}); err == nil || err.Error() != "no channel" {
+		t.Errorf("fetch tracks error: %v", err)
+	}
+	chs, err := AdaptChannelFetcher(legacyChannels{f}).FetchChannels(ctx, FetchChannelsParams{})
+	if err != nil || len(chs) != 1 {
+		t.Errorf("fetch channels: %+v, %v", chs, err)
+	}
+}
+
+// legacyChannels turns the tracks of a blockingFetcher into channels.
+type legacyChannels struct {
+	f *blockingFetcher
+}
+
+func (l legacyChannels) FetchChannels() ([]Channel, error) {
+	trks, err := l.f.FetchTracks(FetchTracksParams{Channel: "c1"})
+	chs := make([]Channel, 0, len(trks))
+	for _, t := range trks {
+		chs = append(chs, Channel{DataId: t.Channel})
+	}
+	return chs, err
+}
+
+func TestAdaptCancel(t *testing.T) {
+	f := &blockingFetcher{release: make(chan struct{})}
+	tf := AdaptTracksFetcher(f)
+	calls := DefaultLegacyCalls + 5
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func(i int) {
+			_, err := tf.FetchTracks(context.Background(), FetchTracksParams{
+				Channel:      fmt.Sprint(i),
+				FetchOptions: FetchOptions{Timeout: 20 * time.Millisecond},
+			})
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < calls; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("call %d: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a call outlived its timeout")
+		}
+	}
+	// the abandoned calls keep their slots, the others never started
+	if running, peak := f.inFlight(); running != DefaultLegacyCalls || peak != DefaultLegacyCalls {
+		t.Errorf("%d legacy calls running, %d at most, want %d", running, peak, DefaultLegacyCalls)
+	}
+	close(f.release)
+	trks, err := tf.FetchTracks(context.Background(), FetchTracksParams{Channel: "c1"})
+	if err != nil || len(trks) != 1 {
+		t.Errorf("after release: %+v, %v", trks, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for running, _ := f.inFlight(); running != 0; running, _ = f.inFlight() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d legacy calls still running", running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package usecase
+
+import (
+	"fmt"
+	"math"
+
+	"accu/tracks"
+)
+
+type Estimator string
+
+const (
+	// Chao1 estimates the catalog size from the number of tracks seen
+	// exactly once and exactly twice across all fetches.
+	Chao1 Estimator = "chao1"
+	// LincolnPetersen treats odd and even fetches as two capture occasions
+	// and uses Chapman's bias-corrected form of the estimator.
+	LincolnPetersen Estimator = "lincoln-petersen"
+)
+
+// Coverage is an estimate of how much of a channel's rotation has been seen.
+type Coverage struct {
+	Fetches  int
+	Observed int
+	Chao1    float64
+	Chapman  float64
+}
+
+func (c Coverage) Estimate(e Estimator) float64 {
+	if e == LincolnPetersen {
+		return c.Chapman
+	}
+	return c.Chao1
+}
+
+// Ratio returns observed tracks over the estimated catalog size, 0..1.
+func (c Coverage) Ratio(e Estimator) float64 {
+	est := c.Estimate(e)
+	if est <= 0 {
+		return 0
+	}
+	return math.Min(1, float64(c.Observed)/est)
+}
+
+func (c Coverage) String() string {
+	return fmt.Sprintf("observed %d tracks in %d fetches, estimated catalog chao1 %.0f (%.1f%%), lincoln-petersen %.0f (%.1f%%)",
+		c.Observed, c.Fetches,
+		c.Chao1, 100*c.Ratio(Chao1),
+		c.Chapman, 100*c.Ratio(LincolnPetersen),
+	)
+}
+
+type sighting struct {
+	count int
+	odd   bool
+	even  bool
+}
+
+// coverageTracker counts how often each track shows up in the repeated
+// playlist fetches of a single channel.
+type coverageTracker struct {
+	fetches int
+	seen    map[string]*sighting
+}
+
+func newCoverageTracker() *coverageTracker {
+	return &coverageTracker{
+		seen: map[string]*sighting{},
+	}
+}
+
+func (c *coverageTracker) observe(trcks []tracks.Track) {
+	c.fetches++
+	odd := c.fetches%2 == 1
+	inFetch := make(map[string]struct{}, len(trcks))
+	for _, t := range trcks {
+		key := t.ID
+		if _, ok := inFetch[key]; ok {
+			continue
+		}
+		inFetch[key] = struct{}{}
+		s, ok := c.seen[key]
+		if !ok {
+			s = &sighting{}
+			c.seen[key] = s
+		}
+		s.count++
+		if odd {
+			s.odd = true
+		} else {
+			s.even = true
+		}
+	}
+}
+
+func (c *coverageTracker) coverage() Coverage {
+	var f1, f2, n1, n2, m float64
+	for _, s := range c.seen {
+		switch s.count {
+		case 1:
+			f1++
+		case 2:
+			f2++
+		}
+		if s.odd {
+			n1++
+		}
+		if s.even {
+			n2++
+		}
+		if s.odd && s.even {
+			m++
+		}
+	}
+	observed := float64(len(c.seen))
+	return Coverage{
+		Fetches:  c.fetches,
+		Observed: len(c.seen),
+		Chao1:    observed + f1*(f1-1)/(2*(f2+1)),
+		Chapman:  (n1+1)*(n2+1)/(m+1) - 1,
+	}
+}
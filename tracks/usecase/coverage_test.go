@@ -0,0 +1,81 @@
+package usecase
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"accu/tracks"
+)
+
+func playlist(ids ...string) []tracks.Track {
+	trcks := make([]tracks.Track, len(ids))
+	for i, id := range ids {
+		trcks[i] = tracks.Track{ID: id, PrimaryLink: "https://cdn.example/" + id + ".m4a"}
+	}
+	return trcks
+}
+
+func TestCoverageEstimators(t *testing.T) {
+	c := newCoverageTracker()
+	c.observe(playlist("a", "b", "b"))
+	c.observe(playlist("a", "c"))
+	c.observe(playlist("d"))
+	got := c.coverage()
+	// a twice, b c d once: chao1 4 + 3*2/(2*(1+1)), odd fetches saw a b d,
+	// even ones a c: chapman (3+1)*(2+1)/(1+1) - 1
+	want := Coverage{Fetches: 3, Observed: 4, Chao1: 5.5, Chapman: 5}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if r := got.Ratio(Chao1); math.Abs(r-4/5.5) > 1e-9 {
+		t.Errorf("chao1 ratio %f", r)
+	}
+	if r := (Coverage{Observed: 10, Chao1: 8}).Ratio(Chao1); r != 1 {
+		t.Errorf("ratio %f above 1", r)
+	}
+	if r := (Coverage{}).Ratio(LincolnPetersen); r != 0 {
+		t.Errorf("ratio %f without an estimate", r)
+	}
+}
+
+// TestCoverageKnownPopulation samples playlists uniformly from rotations of
+// known sizes, both estimates should land close to the size once a good
+// share of the rotation was seen.
+func TestCoverageKnownPopulation(t *testing.T) {
+	for _, tc := range []struct {
+		size, playlist, fetches int
+	}{
+		{size: 50, playlist: 5, fetches: 15},
+		{size: 200, playlist: 10, fetches: 30},
+		{size: 1000, playlist: 20, fetches: 60},
+	} {
+		rnd := rand.New(rand.NewSource(1))
+		c := newCoverageTracker()
+		for i := 0; i < tc.fetches; i++ {
+			links := make([]string, tc.playlist)
+			for j, k := range rnd.Perm(tc.size)[:tc.playlist] {
+				links[j] = fmt.Sprint(k)
+			}
+			c.observe(playlist(links...))
+		}
+		cov := c.coverage()
+		for _, e := range []Estimator{Chao1, LincolnPetersen} {
+			if est := cov.Estimate(e); math.Abs(est-float64(tc.size)) > 0.2*float64(tc.size) {
+				t.Errorf("size %d: %s estimated %.0f from %s", tc.size, e, est, cov)
+			}
+		}
+	}
+}
+
+// TestCoverageByID checks a track served from another mirror is the same
+// sighting.
+func TestCoverageByID(t *testing.T) {
+	c := newCoverageTracker()
+	c.observe([]tracks.Track{{ID: "a", PrimaryLink: "https://cdn1.example/a.m4a"}})
+	c.observe([]tracks.Track{{ID: "a", PrimaryLink: "https://cdn2.example/x/a.m4a"}})
+	if got := c.coverage(); got.Observed != 1 || got.Chao1 != 1 {
+		t.Errorf("got %+v, want one track seen twice", got)
+	}
+}
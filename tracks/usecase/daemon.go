@@ -0,0 +1,353 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"accu/tracks"
+)
+
+// DaemonCfg controls the long-running ripping mode.
+type DaemonCfg struct {
+	// RediscoverInterval is how often the channel list is re-scraped.
+	RediscoverInterval time.Duration
+	// ReviveInterval is how long a channel stays dormant after its poller
+	// stopped before it is polled again.
+	ReviveInterval time.Duration
+	// MinRetryBackoff and MaxRetryBackoff bound the delay between
+	// attempts when channel discovery fails.
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+var DefaultDaemonCfg = DaemonCfg{
+	RediscoverInterval: 6 * time.Hour,
+	ReviveInterval:     24 * time.Hour,
+	MinRetryBackoff:    5 * time.Second,
+	MaxRetryBackoff:    10 * time.Minute,
+}
+
+func (c DaemonCfg) withDefaults() DaemonCfg {
+	if c.RediscoverInterval == 0 {
+		c.RediscoverInterval = DefaultDaemonCfg.RediscoverInterval
+	}
+	if c.ReviveInterval == 0 {
+		c.ReviveInterval = DefaultDaemonCfg.ReviveInterval
+	}
+	if c.MinRetryBackoff == 0 {
+		c.MinRetryBackoff = DefaultDaemonCfg.MinRetryBackoff
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = DefaultDaemonCfg.MaxRetryBackoff
+	}
+	if c.MaxRetryBackoff < c.MinRetryBackoff {
+		c.MaxRetryBackoff = c.MinRetryBackoff
+	}
+	return c
+}
+
+type channelWorker struct {
+	ch tracks.Channel
+	// token is the fencing token of the lease the worker polls under.
+	token     int64
+	cancel    context.CancelFunc
+	done      chan struct{}
+	stoppedAt time.Time
+}
+
+func (w *channelWorker) running() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+type daemon struct {
+	u       Usecase
+	b       *budget
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	workers map[string]*channelWorker
+	// channels are the discovered channels and held their leases, by data
+	// id, when the channels are leased.
+	channels map[string]tracks.Channel
+	held     map[string]int64
+}
+
+// Daemon rips channels until ctx is cancelled. Channels are re-discovered
+// every RediscoverInterval, pollers that stopped are revived after
+// ReviveInterval and every Cfg received from reload replaces the current
+// configuration, restarting running pollers. With WithLeases only the
+// channels leased to this ripper are polled, the leases are synced every
+// LeaseCfg.Interval and given up on shutdown.
+func (u Usecase) Daemon(ctx context.Context, reload <-chan Cfg) error {
+	d := &daemon{
+		u:        u,
+		b:        newBudget(u.cfg.Poll),
+		workers:  map[string]*channelWorker{},
+		channels: map[string]tracks.Channel{},
+	}
+	if u.leases != nil {
+		defer u.releaseLeases()
+	}
+	defer d.wg.Wait()
+	d.discover(ctx)
+	lastDiscovery := time.Now()
+	tick := time.NewTicker(d.tickInterval())
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			u.l.Print("daemon: shutting down")
+			return nil
+		case cfg, ok := <-reload:
+			if !ok {
+				reload = nil
+				continue
+			}
+			d.reload(ctx, cfg)
+			tick.Reset(d.tickInterval())
+		case <-tick.C:
+			if time.Since(lastDiscovery) >= d.u.cfg.Daemon.RediscoverInterval {
+				d.u.reportDrift()
+				d.discover(ctx)
+				lastDiscovery = time.Now()
+				continue
+			}
+			if d.u.leases != nil {
+				d.sync(ctx)
+				continue
+			}
+			d.revive(ctx)
+		}
+	}
+}
+
+func (d *daemon) tickInterval() time.Duration {
+	t := time.Minute
+	if i := d.u.cfg.Daemon.RediscoverInterval; i < t {
+		t = i
+	}
+	if i := d.u.cfg.Daemon.ReviveInterval; i < t {
+		t = i
+	}
+	if i := d.u.cfg.Leases.Interval; d.u.leases != nil && i < t {
+		t = i
+	}
+	return t
+}
+
+// discover fetches the channel list, retrying until it succeeds or ctx is done.
+func (d *daemon) discover(ctx context.Context) {
+	backoff := d.u.cfg.Daemon.MinRetryBackoff
+	for {
+		channels, err := d.fetchChannels(ctx)
+		if err == nil {
+			d.mu.Lock()
+			d.b = newBudget(d.u.cfg.Poll)
+			d.channels = make(map[string]tracks.Channel, len(channels))
+			for _, ch := range channels {
+				d.channels[ch.DataId] = ch
+			}
+			d.mu.Unlock()
+			if d.u.leases != nil {
+				d.sync(ctx)
+				return
+			}
+			for _, ch := range channels {
+				d.start(ctx, ch, false)
+			}
+			return
+		}
+		wait := backoff
+		if d, ok := tracks.RetryAfter(err); ok && d > wait {
+			wait = d
+		}
+		d.u.l.Printf("daemon: %v, retrying in %s", err, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return
+		}
+		backoff *= 2
+		if backoff > d.u.cfg.Daemon.MaxRetryBackoff {
+			backoff = d.u.cfg.Daemon.MaxRetryBackoff
+		}
+	}
+}
+
+func (d *daemon) fetchChannels(ctx context.Context) ([]tracks.Channel, error) {
+	handleErr := func(err error) ([]tracks.Channel, error) {
+		return nil, fmt.Errorf("discover channels: %w", err)
+	}
+	channels, err := d.u.cf.FetchChannels(ctx, tracks.FetchChannelsParams{
+		FetchOptions: d.u.cfg.Fetch,
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+	if len(channels) == 0 {
+		return handleErr(tracks.ErrNoChannels)
+	}
+	if err := d.u.r.SaveChannels(ctx, channels...); err != nil {
+		return handleErr(err)
+	}
+	return channels, nil
+}
+
+// revive starts the dormant channels again, those the last discovery no
+// longer returned are dropped.
+func (d *daemon) revive(ctx context.Context) {
+	d.mu.Lock()
+	dormant := make([]tracks.Channel, 0, len(d.workers))
+	for id, w := range d.workers {
+		if w.running() {
+			continue
+		}
+		ch, ok := d.channels[id]
+		if !ok {
+			d.u.l.Printf("daemon: channel %s - %s is gone from the site", w.ch.DataId, w.ch.Name)
+			delete(d.workers, id)
+			continue
+		}
+		dormant = append(dormant, ch)
+	}
+	d.mu.Unlock()
+	for _, ch := range dormant {
+		d.start(ctx, ch, false)
+	}
+}
+
+func (d *daemon) reload(ctx context.Context, cfg Cfg) {
+	d.mu.Lock()
+	d.u.cfg = cfg.withDefaults()
+	d.b = newBudget(d.u.cfg.Poll)
+	running := make([]tracks.Channel, 0, len(d.workers))
+	for id, w := range d.workers {
+		if !w.running() {
+			continue
+		}
+		w.cancel()
+		if ch, ok := d.channels[id]; ok {
+			running = append(running, ch)
+		}
+	}
+	d.mu.Unlock()
+	d.u.l.Print("daemon: configuration reloaded")
+	for _, ch := range running {
+		d.start(ctx, ch, true)
+	}
+}
+
+// sync renews the leases of the discovered channels. The pollers of the
+// channels leased to another ripper are stopped, those whose lease was
+// taken again with a new token are restarted and the channels leased to
+// this ripper are started.
+func (d *daemon) sync(ctx context.Context) {
+	d.mu.Lock()
+	ids := make([]string, 0, len(d.channels))
+	for id := range d.channels {
+		ids = append(ids, id)
+	}
+	d.mu.Unlock()
+	held, err := d.u.leases.Sync(ctx, ids)
+	if err != nil {
+		d.u.l.Printf("daemon: %v", err)
+		return
+	}
+	d.mu.Lock()
+	d.held = held
+	var restart, start []tracks.Channel
+	for id, w := range d.workers {
+		if token, ok := held[id]; !ok && w.running() {
+			d.u.l.Printf("daemon: channel %s - %s is leased to another ripper", w.ch.DataId, w.ch.Name)
+			w.cancel()
+		} else if ok && w.running() && token != w.token {
+			w.cancel()
+			restart = append(restart, w.ch)
+		}
+	}
+	for id := range held {
+		if ch, ok := d.channels[id]; ok {
+			start = append(start, ch)
+		}
+	}
+	d.mu.Unlock()
+	for _, ch := range restart {
+		d.start(ctx, ch, true)
+	}
+	for _, ch := range start {
+		d.start(ctx, ch, false)
+	}
+}
+
+// start launches a poller for ch unless one is running or ch is still dormant.
+// force ignores dormancy and waits for the previous poller to exit. With
+// leases ch must be held, a poller stopped under an older lease is not
+// dormant.
+func (d *daemon) start(ctx context.Context, ch tracks.Channel, force bool) {
+	d.mu.Lock()
+	token, due := d.due(ch, force)
+	d.mu.Unlock()
+	if !due {
+		return
+	}
+	// selected reads the repo, so it is asked without holding d.mu. The
+	// workers and leases only change on the daemon goroutine that calls
+	// start, they are the same once d.mu is taken again.
+	if ok, err := d.u.selected(ctx, ch); err != nil {
+		d.u.l.Printf("daemon: %v", err)
+		return
+	} else if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev := d.workers[ch.DataId]
+	w := &channelWorker{
+		ch:    ch,
+		token: token,
+		done:  make(chan struct{}),
+	}
+	workerCtx := ctx
+	if d.u.leases != nil {
+		workerCtx = tracks.WithFence(ctx, tracks.Fence{Channel: ch.DataId, Token: token})
+	}
+	workerCtx, w.cancel = context.WithCancel(workerCtx)
+	d.workers[ch.DataId] = w
+	u, b := d.u, d.b
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer w.cancel()
+		if prev != nil {
+			<-prev.done
+		}
+		u.ripChannel(workerCtx, ch, b)
+		d.mu.Lock()
+		w.stoppedAt = time.Now()
+		close(w.done)
+		d.mu.Unlock()
+	}()
+}
+
+// due reports whether a poller for ch is to be started, and under which
+// lease token. d.mu must be held.
+func (d *daemon) due(ch tracks.Channel, force bool) (int64, bool) {
+	var token int64
+	if d.u.leases != nil {
+		var held bool
+		if token, held = d.held[ch.DataId]; !held {
+			return 0, false
+		}
+	}
+	w, ok := d.workers[ch.DataId]
+	if ok && !force {
+		if w.running() || w.token == token && time.Since(w.stoppedAt) < d.u.cfg.Daemon.ReviveInterval {
+			return 0, false
+		}
+	}
+	return token, true
+}
@@ -0,0 +1,221 @@
+package usecase_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"accu/drivers/fakeaccu"
+	"accu/tracks/usecase"
+)
+
+// logBuffer collects the usecase log for the daemon tests.
+type logBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *logBuffer) count(s string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Count(l.b.String(), s)
+}
+
+// categoryPages counts the category page requests and fails the first
+// fail of them with a 503.
+type categoryPages struct {
+	next http.RoundTripper
+	mu   sync.Mutex
+	fail int
+	n    int
+}
+
+func (c *categoryPages) wrap(rt http.RoundTripper) http.RoundTripper {
+	c.next = rt
+	return c
+}
+
+func (c *categoryPages) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != fakeaccu.CategoryPath {
+		return c.next.RoundTrip(req)
+	}
+	c.mu.Lock()
+	c.n++
+	fail := c.n <= c.fail
+	c.mu.Unlock()
+	if fail {
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	return c.next.RoundTrip(req)
+}
+
+func (c *categoryPages) requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// daemon runs the daemon of e until the test ends.
+func (e env) daemon(t *testing.T, reload <-chan usecase.Cfg) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- e.u.Daemon(ctx, reload)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("daemon: %v", err)
+		}
+	})
+}
+
+func started(ch string) string {
+	return "started fetching tracks for channel " + ch
+}
+
+func exited(ch string) string {
+	return "exit fetching tracks for channel " + ch
+}
+
+func TestDaemonDiscoveryRetry(t *testing.T) {
+	pages := &categoryPages{fail: 2}
+	l := &logBuffer{}
+	e := newEnv(t, envCfg{
+		transport: pages.wrap,
+		log:       l,
+		tune: func(cfg *usecase.Cfg) {
+			cfg.Daemon = usecase.DaemonCfg{
+				RediscoverInterval: time.Hour,
+				ReviveInterval:     time.Hour,
+				MinRetryBackoff:    time.Millisecond,
+				MaxRetryBackoff:    5 * time.Millisecond,
+			}
+		},
+	})
+	e.daemon(t, nil)
+	waitFor(t, "every track", func() bool {
+		return len(e.storedTracks(t)) == 11
+	})
+	if n := pages.requests(); n != 3 {
+		t.Errorf("%d category requests, want 3", n)
+	}
+	if n := l.count("retrying in"); n != 2 {
+		t.Errorf("%d retries logged, want 2", n)
+	}
+}
+
+func TestDaemonRevive(t *testing.T) {
+	pages := &categoryPages{}
+	l := &logBuffer{}
+	e := newEnv(t, envCfg{
+		transport: pages.wrap,
+		log:       l,
+		tune: func(cfg *usecase.Cfg) {
+			cfg.Daemon = usecase.DaemonCfg{
+				RediscoverInterval: 50 * time.Millisecond,
+				ReviveInterval:     20 * time.Millisecond,
+			}
+		},
+	})
+	e.daemon(t, nil)
+	waitFor(t, "both channels revived", func() bool {
+		return l.count(started("5a1b")) >= 2 && l.count(started("5c2d")) >= 2
+	})
+
+	// Shoegaze is gone from the site, its poller stops on the 404s and
+	// the next rediscoveries no longer return it
+	e.srv.SetChannels([]fakeaccu.Channel{
+		{DataId: "5a1b", OldId: 101, Name: "Indie & Alt", Rotation: rotation("indie", 6)},
+	})
+	n := pages.requests()
+	waitFor(t, "two rediscoveries", func() bool {
+		return pages.requests() >= n+2
+	})
+	waitFor(t, "the shoegaze poller to stop", func() bool {
+		return l.count(exited("5c2d")) == l.count(started("5c2d"))
+	})
+	shoegaze, indie := l.count(started("5c2d")), l.count(started("5a1b"))
+	time.Sleep(150 * time.Millisecond)
+	if n := l.count(started("5c2d")); n != shoegaze {
+		t.Errorf("shoegaze revived %d times after it was gone", n-shoegaze)
+	}
+	if l.count(started("5a1b")) == indie {
+		t.Error("indie no longer revived")
+	}
+	if l.count("5c2d - Shoegaze is gone from the site") != 1 {
+		t.Error("dropped channel not logged")
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	l := &logBuffer{}
+	e := newEnv(t, envCfg{
+		log: l,
+		tune: func(cfg *usecase.Cfg) {
+			// the pollers keep running until they are cancelled
+			cfg.Stop = usecase.StopCfg{MaxEmptyFetches: -1, TargetCoverage: -1}
+			cfg.Daemon = usecase.DaemonCfg{
+				RediscoverInterval: time.Hour,
+				ReviveInterval:     time.Hour,
+			}
+		},
+	})
+	reload := make(chan usecase.Cfg)
+	e.daemon(t, reload)
+	waitFor(t, "both channels", func() bool {
+		return l.count(started("5a1b")) == 1 && l.count(started("5c2d")) == 1
+	})
+
+	cfg := e.cfg
+	cfg.Select = usecase.SelectCfg{
+		Exclude: []usecase.ChannelRule{{DataId: "5c2d"}},
+	}
+	reload <- cfg
+	waitFor(t, "the pollers restarted", func() bool {
+		return l.count("configuration reloaded") == 1 &&
+			l.count(started("5a1b")) == 2 && l.count(exited("5c2d")) == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := l.count(started("5c2d")); n != 1 {
+		t.Errorf("excluded channel started %d times", n)
+	}
+	if n := l.count(exited("5a1b")); n != 1 {
+		t.Errorf("indie exited %d times, want only the reload", n)
+	}
+
+	// a closed reload channel leaves the daemon running
+	close(reload)
+	time.Sleep(20 * time.Millisecond)
+	if n := l.count(exited("5a1b")); n != 1 {
+		t.Errorf("indie exited %d times after the reload channel closed", n)
+	}
+}
@@ -0,0 +1,62 @@
+package usecase
+
+import (
+	"sort"
+	"sync"
+
+	"accu/tracks"
+)
+
+// driftMonitor logs the fetcher's schema drift whenever a field drifts
+// that was not reported before, so API changes show up early in the logs.
+type driftMonitor struct {
+	mu     sync.Mutex
+	logged map[string]struct{}
+}
+
+func newDriftMonitor() *driftMonitor {
+	return &driftMonitor{
+		logged: map[string]struct{}{},
+	}
+}
+
+func (u Usecase) checkDrift() {
+	dr, ok := u.tf.(tracks.DriftReporter)
+	if !ok {
+		return
+	}
+	r := dr.DriftReport()
+	var fresh []string
+	u.drift.mu.Lock()
+	for kind, fields := range map[string]map[string]int{
+		"unknown field": r.UnknownFields,
+		"type mismatch": r.TypeMismatches,
+		"missing field": r.MissingFields,
+	} {
+		for f := range fields {
+			key := kind + " " + f
+			if _, ok := u.drift.logged[key]; ok {
+				continue
+			}
+			u.drift.logged[key] = struct{}{}
+			fresh = append(fresh, key)
+		}
+	}
+	u.drift.mu.Unlock()
+	if len(fresh) == 0 {
+		return
+	}
+	sort.Strings(fresh)
+	u.l.Printf("playlist schema drift: new %v; totals: %s", fresh, r)
+}
+
+// reportDrift logs the fetcher's drift totals if there are any.
+func (u Usecase) reportDrift() {
+	dr, ok := u.tf.(tracks.DriftReporter)
+	if !ok {
+		return
+	}
+	if r := dr.DriftReport(); r.Drifted() {
+		u.l.Printf("playlist schema drift: %s", r)
+	}
+}
@@ -0,0 +1,706 @@
+package usecase_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"accu/drivers/cassette"
+	"accu/drivers/channelfetcher"
+	"accu/drivers/fakeaccu"
+	"accu/drivers/faults"
+	"accu/drivers/fetcher"
+	"accu/drivers/repo"
+	"accu/tracks"
+	"accu/tracks/usecase"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func rotation(channel string, n int) []fakeaccu.Song {
+	songs := make([]fakeaccu.Song, 0, n)
+	for i := 0; i < n; i++ {
+		songs = append(songs, fakeaccu.Song{
+			Artist:   fmt.Sprintf("%s artist %d", channel, i),
+			Album:    fmt.Sprintf("%s album %d", channel, i),
+			Title:    fmt.Sprintf("%s title %d", channel, i),
+			Year:     2000 + i,
+			Duration: 180.5,
+			Fn:       fmt.Sprintf("%s-%d", channel, i),
+		})
+	}
+	return songs
+}
+
+type env struct {
+	srv  *fakeaccu.Server
+	repo *repo.Sqlite
+	dir  string
+	cfg  usecase.Cfg
+	u    usecase.Usecase
+}
+
+type envCfg struct {
+	shuffle bool
+	hedge   time.Duration
+	faults  []func(srv *fakeaccu.Server) faults.Rule
+	// shared songs are in the rotation of both channels.
+	shared []fakeaccu.Song
+	// wrap replaces the repo seen by the usecase.
+	wrap func(r *repo.Sqlite) tracks.Repo
+	// transport wraps the round tripper of every upstream request.
+	transport func(rt http.RoundTripper) http.RoundTripper
+	// tune changes the usecase configuration.
+	tune func(cfg *usecase.Cfg)
+	// log receives the usecase log, it is discarded by default.
+	log io.Writer
+	// srv is the upstream of an earlier env, a new one is started by default.
+	srv *fakeaccu.Server
+}
+
+func newEnv(t *testing.T, cfg envCfg) env {
+	t.Helper()
+	srv := cfg.srv
+	if srv == nil {
+		srv = fakeaccu.NewServer(fakeaccu.Cfg{
+			Channels: []fakeaccu.Channel{
+				{DataId: "5a1b", OldId: 101, Name: "Indie & Alt", Rotation: append(rotation("indie", 6), cfg.shared...)},
+				{DataId: "5c2d", OldId: 102, Name: "Shoegaze", Rotation: append(rotation("shoegaze", 5), cfg.shared...)},
+			},
+			PlaylistSize: 3,
+			Shuffle:      cfg.shuffle,
+			Seed:         1,
+		})
+		t.Cleanup(srv.Close)
+	}
+	tmp := t.TempDir()
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&cache=shared", filepath.Join(tmp, "accu.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	r := repo.NewSqlite(db)
+	if err := r.Create(); err != nil {
+		t.Fatal(err)
+	}
+	var rt http.RoundTripper = http.DefaultTransport
+	if len(cfg.faults) > 0 {
+		fcfg := faults.Cfg{Seed: 1}
+		for _, rule := range cfg.faults {
+			fcfg.Rules = append(fcfg.Rules, rule(srv))
+		}
+		rt = faults.New(rt, fcfg)
+	}
+	if cfg.transport != nil {
+		rt = cfg.transport(rt)
+	}
+	dir := filepath.Join(tmp, "downloads")
+	var ur tracks.Repo = r
+	if cfg.wrap != nil {
+		ur = cfg.wrap(r)
+	}
+	ucfg := usecase.Cfg{
+		DownloadsRootDir: dir,
+		Poll: usecase.PollCfg{
+			MinInterval: time.Millisecond,
+			MaxInterval: 5 * time.Millisecond,
+		},
+		Stop: usecase.StopCfg{
+			MaxEmptyFetches: 8,
+			TargetCoverage:  -1,
+		},
+		Download: usecase.DownloadCfg{
+			Hedge: cfg.hedge,
+		},
+		Leases: usecase.LeaseCfg{
+			Interval: 10 * time.Millisecond,
+		},
+		Fetch: tracks.FetchOptions{
+			Timeout: 5 * time.Second,
+		},
+	}
+	if cfg.tune != nil {
+		cfg.tune(&ucfg)
+	}
+	if cfg.log == nil {
+		cfg.log = io.Discard
+	}
+	l := log.New(cfg.log, "", 0)
+	u := usecase.New(ucfg,
+		rt,
+		fetcher.NewTrackListFetcher(rt, fetcher.Cfg{BaseURI: srv.PlaylistURI()}),
+		channelfetcher.NewChannelFetcher(rt, channelfetcher.Cfg{BaseURI: srv.CategoryURI(), Categories: r}, l),
+		ur,
+		l,
+	)
+	return env{
+		srv:  srv,
+		repo: r,
+		dir:  dir,
+		cfg:  ucfg,
+		u:    u,
+	}
+}
+
+func (e env) run(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := e.u.Rip(ctx); err != nil {
+		t.Fatalf("rip: %v", err)
+	}
+	if err := e.u.Save(ctx); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+}
+
+func (e env) storedTracks(t *testing.T) []tracks.Track {
+	t.Helper()
+	var ts []tracks.Track
+	if err := e.repo.GetAllTracks(context.Background(), func(ctx context.Context, tr tracks.Track) error {
+		ts = append(ts, tr)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func (e env) files(t *testing.T, pattern string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(e.dir, "*", pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func (e env) assertComplete(t *testing.T) {
+	t.Helper()
+	ts := e.storedTracks(t)
+	if len(ts) != 11 {
+		t.Fatalf("stored %d tracks, want 11", len(ts))
+	}
+	payloads := map[string][]byte{}
+	for _, tr := range ts {
+		payloads[trackFile(tr)] = fakeaccu.M4A(strings.TrimSuffix(path.Base(tr.PrimaryLink), ".m4a"))
+	}
+	files := e.files(t, "*.m4a")
+	if len(files) != len(ts) {
+		t.Fatalf("downloaded %d files, want %d", len(files), len(ts))
+	}
+	for _, f := range files {
+		if dir := filepath.Base(filepath.Dir(f)); dir != "Indie & Alt" && dir != "Shoegaze" {
+			t.Errorf("%s is not in the folder of a channel name", f)
+		}
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) < 8 || !bytes.Equal(raw[4:8], []byte("ftyp")) {
+			t.Errorf("%s is not an m4a file", f)
+		}
+		if !bytes.Equal(raw, payloads[filepath.Base(f)]) {
+			t.Errorf("%s differs from the served payload", f)
+		}
+	}
+	e.assertNoPartial(t)
+}
+
+func (e env) assertNoPartial(t *testing.T) {
+	t.Helper()
+	if parts := e.files(t, "*.part"); len(parts) > 0 {
+		t.Errorf("partial downloads left behind: %v", parts)
+	}
+}
+
+func trackFile(t tracks.Track) string {
+	return fmt.Sprintf("%s_-_%s_-_%d_-_%s.m4a", t.Artist, t.Album, t.Year, t.Title)
+}
+
+func TestRipSave(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	e.run(t)
+	e.assertComplete(t)
+	ts := e.storedTracks(t)
+	for _, tr := range ts {
+		if tr.Year < 2000 || tr.Duration != 180 || tr.SecondaryLink == tr.PrimaryLink {
+			t.Errorf("unexpected track %+v", tr)
+		}
+	}
+	chs, err := e.repo.GetChannelsByCategory(context.Background(), "indie-rock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 2 {
+		t.Errorf("unexpected channels %+v", chs)
+	}
+}
+
+// disabledErrRepo fails to tell whether a channel is enabled.
+type disabledErrRepo struct {
+	*repo.Sqlite
+	dataId string
+}
+
+func (r disabledErrRepo) IsChannelEnabled(ctx context.Context, dataId string) (bool, error) {
+	if dataId == r.dataId {
+		return false, errors.New("enabled flag unreadable")
+	}
+	return r.Sqlite.IsChannelEnabled(ctx, dataId)
+}
+
+// TestRipSelectError checks that no poller is left running when selecting
+// a later channel fails.
+func TestRipSelectError(t *testing.T) {
+	e := newEnv(t, envCfg{
+		wrap: func(r *repo.Sqlite) tracks.Repo {
+			return disabledErrRepo{r, "5c2d"}
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.u.Rip(ctx); err == nil {
+		t.Fatal("rip succeeded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := e.srv.Requests("site"); n != 0 {
+		t.Errorf("%d playlists fetched after rip failed", n)
+	}
+}
+
+// savesRepo counts the tracks saved.
+type savesRepo struct {
+	*repo.Sqlite
+	mu    *sync.Mutex
+	saved map[string]int
+}
+
+func (r savesRepo) SaveTracks(ctx context.Context, trks ...tracks.Track) error {
+	r.mu.Lock()
+	for _, t := range trks {
+		r.saved[t.ID]++
+	}
+	r.mu.Unlock()
+	return r.Sqlite.SaveTracks(ctx, trks...)
+}
+
+// TestRipSavesOnce checks that the tracks played again are not saved again.
+func TestRipSavesOnce(t *testing.T) {
+	saves := savesRepo{mu: &sync.Mutex{}, saved: map[string]int{}}
+	e := newEnv(t, envCfg{
+		wrap: func(r *repo.Sqlite) tracks.Repo {
+			saves.Sqlite = r
+			return saves
+		},
+	})
+	e.run(t)
+	e.assertComplete(t)
+	if n := e.srv.Requests("site"); n < 2*8 {
+		t.Fatalf("%d playlist requests, the rotations were not played again", n)
+	}
+	for id, n := range saves.saved {
+		if n != 1 {
+			t.Errorf("%s saved %d times", id, n)
+		}
+	}
+}
+
+func TestRipSaveShuffled(t *testing.T) {
+	e := newEnv(t, envCfg{shuffle: true})
+	e.run(t)
+	e.assertComplete(t)
+}
+
+func TestRipSaveUpstreamFaults(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	e.srv.SetFaults("site", fakeaccu.Faults{
+		RateLimitEvery:   3,
+		ServerErrorEvery: 4,
+	})
+	e.srv.SetFaults("primary", fakeaccu.Faults{
+		ServerErrorEvery: 2,
+		SlowBody:         time.Millisecond,
+	})
+	e.run(t)
+	e.assertComplete(t)
+	if e.srv.Requests("secondary") == 0 {
+		t.Error("secondary host was never used")
+	}
+}
+
+// TestRipPermanentErrors checks that a channel outlives a few permanent
+// errors and stops after MaxPermanentErrors of them in a row.
+func TestRipPermanentErrors(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	// fewer than MaxPermanentErrors in a row, whatever channels get them
+	e.srv.SetFaults("site", fakeaccu.Faults{NotFoundFirst: usecase.DefaultStopCfg.MaxPermanentErrors - 1})
+	e.run(t)
+	e.assertComplete(t)
+
+	e = newEnv(t, envCfg{})
+	e.srv.SetFaults("site", fakeaccu.Faults{NotFoundFirst: 1000})
+	e.run(t)
+	if n, want := e.srv.Requests("site"), 2*usecase.DefaultStopCfg.MaxPermanentErrors; n != want {
+		t.Errorf("%d playlist requests, want %d", n, want)
+	}
+	if ts := e.storedTracks(t); len(ts) > 0 {
+		t.Errorf("stored %d tracks of missing playlists", len(ts))
+	}
+}
+
+func TestRipSaveSchemaChange(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	e.srv.SetFaults("site", fakeaccu.Faults{SchemaChange: true})
+	e.run(t)
+	e.assertComplete(t)
+}
+
+func TestSaveTruncatedAudio(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	e.srv.SetFaults("primary", fakeaccu.Faults{Truncate: true})
+	e.run(t)
+	e.assertComplete(t)
+
+	e = newEnv(t, envCfg{})
+	e.srv.SetFaults("primary", fakeaccu.Faults{Truncate: true})
+	e.srv.SetFaults("secondary", fakeaccu.Faults{Truncate: true})
+	e.run(t)
+	if files := e.files(t, "*.m4a"); len(files) > 0 {
+		t.Errorf("truncated downloads saved: %v", files)
+	}
+	e.assertNoPartial(t)
+}
+
+// TestRipSaveCassette replays a recorded run with truncated audio bodies,
+// the replayed downloads fail like the recorded ones and the tracks are
+// taken from the secondary host.
+func TestRipSaveCassette(t *testing.T) {
+	dir := t.TempDir()
+	rec := newEnv(t, envCfg{
+		transport: func(rt http.RoundTripper) http.RoundTripper {
+			r, err := cassette.NewRecorder(rt, cassette.RecorderCfg{Dir: dir, RecordAudio: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		},
+	})
+	rec.srv.SetFaults("primary", fakeaccu.Faults{Truncate: true})
+	rec.run(t)
+	rec.assertComplete(t)
+	rec.srv.Close()
+
+	e := newEnv(t, envCfg{
+		srv: rec.srv,
+		transport: func(http.RoundTripper) http.RoundTripper {
+			r, err := cassette.NewReplayer(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		},
+		tune: func(cfg *usecase.Cfg) {
+			// replays are no samples, the channels stop on the fetch count
+			cfg.Stop.MaxFetches = 50
+		},
+	})
+	e.run(t)
+	e.assertComplete(t)
+}
+
+func host(s *httptest.Server) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(strings.TrimPrefix(s.URL, "http://")) + "$")
+}
+
+func TestRipSaveInjectedFaults(t *testing.T) {
+	playlist := regexp.MustCompile("^" + regexp.QuoteMeta(fakeaccu.PlaylistPath))
+	e := newEnv(t, envCfg{faults: []func(*fakeaccu.Server) faults.Rule{
+		func(srv *fakeaccu.Server) faults.Rule {
+			return faults.Rule{Host: host(srv.Site), Path: playlist, Probability: 0.2, Reset: true}
+		},
+		func(srv *fakeaccu.Server) faults.Rule {
+			return faults.Rule{Host: host(srv.Site), Path: playlist, Probability: 0.2, Status: http.StatusBadGateway, Latency: time.Millisecond}
+		},
+		func(srv *fakeaccu.Server) faults.Rule {
+			return faults.Rule{Host: host(srv.Primary), Probability: 0.5, PartialBody: 0.5}
+		},
+		func(srv *fakeaccu.Server) faults.Rule {
+			return faults.Rule{Host: host(srv.Primary), Probability: 0.3, Reset: true}
+		},
+	}})
+	e.run(t)
+	e.assertComplete(t)
+}
+
+func TestSaveHedged(t *testing.T) {
+	e := newEnv(t, envCfg{
+		hedge: 20 * time.Millisecond,
+		faults: []func(*fakeaccu.Server) faults.Rule{
+			func(srv *fakeaccu.Server) faults.Rule {
+				return faults.Rule{Host: host(srv.Primary), Probability: 1, Latency: 2 * time.Second}
+			},
+		},
+	})
+	e.run(t)
+	e.assertComplete(t)
+	// the primary requests are held back by the fault until the hedges won
+	// and cancelled them, so they never reach the server
+	if n := e.srv.Requests("primary"); n != 0 {
+		t.Errorf("primary served %d downloads, want the secondary to win every race", n)
+	}
+	if n, want := e.srv.Requests("secondary"), len(e.storedTracks(t)); n != want {
+		t.Errorf("secondary served %d downloads, want %d", n, want)
+	}
+}
+
+func TestRipSaveSharedTrack(t *testing.T) {
+	shared := rotation("both", 1)
+	e := newEnv(t, envCfg{shared: shared})
+	e.run(t)
+	ts := e.storedTracks(t)
+	if len(ts) != 12 {
+		t.Fatalf("stored %d tracks, want 12", len(ts))
+	}
+	var files []string
+	for _, tr := range ts {
+		if tr.ID == shared[0].Fn {
+			if len(tr.Channels) != 2 {
+				t.Errorf("shared track seen on %+v, want both channels", tr.Channels)
+			}
+			files = e.files(t, trackFile(tr))
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("shared track saved as %v, want a file per channel", files)
+	}
+	a, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Errorf("%s and %s are separate copies", files[0], files[1])
+	}
+	if got := len(e.files(t, "*.m4a")); got != 13 {
+		t.Errorf("%d files, want 13", got)
+	}
+}
+
+// memQueue hands deliveries out in publish order, failed ones go back to the
+// end until they were delivered twice. settled is closed once every
+// published track was acked or dropped.
+type memQueue struct {
+	mu        sync.Mutex
+	pending   []tracks.Delivery
+	published int
+	acked     int
+	dropped   int
+	settled   chan struct{}
+}
+
+func (q *memQueue) Publish(ctx context.Context, trks ...tracks.Track) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, tr := range trks {
+		q.published++
+		q.pending = append(q.pending, tracks.Delivery{ID: fmt.Sprint(q.published), Track: tr})
+	}
+	return nil
+}
+
+func (q *memQueue) Receive(ctx context.Context, consumer string, n int) ([]tracks.Delivery, error) {
+	q.mu.Lock()
+	if len(q.pending) < n {
+		n = len(q.pending)
+	}
+	ds := q.pending[:n:n]
+	q.pending = q.pending[n:]
+	q.mu.Unlock()
+	for i := range ds {
+		ds[i].Deliveries++
+	}
+	if len(ds) == 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return ds, nil
+}
+
+func (q *memQueue) Ack(ctx context.Context, d tracks.Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked++
+	q.settle()
+	return nil
+}
+
+func (q *memQueue) Fail(ctx context.Context, d tracks.Delivery, reason error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d.Deliveries < 2 {
+		q.pending = append(q.pending, d)
+		return nil
+	}
+	q.dropped++
+	q.settle()
+	return nil
+}
+
+func (q *memQueue) settle() {
+	if q.acked+q.dropped == q.published {
+		close(q.settled)
+	}
+}
+
+func (e env) work(t *testing.T, q *memQueue) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	u := e.u.WithQueue(q)
+	if err := u.Rip(ctx); err != nil {
+		t.Fatalf("rip: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- u.Work(ctx, "test")
+	}()
+	select {
+	case <-q.settled:
+	case <-ctx.Done():
+		t.Error("queue not settled")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("work: %v", err)
+	}
+}
+
+func TestRipWork(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	q := &memQueue{settled: make(chan struct{})}
+	e.work(t, q)
+	if q.published != 11 || q.acked != 11 {
+		t.Errorf("published %d, acked %d, want 11", q.published, q.acked)
+	}
+	e.assertComplete(t)
+
+	e = newEnv(t, envCfg{})
+	e.srv.SetFaults("primary", fakeaccu.Faults{Truncate: true})
+	e.srv.SetFaults("secondary", fakeaccu.Faults{Truncate: true})
+	q = &memQueue{settled: make(chan struct{})}
+	e.work(t, q)
+	if q.acked != 0 || q.dropped != 11 {
+		t.Errorf("acked %d, dropped %d of truncated downloads, want 0 and 11", q.acked, q.dropped)
+	}
+	if files := e.files(t, "*.m4a"); len(files) > 0 {
+		t.Errorf("truncated downloads saved: %v", files)
+	}
+	e.assertNoPartial(t)
+}
+
+// TestRipWorkSharedTrack checks that a track published for each of its
+// channels is downloaded once and linked into the other channel.
+func TestRipWorkSharedTrack(t *testing.T) {
+	shared := rotation("both", 1)
+	e := newEnv(t, envCfg{shared: shared})
+	q := &memQueue{settled: make(chan struct{})}
+	e.work(t, q)
+	if q.published != 13 || q.acked != 13 {
+		t.Errorf("published %d, acked %d, want 13", q.published, q.acked)
+	}
+	if n := e.srv.Requests("primary") + e.srv.Requests("secondary"); n != 12 {
+		t.Errorf("%d downloads, want 12", n)
+	}
+	files := e.files(t, trackFile(tracks.Track{
+		Artist: shared[0].Artist,
+		Album:  shared[0].Album,
+		Year:   shared[0].Year,
+		Title:  shared[0].Title,
+	}))
+	if len(files) != 2 {
+		t.Fatalf("shared track saved as %v, want a file per channel", files)
+	}
+	a, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Errorf("%s and %s are separate copies", files[0], files[1])
+	}
+}
+
+// memLeases returns the leases of syncs in turn, the last ones for good.
+type memLeases struct {
+	mu       sync.Mutex
+	syncs    []map[string]int64
+	released bool
+}
+
+func (l *memLeases) Sync(ctx context.Context, channels []string) (map[string]int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held := l.syncs[0]
+	if len(l.syncs) > 1 {
+		l.syncs = l.syncs[1:]
+	}
+	return held, nil
+}
+
+func (l *memLeases) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	return nil
+}
+
+func TestRipLeased(t *testing.T) {
+	e := newEnv(t, envCfg{})
+	// another ripper holds 5c2d until it dies and its lease expires
+	l := &memLeases{syncs: []map[string]int64{
+		{"5a1b": 1},
+		{"5a1b": 1},
+		{"5a1b": 1, "5c2d": 2},
+	}}
+	e.u = e.u.WithLeases(l)
+	e.run(t)
+	e.assertComplete(t)
+	if !l.released {
+		t.Error("leases not released")
+	}
+
+	e = newEnv(t, envCfg{})
+	e.u = e.u.WithLeases(&memLeases{syncs: []map[string]int64{{"5c2d": 1}}})
+	e.run(t)
+	for _, tr := range e.storedTracks(t) {
+		if !strings.HasPrefix(tr.Artist, "shoegaze") {
+			t.Errorf("ripped %s of a channel leased to another ripper", tr.Artist)
+		}
+	}
+	if files := e.files(t, "*.m4a"); len(files) != 5 {
+		t.Errorf("downloaded %d files, want 5", len(files))
+	}
+}
@@ -0,0 +1,47 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+
+	"accu/tracks"
+)
+
+// channelFolders names the download folders after the channels, the repos
+// keep the channel of a track by data id. A channel the repo doesn't list
+// gets a folder named after its data id.
+type channelFolders struct {
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func newChannelFolders() *channelFolders {
+	return &channelFolders{names: map[string]string{}}
+}
+
+// load reads the channel names from r when it lists the channels.
+func (f *channelFolders) load(ctx context.Context, r tracks.Repo) error {
+	qr, ok := r.(tracks.QueryRepo)
+	if !ok {
+		return nil
+	}
+	chs, err := qr.GetChannels(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ch := range chs {
+		f.names[ch.DataId] = ch.Name
+	}
+	return nil
+}
+
+func (f *channelFolders) name(dataId string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if name, ok := f.names[dataId]; ok {
+		return name
+	}
+	return dataId
+}
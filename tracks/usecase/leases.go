@@ -0,0 +1,126 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"accu/tracks"
+)
+
+// LeaseCfg controls the channel leases of WithLeases.
+type LeaseCfg struct {
+	// Interval is how often the leases are renewed and rebalanced, it must
+	// be well below their TTL.
+	Interval time.Duration
+}
+
+var DefaultLeaseCfg = LeaseCfg{
+	Interval: 10 * time.Second,
+}
+
+func (c LeaseCfg) withDefaults() LeaseCfg {
+	if c.Interval == 0 {
+		c.Interval = DefaultLeaseCfg.Interval
+	}
+	return c
+}
+
+// releaseTimeout bounds giving the leases up once ctx is done.
+const releaseTimeout = 10 * time.Second
+
+// WithLeases shares the channels with the other rippers holding leases from
+// l, Rip and Daemon only poll the channels leased to this ripper. The track
+// writes of a poller are fenced by the token of its lease, the poller stops
+// once its lease was taken over.
+func (u Usecase) WithLeases(l tracks.ChannelLeases) Usecase {
+	u.leases = l
+	return u
+}
+
+func (u Usecase) releaseLeases() {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := u.leases.Release(ctx); err != nil {
+		u.l.Print(err)
+	}
+}
+
+type leasedPoller struct {
+	token  int64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ripLeased polls the channels leased to this ripper among channels, the
+// leases are renewed every Interval. A channel leased meanwhile is polled
+// too, so the channels of a ripper that died are taken over, and a poller
+// whose lease was lost is cancelled. It returns once no poller is running,
+// after two intervals at least so that the rippers that were running
+// before release the channels assigned to this one.
+func (u Usecase) ripLeased(ctx context.Context, channels []tracks.Channel, b *budget) {
+	defer u.releaseLeases()
+	ids := make([]string, len(channels))
+	byID := make(map[string]tracks.Channel, len(channels))
+	for i, ch := range channels {
+		ids[i] = ch.DataId
+		byID[ch.DataId] = ch
+	}
+	pollers := map[string]*leasedPoller{}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	began := time.Now()
+	tick := time.NewTicker(u.cfg.Leases.Interval)
+	defer tick.Stop()
+	for {
+		held, err := u.leases.Sync(ctx, ids)
+		if err != nil {
+			u.l.Print(err)
+		} else {
+			for id, p := range pollers {
+				if token, ok := held[id]; !ok || token != p.token {
+					p.cancel()
+				}
+			}
+			for id, token := range held {
+				prev, ok := pollers[id]
+				if ok && prev.token == token {
+					continue
+				}
+				p := &leasedPoller{
+					token: token,
+					done:  make(chan struct{}),
+				}
+				var pollerCtx context.Context
+				pollerCtx, p.cancel = context.WithCancel(tracks.WithFence(ctx, tracks.Fence{Channel: id, Token: token}))
+				pollers[id] = p
+				wg.Add(1)
+				go func(ch tracks.Channel, p, prev *leasedPoller) {
+					defer wg.Done()
+					defer close(p.done)
+					defer p.cancel()
+					if prev != nil {
+						<-prev.done
+					}
+					u.ripChannel(pollerCtx, ch, b)
+				}(byID[id], p, prev)
+			}
+		}
+		running := false
+		for _, p := range pollers {
+			select {
+			case <-p.done:
+			default:
+				running = true
+			}
+		}
+		if !running && time.Since(began) >= 2*u.cfg.Leases.Interval {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DownloadCfg struct {
+	// Hedge starts the next mirror when the current one has not produced
+	// any bytes after this long, the slower one is cancelled. 0 disables hedging.
+	Hedge time.Duration
+	// Smoothing is the weight of the latest sample in the mirror health averages.
+	Smoothing float64
+}
+
+var DefaultDownloadCfg = DownloadCfg{
+	Smoothing: 0.3,
+}
+
+func (c DownloadCfg) withDefaults() DownloadCfg {
+	if c.Smoothing == 0 {
+		c.Smoothing = DefaultDownloadCfg.Smoothing
+	}
+	return c
+}
+
+// typicalTrackSize turns latency and throughput into an expected download time.
+const typicalTrackSize = 8 << 20
+
+type hostHealth struct {
+	samples    int
+	latency    float64 // seconds to the first byte
+	throughput float64 // bytes per second
+	errRate    float64
+}
+
+// cost is the expected time in seconds to download a typical track,
+// inflated by the error rate. Hosts without samples cost nothing so that
+// they get measured.
+func (h hostHealth) cost() float64 {
+	if h.samples == 0 {
+		return 0
+	}
+	c := h.latency
+	if h.throughput > 0 {
+		c += typicalTrackSize / h.throughput
+	}
+	errRate := h.errRate
+	if errRate > 0.95 {
+		errRate = 0.95
+	}
+	return c / (1 - errRate)
+}
+
+// mirrorHealth scores the audio hosts from the downloads made so far.
+type mirrorHealth struct {
+	mu    sync.Mutex
+	hosts map[string]*hostHealth
+}
+
+func newMirrorHealth() *mirrorHealth {
+	return &mirrorHealth{
+		hosts: map[string]*hostHealth{},
+	}
+}
+
+func hostOf(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	return u.Host
+}
+
+func (m *mirrorHealth) host(link string) *hostHealth {
+	h, ok := m.hosts[hostOf(link)]
+	if !ok {
+		h = &hostHealth{}
+		m.hosts[hostOf(link)] = h
+	}
+	return h
+}
+
+// rank orders the distinct links from the healthiest host to the least
+// healthy one, links of equally healthy hosts keep their order.
+func (m *mirrorHealth) rank(links ...string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uniq := make([]string, 0, len(links))
+	for _, l := range links {
+		if l == "" || contains(uniq, l) {
+			continue
+		}
+		uniq = append(uniq, l)
+	}
+	sort.SliceStable(uniq, func(i, j int) bool {
+		return m.host(uniq[i]).cost() < m.host(uniq[j]).cost()
+	})
+	return uniq
+}
+
+func ewma(prev, sample, smoothing float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return smoothing*sample + (1-smoothing)*prev
+}
+
+func (m *mirrorHealth) firstByte(link string, d time.Duration, smoothing float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.host(link)
+	h.latency = ewma(h.latency, d.Seconds(), smoothing, h.samples == 0)
+}
+
+func (m *mirrorHealth) success(link string, n int64, d time.Duration, smoothing float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.host(link)
+	if d > 0 {
+		h.throughput = ewma(h.throughput, float64(n)/d.Seconds(), smoothing, h.throughput == 0)
+	}
+	h.errRate = ewma(h.errRate, 0, smoothing, h.samples == 0)
+	h.samples++
+}
+
+func (m *mirrorHealth) failure(link string, smoothing float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.host(link)
+	h.errRate = ewma(h.errRate, 1, smoothing, h.samples == 0)
+	h.samples++
+}
+
+func (m *mirrorHealth) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.hosts))
+	for name := range m.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		h := m.hosts[name]
+		parts = append(parts, fmt.Sprintf("%s: %d downloads, %.0fms to first byte, %.0fKiB/s, %.0f%% errors",
+			name, h.samples, h.latency*1000, h.throughput/1024, h.errRate*100))
+	}
+	return strings.Join(parts, "; ")
+}
+
+type opened struct {
+	body io.ReadCloser
+	link string
+	err  error
+}
+
+// cancelOnClose cancels the context of a download when its body is closed.
+type cancelOnClose struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.body.Close()
+}
+
+// openMirror opens the links in order and returns the first body that
+// produced bytes. With hedging the next link is started when the current
+// one is still silent after the hedge delay, the losers are cancelled.
+func (u Usecase) openMirror(ctx context.Context, links []string) (io.ReadCloser, string, error) {
+	results := make(chan opened, len(links))
+	cancels := map[string]context.CancelFunc{}
+	next, pending := 0, 0
+	start := func() {
+		link := links[next]
+		next++
+		pending++
+		actx, cancel := context.WithCancel(ctx)
+		cancels[link] = cancel
+		go func() {
+			began := time.Now()
+			body, err := u.firstBytes(actx, link)
+			if err != nil {
+				cancel()
+				if !errors.Is(err, context.Canceled) {
+					u.mirrors.failure(link, u.cfg.Download.Smoothing)
+				}
+				results <- opened{link: link, err: err}
+				return
+			}
+			u.mirrors.firstByte(link, time.Since(began), u.cfg.Download.Smoothing)
+			results <- opened{
+				body: cancelOnClose{
+					Reader: body,
+					body:   body,
+					cancel: cancel,
+				},
+				link: link,
+			}
+		}()
+	}
+	start()
+	var hedge <-chan time.Time
+	if u.cfg.Download.Hedge > 0 && len(links) > 1 {
+		t := time.NewTimer(u.cfg.Download.Hedge)
+		defer t.Stop()
+		hedge = t.C
+	}
+	var err error
+	for pending > 0 {
+		select {
+		case <-hedge:
+			hedge = nil
+			if next < len(links) {
+				start()
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				err = r.err
+				if pending == 0 && next < len(links) {
+					start()
+				}
+				continue
+			}
+			for link, cancel := range cancels {
+				if link != r.link {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for i := 0; i < pending; i++ {
+					if r := <-results; r.err == nil {
+						r.body.Close()
+					}
+				}
+			}(pending)
+			return r.body, r.link, nil
+		}
+	}
+	return nil, "", err
+}
+
+var errEmptyBody = errors.New("empty body")
+
+// firstBytes downloads link until the first bytes of the body arrive.
+func (u Usecase) firstBytes(ctx context.Context, link string) (io.ReadCloser, error) {
+	body, err := u.downloadFile(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf[:n]), body), body}, nil
+		}
+		if err != nil {
+			body.Close()
+			if errors.Is(err, io.EOF) {
+				err = errEmptyBody
+			}
+			return nil, fmt.Errorf("download file: %s: %w", link, err)
+		}
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"accu/tracks"
+	"accu/tracks/dedupe"
+)
+
+// Work downloads the tracks handed out by the queue of WithQueue as
+// consumer until ctx is cancelled. A delivery is acked once its file is
+// saved and verified, tracks skipped as duplicates are acked right away.
+// Failed deliveries are given back to the queue, deliveries interrupted by
+// ctx are left pending for the next run.
+func (u Usecase) Work(ctx context.Context, consumer string) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("usecase: work: %w", err)
+	}
+	if u.q == nil {
+		return handleErr(errors.New("no queue"))
+	}
+	for ctx.Err() == nil {
+		ds, err := u.q.Receive(ctx, consumer, maxDownloads)
+		if err == nil && len(ds) > 0 {
+			err = u.deliver(ctx, ds)
+		}
+		if err != nil && ctx.Err() == nil {
+			u.l.Print(handleErr(err))
+			if err := sleep(ctx, u.cfg.Daemon.MinRetryBackoff); err != nil {
+				break
+			}
+		}
+	}
+	u.l.Printf("mirrors: %s", u.mirrors)
+	return nil
+}
+
+// deliver downloads ds with the channels their tracks were seen on, so a
+// track new to a channel is linked from the file saved for another one.
+// The deliveries of one track are handled in turn, the later ones find the
+// file of the first.
+func (u Usecase) deliver(ctx context.Context, ds []tracks.Delivery) error {
+	groups, err := u.r.GetDuplicateGroups(ctx)
+	if err != nil {
+		return err
+	}
+	skipped := dedupe.Skipped(groups)
+	if err := u.folders.load(ctx, u.r); err != nil {
+		return err
+	}
+	byTrack := map[string][]tracks.Delivery{}
+	var order []string
+	for _, d := range ds {
+		if _, ok := byTrack[d.Track.ID]; !ok {
+			order = append(order, d.Track.ID)
+		}
+		byTrack[d.Track.ID] = append(byTrack[d.Track.ID], d)
+	}
+	wg := sync.WaitGroup{}
+	for _, id := range order {
+		wg.Add(1)
+		go func(ds []tracks.Delivery) {
+			defer wg.Done()
+			for _, d := range ds {
+				u.deliverOne(ctx, d, skipped)
+			}
+		}(byTrack[id])
+	}
+	wg.Wait()
+	return nil
+}
+
+func (u Usecase) deliverOne(ctx context.Context, d tracks.Delivery, skipped map[string]bool) {
+	if !skipped[d.Track.ID] {
+		t := d.Track
+		// the queue hands t out for the one channel it is new to, the
+		// stored track was seen on the others
+		var nf *tracks.NotFoundError
+		if stored, err := u.r.GetTrackByLink(ctx, t.PrimaryLink); err == nil {
+			t.Channels = stored.Channels
+		} else if !errors.As(err, &nf) {
+			u.l.Print(err)
+		}
+		if err := u.download(ctx, t); err != nil {
+			u.l.Printf("delivery %s, attempt %d: %s", d.ID, d.Deliveries, err)
+			if ctx.Err() != nil {
+				return
+			}
+			if err := u.q.Fail(ctx, d, err); err != nil {
+				u.l.Print(err)
+			}
+			return
+		}
+	}
+	if err := u.q.Ack(ctx, d); err != nil {
+		u.l.Print(err)
+	}
+}
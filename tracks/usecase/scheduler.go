@@ -0,0 +1,262 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"accu/tracks"
+)
+
+// PollCfg controls how often each channel playlist is polled.
+type PollCfg struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Jitter is the fraction of the interval randomly added or subtracted, 0..1,
+	// 0 disables jitter.
+	Jitter float64
+	// Smoothing is the weight of the latest fetch in the novelty average, 0..1.
+	Smoothing float64
+	// GlobalRPS caps fetches per second across all channels, 0 disables the cap.
+	GlobalRPS float64
+	// Budget caps the total number of fetches in a run, 0 disables the cap.
+	Budget int
+}
+
+// StopCfg controls when a channel is considered exhausted. Zero values
+// take the DefaultStopCfg value, negative values disable the corresponding
+// rule. By default a channel stops once the estimated coverage of its
+// rotation reaches TargetCoverage.
+type StopCfg struct {
+	// MaxEmptyFetches stops a channel after that many fetches in a row
+	// without a new track, it is off by default.
+	MaxEmptyFetches int
+	// MaxFetches stops a channel after that many fetches, the replayed
+	// ones included.
+	MaxFetches int
+	// TargetCoverage stops a channel once its estimated coverage reaches
+	// the given ratio, 0..1.
+	TargetCoverage float64
+	Estimator      Estimator
+	// MinCoverageFetches is the number of fetches required before
+	// the coverage estimate is trusted.
+	MinCoverageFetches int
+	// MaxPermanentErrors is the number of permanent errors in a row, such
+	// as a missing playlist or one that can't be decoded, that stops a
+	// channel. The channel backs off after each of them.
+	MaxPermanentErrors int
+}
+
+var DefaultPollCfg = PollCfg{
+	MinInterval: 2 * time.Second,
+	MaxInterval: time.Minute,
+	Jitter:      0.2,
+	Smoothing:   0.3,
+}
+
+var DefaultStopCfg = StopCfg{
+	MaxEmptyFetches:    -1,
+	MaxFetches:         -1,
+	TargetCoverage:     0.95,
+	Estimator:          Chao1,
+	MinCoverageFetches: 10,
+	MaxPermanentErrors: 5,
+}
+
+func (c PollCfg) withDefaults() PollCfg {
+	if c.MinInterval == 0 {
+		c.MinInterval = DefaultPollCfg.MinInterval
+	}
+	if c.MaxInterval == 0 {
+		c.MaxInterval = DefaultPollCfg.MaxInterval
+	}
+	if c.MaxInterval < c.MinInterval {
+		c.MaxInterval = c.MinInterval
+	}
+	if c.Smoothing == 0 {
+		c.Smoothing = DefaultPollCfg.Smoothing
+	}
+	return c
+}
+
+func (c StopCfg) withDefaults() StopCfg {
+	if c.MaxEmptyFetches == 0 {
+		c.MaxEmptyFetches = DefaultStopCfg.MaxEmptyFetches
+	}
+	if c.MaxFetches == 0 {
+		c.MaxFetches = DefaultStopCfg.MaxFetches
+	}
+	if c.TargetCoverage == 0 {
+		c.TargetCoverage = DefaultStopCfg.TargetCoverage
+	}
+	if c.Estimator == "" {
+		c.Estimator = DefaultStopCfg.Estimator
+	}
+	if c.MinCoverageFetches == 0 {
+		c.MinCoverageFetches = DefaultStopCfg.MinCoverageFetches
+	}
+	if c.MaxPermanentErrors == 0 {
+		c.MaxPermanentErrors = DefaultStopCfg.MaxPermanentErrors
+	}
+	return c
+}
+
+var errBudgetExhausted = errors.New("fetch budget exhausted")
+
+// budget is shared by all channel pollers of a run.
+type budget struct {
+	mu     sync.Mutex
+	every  time.Duration
+	next   time.Time
+	left   int
+	capped bool
+}
+
+func newBudget(cfg PollCfg) *budget {
+	b := &budget{
+		left:   cfg.Budget,
+		capped: cfg.Budget > 0,
+	}
+	if cfg.GlobalRPS > 0 {
+		b.every = time.Duration(float64(time.Second) / cfg.GlobalRPS)
+	}
+	return b
+}
+
+// take blocks until the next fetch is allowed.
+func (b *budget) take(ctx context.Context) error {
+	b.mu.Lock()
+	if b.capped {
+		if b.left == 0 {
+			b.mu.Unlock()
+			return errBudgetExhausted
+		}
+		b.left--
+	}
+	now := time.Now()
+	at := b.next
+	if at.Before(now) {
+		at = now
+	}
+	b.next = at.Add(b.every)
+	b.mu.Unlock()
+	return sleep(ctx, at.Sub(now))
+}
+
+// channelSchedule adapts a channel's poll interval to its recent novelty rate:
+// channels that keep yielding new tracks are polled at MinInterval,
+// channels that yield nothing drift towards MaxInterval.
+type channelSchedule struct {
+	poll        PollCfg
+	stop        StopCfg
+	novelty     float64
+	fetches     int
+	replays     int
+	emptyStreak int
+	// errStreak counts the permanent errors since the last fetch that
+	// succeeded.
+	errStreak int
+	cov       *coverageTracker
+}
+
+func newChannelSchedule(poll PollCfg, stop StopCfg) *channelSchedule {
+	return &channelSchedule{
+		poll:    poll,
+		stop:    stop,
+		novelty: 1,
+		cov:     newCoverageTracker(),
+	}
+}
+
+func (s *channelSchedule) observe(fetched []tracks.Track, fresh int) {
+	s.fetches++
+	s.cov.observe(fetched)
+	if fresh == 0 {
+		s.emptyStreak++
+	} else {
+		s.emptyStreak = 0
+	}
+	var rate float64
+	if len(fetched) > 0 {
+		rate = float64(fresh) / float64(len(fetched))
+	}
+	s.novelty = s.poll.Smoothing*rate + (1-s.poll.Smoothing)*s.novelty
+}
+
+// replayed counts a fetch served from a cache or a cassette, it is no
+// sample of the rotation and only counts towards MaxFetches.
+func (s *channelSchedule) replayed() {
+	s.replays++
+}
+
+func (s *channelSchedule) succeeded() {
+	s.errStreak = 0
+}
+
+func (s *channelSchedule) failed() {
+	s.errStreak++
+}
+
+// backoff doubles from MinInterval with every permanent error in a row, up
+// to MaxInterval.
+func (s *channelSchedule) backoff() time.Duration {
+	if s.errStreak == 0 {
+		return 0
+	}
+	d := s.poll.MinInterval
+	for i := 1; i < s.errStreak && d < s.poll.MaxInterval; i++ {
+		d *= 2
+	}
+	if d > s.poll.MaxInterval {
+		d = s.poll.MaxInterval
+	}
+	return d
+}
+
+func (s *channelSchedule) done() bool {
+	if s.stop.MaxPermanentErrors > 0 && s.errStreak >= s.stop.MaxPermanentErrors {
+		return true
+	}
+	if s.stop.MaxEmptyFetches > 0 && s.emptyStreak >= s.stop.MaxEmptyFetches {
+		return true
+	}
+	if s.stop.MaxFetches > 0 && s.fetches+s.replays >= s.stop.MaxFetches {
+		return true
+	}
+	if s.stop.TargetCoverage > 0 && s.fetches >= s.stop.MinCoverageFetches {
+		return s.coverage().Ratio(s.stop.Estimator) >= s.stop.TargetCoverage
+	}
+	return false
+}
+
+func (s *channelSchedule) coverage() Coverage {
+	return s.cov.coverage()
+}
+
+func (s *channelSchedule) interval() time.Duration {
+	span := float64(s.poll.MaxInterval - s.poll.MinInterval)
+	d := float64(s.poll.MinInterval) + span*(1-s.novelty)
+	if s.poll.Jitter > 0 {
+		d += d * s.poll.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
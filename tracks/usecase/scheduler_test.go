@@ -0,0 +1,248 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"accu/tracks"
+)
+
+func TestChannelSchedulePermanentErrors(t *testing.T) {
+	poll := PollCfg{MinInterval: time.Second, MaxInterval: 10 * time.Second}.withDefaults()
+	s := newChannelSchedule(poll, StopCfg{MaxPermanentErrors: 3}.withDefaults())
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		s.failed()
+		if s.done() {
+			t.Fatalf("done after %d errors", i+1)
+		}
+		if d := s.backoff(); d != want {
+			t.Errorf("backoff after %d errors %s, want %s", i+1, d, want)
+		}
+	}
+	s.succeeded()
+	if d := s.backoff(); d != 0 {
+		t.Errorf("backoff %s after a success", d)
+	}
+	for i := 0; i < 3; i++ {
+		s.failed()
+	}
+	if !s.done() {
+		t.Error("not done after 3 errors in a row")
+	}
+
+	s = newChannelSchedule(poll, StopCfg{MaxPermanentErrors: -1}.withDefaults())
+	for i := 0; i < 10; i++ {
+		s.failed()
+	}
+	if s.done() {
+		t.Error("done with the rule disabled")
+	}
+	if d := s.backoff(); d != poll.MaxInterval {
+		t.Errorf("backoff %s, want MaxInterval", d)
+	}
+}
+
+func TestBudgetCap(t *testing.T) {
+	b := newBudget(PollCfg{Budget: 3})
+	for i := 0; i < 3; i++ {
+		if err := b.take(context.Background()); err != nil {
+			t.Fatalf("take %d: %v", i+1, err)
+		}
+	}
+	if err := b.take(context.Background()); !errors.Is(err, errBudgetExhausted) {
+		t.Errorf("take past the budget: %v", err)
+	}
+
+	b = newBudget(PollCfg{})
+	for i := 0; i < 1000; i++ {
+		if err := b.take(context.Background()); err != nil {
+			t.Fatalf("uncapped take %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestBudgetGlobalRPS(t *testing.T) {
+	b := newBudget(PollCfg{GlobalRPS: 100})
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.take(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// the first take is immediate, the other four are 10ms apart
+	if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+		t.Errorf("5 takes at 100 rps took %s", d)
+	}
+
+	b = newBudget(PollCfg{GlobalRPS: 0.1})
+	if err := b.take(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.take(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("take while waiting for the next slot: %v", err)
+	}
+}
+
+func TestChannelScheduleInterval(t *testing.T) {
+	poll := PollCfg{MinInterval: time.Second, MaxInterval: 11 * time.Second, Smoothing: 0.5}.withDefaults()
+	if poll.Jitter != 0 {
+		t.Fatalf("jitter %f by default", poll.Jitter)
+	}
+	s := newChannelSchedule(poll, StopCfg{}.withDefaults())
+	if d := s.interval(); d != time.Second {
+		t.Errorf("first interval %s, want MinInterval", d)
+	}
+	three := playlist("a", "b", "c")
+	for i, tc := range []struct {
+		fetched []tracks.Track
+		fresh   int
+		want    time.Duration
+	}{
+		// novelty 0.5, then 0.25
+		{three, 0, 6 * time.Second},
+		{three, 0, 8500 * time.Millisecond},
+		// every track new, novelty 0.625
+		{three, 3, 4750 * time.Millisecond},
+		// an empty playlist counts as no novelty, 0.3125
+		{nil, 0, 7875 * time.Millisecond},
+		// one new track out of three, 0.3125/2 + 1/6
+		{three, 1, 7770833333},
+	} {
+		s.observe(tc.fetched, tc.fresh)
+		if d := s.interval(); d != tc.want {
+			t.Errorf("interval after fetch %d %s, want %s", i+1, d, tc.want)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		s.observe(three, 0)
+	}
+	if d := s.interval(); d < 11*time.Second-time.Millisecond || d > 11*time.Second {
+		t.Errorf("interval %s after a long run without new tracks, want MaxInterval", d)
+	}
+}
+
+func TestChannelScheduleJitter(t *testing.T) {
+	poll := PollCfg{MinInterval: 10 * time.Second, MaxInterval: time.Minute, Jitter: 0.2}.withDefaults()
+	s := newChannelSchedule(poll, StopCfg{}.withDefaults())
+	lo, hi := time.Hour, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := s.interval()
+		if d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+	}
+	if lo < 8*time.Second || hi > 12*time.Second {
+		t.Errorf("intervals %s..%s outside 10s ±20%%", lo, hi)
+	}
+	if lo > 9*time.Second || hi < 11*time.Second {
+		t.Errorf("intervals %s..%s hardly jittered", lo, hi)
+	}
+}
+
+func TestChannelScheduleDone(t *testing.T) {
+	poll := PollCfg{}.withDefaults()
+	same := playlist("a", "b", "c")
+	for _, tc := range []struct {
+		name  string
+		stop  StopCfg
+		fetch func(i int) ([]tracks.Track, int)
+		// doneAt is the fetch after which the channel is done, 0 for never.
+		doneAt int
+	}{
+		{
+			name:   "empty fetches",
+			stop:   StopCfg{MaxEmptyFetches: 3, TargetCoverage: -1},
+			fetch:  func(i int) ([]tracks.Track, int) { return same, 0 },
+			doneAt: 3,
+		},
+		{
+			name: "empty streak reset by a new track",
+			stop: StopCfg{MaxEmptyFetches: 3, TargetCoverage: -1},
+			fetch: func(i int) ([]tracks.Track, int) {
+				if i == 2 {
+					return same, 1
+				}
+				return same, 0
+			},
+			doneAt: 5,
+		},
+		{
+			name:   "max fetches",
+			stop:   StopCfg{MaxFetches: 4, TargetCoverage: -1},
+			fetch:  func(i int) ([]tracks.Track, int) { return same, 3 },
+			doneAt: 4,
+		},
+		{
+			// the odd fetches are replayed
+			name: "max fetches with replays",
+			stop: StopCfg{MaxFetches: 4, MaxEmptyFetches: 2, TargetCoverage: -1},
+			fetch: func(i int) ([]tracks.Track, int) {
+				if i%2 == 1 {
+					return nil, -1
+				}
+				return playlist(fmt.Sprint(i)), 1
+			},
+			doneAt: 4,
+		},
+		{
+			name: "replays are no empty fetches",
+			stop: StopCfg{MaxEmptyFetches: 2, TargetCoverage: -1},
+			fetch: func(i int) ([]tracks.Track, int) {
+				return nil, -1
+			},
+		},
+		{
+			// every track seen twice, chao1 equals the observed count
+			name:   "coverage by default",
+			stop:   StopCfg{MinCoverageFetches: 2},
+			fetch:  func(i int) ([]tracks.Track, int) { return same, 0 },
+			doneAt: 2,
+		},
+		{
+			name: "coverage below target",
+			stop: StopCfg{MinCoverageFetches: 2},
+			fetch: func(i int) ([]tracks.Track, int) {
+				return playlist(fmt.Sprint(i), "a"), 1
+			},
+		},
+		{
+			name:  "rules disabled",
+			stop:  StopCfg{TargetCoverage: -1},
+			fetch: func(i int) ([]tracks.Track, int) { return same, 0 },
+		},
+	} {
+		s := newChannelSchedule(poll, tc.stop.withDefaults())
+		for i := 1; i <= 200; i++ {
+			// a negative fresh count stands for a replayed fetch
+			if fetched, fresh := tc.fetch(i); fresh < 0 {
+				s.replayed()
+			} else {
+				s.observe(fetched, fresh)
+			}
+			if s.done() {
+				if i != tc.doneAt {
+					t.Errorf("%s: done after %d fetches, want %d", tc.name, i, tc.doneAt)
+				}
+				break
+			}
+		}
+		if !s.done() && tc.doneAt != 0 {
+			t.Errorf("%s: not done after 200 fetches", tc.name)
+		}
+	}
+}
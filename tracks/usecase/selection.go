@@ -0,0 +1,124 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"accu/tracks"
+)
+
+// ChannelRule matches a channel when every non-empty field matches. A
+// Category rule matches the channels in the category or any of its
+// descendants.
+type ChannelRule struct {
+	Name     *regexp.Regexp
+	DataId   string
+	Category string
+}
+
+// match looks up the ancestors above the parents of the channel categories
+// in parents, a category slug to parent slug map.
+func (r ChannelRule) match(ch tracks.Channel, parents map[string]string) bool {
+	if r.Name != nil && !r.Name.MatchString(ch.Name) {
+		return false
+	}
+	if r.DataId != "" && r.DataId != ch.DataId {
+		return false
+	}
+	if r.Category == "" {
+		return true
+	}
+	for _, c := range ch.Categories {
+		if c.Slug == r.Category {
+			return true
+		}
+		parent := c.Parent
+		if parent == "" {
+			parent = parents[c.Slug]
+		}
+		// the depth bound guards against a cycle in the stored parents
+		for slug, depth := parent, 0; slug != "" && depth <= len(parents); depth++ {
+			if slug == r.Category {
+				return true
+			}
+			slug = parents[slug]
+		}
+	}
+	return false
+}
+
+// SelectCfg picks the channels to rip. With no Include rules every channel
+// is included, Exclude rules win over Include rules.
+type SelectCfg struct {
+	Include []ChannelRule
+	Exclude []ChannelRule
+}
+
+func (c SelectCfg) match(ch tracks.Channel, parents map[string]string) bool {
+	for _, r := range c.Exclude {
+		if r.match(ch, parents) {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, r := range c.Include {
+		if r.match(ch, parents) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c SelectCfg) byCategory() bool {
+	for _, rules := range [][]ChannelRule{c.Include, c.Exclude} {
+		for _, r := range rules {
+			if r.Category != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selected reports whether ch passes the configured rules and is enabled in the repo.
+func (u Usecase) selected(ctx context.Context, ch tracks.Channel) (bool, error) {
+	handleErr := func(err error) (bool, error) {
+		return false, fmt.Errorf("selected: %w", err)
+	}
+	parents, err := u.categoryParents(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	if !u.cfg.Select.match(ch, parents) {
+		return false, nil
+	}
+	enabled, err := u.r.IsChannelEnabled(ctx, ch.DataId)
+	if err != nil {
+		return handleErr(err)
+	}
+	return enabled, nil
+}
+
+// categoryParents maps the category slugs stored in the repo to their
+// parents, they are only needed by Category rules.
+func (u Usecase) categoryParents(ctx context.Context) (map[string]string, error) {
+	if !u.cfg.Select.byCategory() {
+		return nil, nil
+	}
+	parents := map[string]string{}
+	if cr, ok := u.r.(tracks.CategoryRepo); ok {
+		cc, err := cr.GetCategories(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cc {
+			if c.Parent != "" {
+				parents[c.Slug] = c.Parent
+			}
+		}
+	}
+	return parents, nil
+}
@@ -0,0 +1,82 @@
+package usecase
+
+import (
+	"regexp"
+	"testing"
+
+	"accu/tracks"
+)
+
+func TestChannelRuleMatch(t *testing.T) {
+	smooth := tracks.Channel{
+		Name:   "Smooth Jazz Lounge",
+		DataId: "c1",
+		Categories: []tracks.Category{
+			{Slug: "smooth-jazz", Parent: "jazz"},
+			{Slug: "dinner"},
+		},
+	}
+	// crawled from an attribute, the lineage is only in the repo
+	quiet := tracks.Channel{
+		Name:       "Quiet Storm",
+		DataId:     "c2",
+		Categories: []tracks.Category{{Slug: "quiet-storm"}},
+	}
+	parents := map[string]string{
+		"quiet-storm": "smooth-jazz",
+		"smooth-jazz": "jazz",
+		// a loop in the stored tree
+		"a": "b",
+		"b": "a",
+	}
+	for _, tc := range []struct {
+		name string
+		rule ChannelRule
+		ch   tracks.Channel
+		want bool
+	}{
+		{"empty rule", ChannelRule{}, smooth, true},
+		{"name", ChannelRule{Name: regexp.MustCompile(`(?i)jazz`)}, smooth, true},
+		{"other name", ChannelRule{Name: regexp.MustCompile(`^Rock`)}, smooth, false},
+		{"data id", ChannelRule{DataId: "c1"}, smooth, true},
+		{"other data id", ChannelRule{DataId: "c2"}, smooth, false},
+		{"category", ChannelRule{Category: "smooth-jazz"}, smooth, true},
+		{"second category", ChannelRule{Category: "dinner"}, smooth, true},
+		{"parent category", ChannelRule{Category: "jazz"}, smooth, true},
+		{"stored ancestor", ChannelRule{Category: "jazz"}, quiet, true},
+		{"descendant category", ChannelRule{Category: "quiet-storm"}, smooth, false},
+		{"other category", ChannelRule{Category: "rock"}, smooth, false},
+		{"cycle", ChannelRule{Category: "rock"}, tracks.Channel{Categories: []tracks.Category{{Slug: "a"}}}, false},
+		{"all fields", ChannelRule{Name: regexp.MustCompile(`Lounge`), DataId: "c1", Category: "jazz"}, smooth, true},
+		{"one field off", ChannelRule{Name: regexp.MustCompile(`Lounge`), DataId: "c2", Category: "jazz"}, smooth, false},
+	} {
+		if got := tc.rule.match(tc.ch, parents); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSelectCfgMatch(t *testing.T) {
+	jazz := tracks.Channel{Name: "Jazz", DataId: "c1", Categories: []tracks.Category{{Slug: "smooth-jazz", Parent: "jazz"}}}
+	rock := tracks.Channel{Name: "Rock", DataId: "c2", Categories: []tracks.Category{{Slug: "rock"}}}
+	for _, tc := range []struct {
+		name string
+		cfg  SelectCfg
+		want [2]bool
+	}{
+		{"no rules", SelectCfg{}, [2]bool{true, true}},
+		{"include", SelectCfg{Include: []ChannelRule{{Category: "jazz"}}}, [2]bool{true, false}},
+		{"include any", SelectCfg{Include: []ChannelRule{{DataId: "c1"}, {DataId: "c2"}}}, [2]bool{true, true}},
+		{"exclude", SelectCfg{Exclude: []ChannelRule{{Category: "jazz"}}}, [2]bool{false, true}},
+		{"exclude wins", SelectCfg{
+			Include: []ChannelRule{{Name: regexp.MustCompile(`.`)}},
+			Exclude: []ChannelRule{{DataId: "c2"}},
+		}, [2]bool{true, false}},
+	} {
+		for i, ch := range []tracks.Channel{jazz, rock} {
+			if got := tc.cfg.match(ch, nil); got != tc.want[i] {
+				t.Errorf("%s: %s got %v, want %v", tc.name, ch.Name, got, tc.want[i])
+			}
+		}
+	}
+}
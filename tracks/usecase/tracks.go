@@ -2,6 +2,7 @@ package usecase
 
 import (
 	"accu/tracks"
+	"accu/tracks/dedupe"
 	"context"
 	"errors"
 	"fmt"
@@ -12,19 +13,41 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Cfg struct {
 	DownloadsRootDir string
+	Poll             PollCfg
+	Stop             StopCfg
+	Daemon           DaemonCfg
+	Select           SelectCfg
+	Download         DownloadCfg
+	Leases           LeaseCfg
+	// Fetch is passed to every channel and playlist fetch.
+	Fetch tracks.FetchOptions
+	// LastSeenInterval is how often a known track seen again is saved to
+	// move its last seen time, it is saved at once when its links moved.
+	LastSeenInterval time.Duration
 }
 
+const (
+	DefaultFetchTimeout     = 30 * time.Second
+	DefaultLastSeenInterval = time.Hour
+)
+
 type Usecase struct {
-	tf  tracks.TracksFetcher
-	cf  tracks.ChannelFetcher
-	r   tracks.Repo
-	c   *http.Client
-	l   *log.Logger
-	cfg Cfg
+	tf      tracks.TracksFetcher
+	cf      tracks.ChannelFetcher
+	r       tracks.Repo
+	c       *http.Client
+	l       *log.Logger
+	cfg     Cfg
+	drift   *driftMonitor
+	mirrors *mirrorHealth
+	folders *channelFolders
+	q       tracks.TrackQueue
+	leases  tracks.ChannelLeases
 }
 
 func New(cfg Cfg, rt http.RoundTripper, tf tracks.TracksFetcher, cf tracks.ChannelFetcher, r tracks.Repo, l *log.Logger) Usecase {
@@ -36,159 +59,473 @@ func New(cfg Cfg, rt http.RoundTripper, tf tracks.TracksFetcher, cf tracks.Chann
 			Transport: rt,
 		},
 		l,
-		cfg,
+		cfg.withDefaults(),
+		newDriftMonitor(),
+		newMirrorHealth(),
+		newChannelFolders(),
+		nil,
+		nil,
 	}
 }
 
+// WithQueue publishes the new tracks found by Rip and Daemon to q.
+func (u Usecase) WithQueue(q tracks.TrackQueue) Usecase {
+	u.q = q
+	return u
+}
+
+func (c Cfg) withDefaults() Cfg {
+	c.Poll = c.Poll.withDefaults()
+	c.Stop = c.Stop.withDefaults()
+	c.Daemon = c.Daemon.withDefaults()
+	c.Download = c.Download.withDefaults()
+	c.Leases = c.Leases.withDefaults()
+	if c.Fetch.Timeout == 0 {
+		c.Fetch.Timeout = DefaultFetchTimeout
+	}
+	if c.LastSeenInterval == 0 {
+		c.LastSeenInterval = DefaultLastSeenInterval
+	}
+	return c
+}
+
 func (u Usecase) Rip(ctx context.Context) error {
 	handleErr := func(err error) error {
 		return fmt.Errorf("usecase: do: %w", err)
 	}
-	channels, err := u.cf.FetchChannels()
+	channels, err := u.cf.FetchChannels(ctx, tracks.FetchChannelsParams{
+		FetchOptions: u.cfg.Fetch,
+	})
 	if err != nil {
 		return handleErr(err)
 	}
-	wg := sync.WaitGroup{}
-	wg.Add(len(channels))
+	if len(channels) == 0 {
+		return handleErr(tracks.ErrNoChannels)
+	}
+	selected := make([]tracks.Channel, 0, len(channels))
 	for _, ch := range channels {
 		if err := u.r.SaveChannels(ctx, ch); err != nil {
 			return handleErr(err)
 		}
+		if ok, err := u.selected(ctx, ch); err != nil {
+			return handleErr(err)
+		} else if !ok {
+			u.l.Printf("skipping channel %s - %s", ch.DataId, ch.Name)
+			continue
+		}
+		selected = append(selected, ch)
+	}
+	b := newBudget(u.cfg.Poll)
+	if u.leases != nil {
+		u.ripLeased(ctx, selected, b)
+		u.reportDrift()
+		return nil
+	}
+	wg := sync.WaitGroup{}
+	for _, ch := range selected {
+		wg.Add(1)
 		go func(ch tracks.Channel) {
-			var noNewTracks int
 			defer wg.Done()
-		loop:
-			for {
-				u.l.Printf("started fetching tracks for channel %s - %s", ch.DataId, ch.Name)
-				select {
-				case <-ctx.Done():
-					break loop
-				default:
-				}
-				trcks, err := u.tf.FetchTracks(tracks.FetchTracksParams{
-					Channel: ch.DataId,
-				})
-				if err != nil {
-					u.l.Print(err)
-					continue
-				}
-				filtered, err := u.filterTracks(ctx, trcks)
-				if err != nil {
-					u.l.Print(err)
-					continue
-				}
-				if len(filtered) == 0 {
-					noNewTracks++
-				} else {
-					noNewTracks = 0
-				}
-				if noNewTracks == 100 {
-					break loop
-				}
-				if err := u.r.SaveTracks(ctx, filtered...); err != nil {
-					u.l.Print(err)
-				}
-				u.l.Printf("fetched %d tracks for channel %s - %s", len(filtered), ch.DataId, ch.Name)
-			}
-			u.l.Printf("exit fetching tracks for channel %s - %s", ch.DataId, ch.Name)
+			u.ripChannel(ctx, ch, b)
 		}(ch)
 	}
 	wg.Wait()
+	u.reportDrift()
+	return nil
+}
+
+func (u Usecase) ripChannel(ctx context.Context, ch tracks.Channel, b *budget) {
+	s := newChannelSchedule(u.cfg.Poll, u.cfg.Stop)
+	w := newTrackWrites(u.cfg.LastSeenInterval)
+	u.l.Printf("started fetching tracks for channel %s - %s", ch.DataId, ch.Name)
+	for !s.done() {
+		if err := b.take(ctx); err != nil {
+			break
+		}
+		info := &tracks.FetchInfo{}
+		trcks, err := u.tf.FetchTracks(tracks.WithFetchInfo(ctx, info), tracks.FetchTracksParams{
+			Channel:      ch.DataId,
+			FetchOptions: u.cfg.Fetch,
+		})
+		u.checkDrift()
+		if err == nil {
+			err = u.saveNewTracks(ctx, ch, trcks, s, w, info.Replayed)
+		}
+		if err == nil {
+			s.succeeded()
+		} else if tracks.IsPermanent(err) {
+			s.failed()
+		}
+		wait := s.interval()
+		if err != nil {
+			u.l.Print(err)
+			// the channel was leased to another ripper
+			var fe *tracks.FencedError
+			if errors.As(err, &fe) {
+				break
+			}
+			if d := s.backoff(); d > wait {
+				wait = d
+			}
+			if d, ok := tracks.RetryAfter(err); ok && d > wait {
+				wait = d
+			}
+		}
+		if err := sleep(ctx, wait); err != nil {
+			break
+		}
+	}
+	u.l.Printf("exit fetching tracks for channel %s - %s: %s", ch.DataId, ch.Name, s.coverage())
+}
+
+// saveNewTracks saves the new tracks of trcks and the known ones w asks
+// for, a replayed response is no new sample of the rotation and only
+// counts as a fetch.
+func (u Usecase) saveNewTracks(ctx context.Context, ch tracks.Channel, trcks []tracks.Track, s *channelSchedule, w *trackWrites, replayed bool) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("save new tracks: %w", err)
+	}
+	filtered, err := u.filterTracks(ctx, ch.DataId, trcks)
+	if err != nil {
+		return handleErr(err)
+	}
+	if replayed {
+		s.replayed()
+	} else {
+		s.observe(trcks, len(filtered))
+	}
+	// published first, a track saved but not published would never be
+	// published again. The queue refuses the tracks of a lease taken over
+	// as the repo does.
+	if err := u.publish(ctx, ch, filtered); err != nil {
+		return handleErr(err)
+	}
+	now := time.Now()
+	if due := w.due(trcks, filtered, now); len(due) > 0 {
+		if err := u.r.SaveTracks(ctx, due...); err != nil {
+			return handleErr(err)
+		}
+		w.written(due, now)
+	}
+	u.l.Printf("fetched %d tracks for channel %s - %s, coverage %.1f%%, next poll in ~%s",
+		len(filtered), ch.DataId, ch.Name,
+		100*s.coverage().Ratio(u.cfg.Stop.Estimator), s.interval().Round(time.Second),
+	)
 	return nil
 }
 
-func (u Usecase) filterTracks(ctx context.Context, trcks []tracks.Track) ([]tracks.Track, error) {
+// trackWrites remembers the tracks a channel poller saved, a known track
+// seen again is saved when its links moved or its last seen time is older
+// than interval.
+type trackWrites struct {
+	interval time.Duration
+	byID     map[string]trackWrite
+}
+
+type trackWrite struct {
+	primaryLink   string
+	secondaryLink string
+	at            time.Time
+}
+
+func newTrackWrites(interval time.Duration) *trackWrites {
+	return &trackWrites{
+		interval: interval,
+		byID:     map[string]trackWrite{},
+	}
+}
+
+// due returns the tracks of trcks to save, fresh are the ones new to the
+// channel.
+func (w *trackWrites) due(trcks, fresh []tracks.Track, now time.Time) []tracks.Track {
+	isFresh := make(map[string]struct{}, len(fresh))
+	for _, t := range fresh {
+		isFresh[trackID(t)] = struct{}{}
+	}
+	due := make([]tracks.Track, 0, len(trcks))
+	for _, t := range trcks {
+		id := trackID(t)
+		prev, ok := w.byID[id]
+		if _, fresh := isFresh[id]; !fresh && ok && now.Sub(prev.at) < w.interval &&
+			prev.primaryLink == t.PrimaryLink && prev.secondaryLink == t.SecondaryLink {
+			continue
+		}
+		due = append(due, t)
+	}
+	return due
+}
+
+func (w *trackWrites) written(trcks []tracks.Track, now time.Time) {
+	for _, t := range trcks {
+		w.byID[trackID(t)] = trackWrite{
+			primaryLink:   t.PrimaryLink,
+			secondaryLink: t.SecondaryLink,
+			at:            now,
+		}
+	}
+}
+
+// filterTracks keeps the tracks that were not seen on the channel yet, the
+// IDs of all tracks are looked up at once.
+func (u Usecase) filterTracks(ctx context.Context, channel string, trcks []tracks.Track) ([]tracks.Track, error) {
 	handleErr := func(err error) ([]tracks.Track, error) {
 		return nil, fmt.Errorf("filter tracks: %w", err)
 	}
+	ids := make([]string, 0, len(trcks))
+	for _, trck := range trcks {
+		ids = append(ids, trackID(trck))
+	}
+	unknown, err := u.r.UnknownIDs(ctx, channel, ids...)
+	if err != nil {
+		return handleErr(err)
+	}
+	isUnknown := make(map[string]struct{}, len(unknown))
+	for _, id := range unknown {
+		isUnknown[id] = struct{}{}
+	}
 	result := make([]tracks.Track, 0, len(trcks))
 	for _, trck := range trcks {
-		exists, err := u.trackExists(ctx, trck)
-		if err != nil {
-			return handleErr(err)
+		if _, ok := isUnknown[trackID(trck)]; ok {
+			result = append(result, trck)
 		}
-		if exists {
-			continue
-		}
-		result = append(result, trck)
 	}
 	return result, nil
 }
 
-func (u Usecase) trackExists(ctx context.Context, trck tracks.Track) (bool, error) {
-	handleErr := func(err error) (bool, error) {
-		return false, fmt.Errorf("track exists: %w", err)
+// publish hands trcks out to the downloaders when there is a queue, they
+// are saved into the folder of ch.
+func (u Usecase) publish(ctx context.Context, ch tracks.Channel, trcks []tracks.Track) error {
+	if u.q == nil || len(trcks) == 0 {
+		return nil
 	}
-	if _, err := u.r.GetTrackByLink(ctx, trck.PrimaryLink); errors.Is(err, tracks.ErrNotFound) {
-		return false, nil
-	} else if err != nil {
-		return handleErr(err)
+	queued := make([]tracks.Track, len(trcks))
+	for i, trck := range trcks {
+		trck.ID = trackID(trck)
+		trck.Channel = ch.DataId
+		queued[i] = trck
 	}
-	if _, err := u.r.GetTrackByLink(ctx, trck.SecondaryLink); errors.Is(err, tracks.ErrNotFound) {
-		return false, nil
-	} else if err != nil {
-		return handleErr(err)
+	return u.q.Publish(ctx, queued...)
+}
+
+func trackID(t tracks.Track) string {
+	if t.ID != "" {
+		return t.ID
 	}
-	return true, nil
+	return tracks.LinkTrackID(t.PrimaryLink, t.SecondaryLink)
 }
 
 func (u Usecase) Save(ctx context.Context) error {
 	handleErr := func(err error) error {
 		return fmt.Errorf("save tracks: %w", err)
 	}
-	sem := make(chan struct{}, 16)
-	if err := u.r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+	groups, err := u.r.GetDuplicateGroups(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	skipped := dedupe.Skipped(groups)
+	if err := u.folders.load(ctx, u.r); err != nil {
+		return handleErr(err)
+	}
+	sem := make(chan struct{}, maxDownloads)
+	wg := sync.WaitGroup{}
+	err = u.r.GetAllTracks(ctx, func(ctx context.Context, t tracks.Track) error {
+		if skipped[t.ID] {
+			return nil
+		}
 		sem <- struct{}{}
-		go u.getTrack(ctx, t, sem)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.getTrack(ctx, t, sem)
+		}()
 		return nil
-	}); err != nil {
+	})
+	wg.Wait()
+	u.l.Printf("mirrors: %s", u.mirrors)
+	if err != nil {
 		return handleErr(err)
 	}
 	return nil
 }
 
+// maxDownloads is the number of tracks downloaded at once.
+const maxDownloads = 16
+
 func (u Usecase) getTrack(ctx context.Context, t tracks.Track, sem <-chan struct{}) {
 	defer func() {
 		<-sem
 	}()
+	if err := u.download(ctx, t); err != nil {
+		u.l.Print(err)
+	}
+}
+
+// download saves t into a .part file that is renamed once complete and
+// checked, so an interrupted download is retried the next time.
+func (u Usecase) download(ctx context.Context, t tracks.Track) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("download %s: %w", t.ID, err)
+	}
 	filename := u.buildFileName(t)
 	exists, err := isExist(filename)
 	if err != nil {
-		u.l.Print(err)
-		return
+		return handleErr(err)
 	}
 	if exists {
 		u.l.Printf("track %q already exists", filename)
-		return
+		u.linkChannels(t, filename)
+		return nil
 	}
 	if err := u.mkdir(t); err != nil {
-		u.l.Print(err)
-		return
+		return handleErr(err)
+	}
+	if u.linkSaved(t, filename) {
+		u.linkChannels(t, filename)
+		return nil
+	}
+	partname := filename + ".part"
+	links := u.mirrors.rank(t.PrimaryLink, t.SecondaryLink)
+	var size int64
+	for len(links) > 0 {
+		var link string
+		if link, size, err = u.saveFile(ctx, links, partname); err == nil || link == "" {
+			break
+		}
+		links = remove(links, link)
 	}
-	outFile, err := os.Create(filename)
 	if err != nil {
-		u.l.Print(err)
-		return
+		if err := os.Remove(partname); err != nil && !errors.Is(err, os.ErrNotExist) {
+			u.l.Print(err)
+		}
+		return handleErr(err)
 	}
-	defer outFile.Close()
-	from, err := u.downloadFile(t.PrimaryLink)
+	if err := os.Rename(partname, filename); err != nil {
+		return handleErr(err)
+	}
+	if err := verify(filename, size); err != nil {
+		return handleErr(err)
+	}
+	u.l.Printf("saved %s", filename)
+	u.linkChannels(t, filename)
+	return nil
+}
+
+// verify checks that filename holds the size bytes downloaded, an empty
+// download is removed.
+func verify(filename string, size int64) error {
+	fi, err := os.Stat(filename)
 	if err != nil {
-		from, err = u.downloadFile(t.SecondaryLink)
-		if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("%s has %d bytes, %d were downloaded", filename, fi.Size(), size)
+	}
+	if size == 0 {
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s is empty", filename)
+	}
+	return nil
+}
+
+// linkSaved hard links filename to the file of t saved for another channel
+// it was seen on, if there is one.
+func (u Usecase) linkSaved(t tracks.Track, filename string) bool {
+	for _, m := range t.Channels {
+		if m.Channel == t.Channel {
+			continue
+		}
+		other := t
+		other.Channel = m.Channel
+		name := u.buildFileName(other)
+		if exists, err := isExist(name); err != nil {
 			u.l.Print(err)
-			return
+			continue
+		} else if !exists {
+			continue
 		}
+		if err := os.Link(name, filename); err != nil {
+			u.l.Print(err)
+			continue
+		}
+		u.l.Printf("linked %s", filename)
+		return true
+	}
+	return false
+}
+
+// linkChannels hard links the file of t into the folders of the other
+// channels it was seen on.
+func (u Usecase) linkChannels(t tracks.Track, filename string) {
+	for _, m := range t.Channels {
+		if m.Channel == t.Channel {
+			continue
+		}
+		other := t
+		other.Channel = m.Channel
+		name := u.buildFileName(other)
+		if exists, err := isExist(name); err != nil {
+			u.l.Print(err)
+			continue
+		} else if exists {
+			continue
+		}
+		if err := u.mkdir(other); err != nil {
+			u.l.Print(err)
+			continue
+		}
+		if err := os.Link(filename, name); err != nil {
+			u.l.Print(err)
+			continue
+		}
+		u.l.Printf("linked %s", name)
+	}
+}
+
+// saveFile downloads the first of links that answers into filename and
+// returns the link it used and the bytes it wrote.
+func (u Usecase) saveFile(ctx context.Context, links []string, filename string) (string, int64, error) {
+	handleErr := func(link string, err error) (string, int64, error) {
+		return link, 0, fmt.Errorf("save file: %w", err)
+	}
+	from, link, err := u.openMirror(ctx, links)
+	if err != nil {
+		return handleErr("", err)
 	}
 	defer from.Close()
-	if _, err := io.Copy(outFile, from); err != nil {
-		u.l.Print(err)
-		return
+	outFile, err := os.Create(filename)
+	if err != nil {
+		return handleErr("", err)
 	}
-	u.l.Printf("saved %s", filename)
+	began := time.Now()
+	n, err := io.Copy(outFile, from)
+	if err != nil {
+		outFile.Close()
+		if !errors.Is(err, context.Canceled) {
+			u.mirrors.failure(link, u.cfg.Download.Smoothing)
+		}
+		return handleErr(link, &tracks.TransportError{URI: link, Err: err})
+	}
+	u.mirrors.success(link, n, time.Since(began), u.cfg.Download.Smoothing)
+	if err := outFile.Close(); err != nil {
+		return handleErr("", err)
+	}
+	return link, n, nil
+}
+
+func remove(ss []string, s string) []string {
+	res := make([]string, 0, len(ss))
+	for _, v := range ss {
+		if v != s {
+			res = append(res, v)
+		}
+	}
+	return res
 }
 
 func (u Usecase) mkdir(t tracks.Track) error {
-	name := cleanFilename(t.Channel)
+	name := cleanFilename(u.folders.name(t.Channel))
 	if err := os.MkdirAll(u.cfg.DownloadsRootDir+"/"+name, 0700); errors.Is(err, os.ErrExist) {
 		return nil
 	} else if err != nil {
@@ -207,7 +544,7 @@ func isExist(name string) (bool, error) {
 }
 
 func (u Usecase) buildFileName(t tracks.Track) string {
-	channel := cleanFilename(t.Channel)
+	channel := cleanFilename(u.folders.name(t.Channel))
 	artist := cleanFilename(t.Artist)
 	album := cleanFilename(t.Album)
 	year := strconv.Itoa(t.Year)
@@ -220,17 +557,21 @@ func cleanFilename(n string) string {
 	return strings.ReplaceAll(n, "/", "_")
 }
 
-func (u Usecase) downloadFile(link string) (io.ReadCloser, error) {
+func (u Usecase) downloadFile(ctx context.Context, link string) (io.ReadCloser, error) {
 	handleErr := func(err error) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("download file: %w", err)
 	}
-	resp, err := u.c.Get(link)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
 	if err != nil {
 		return handleErr(err)
 	}
-	if resp.StatusCode != http.StatusOK {
+	resp, err := u.c.Do(req)
+	if err != nil {
+		return handleErr(&tracks.TransportError{URI: link, Err: err})
+	}
+	if err := tracks.CheckStatus(resp); err != nil {
 		resp.Body.Close()
-		return handleErr(fmt.Errorf("response status not ok: %q", resp.Status))
+		return handleErr(err)
 	}
 	return resp.Body, nil
 }
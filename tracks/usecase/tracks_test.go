@@ -0,0 +1,45 @@
+package usecase
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"accu/tracks"
+)
+
+func TestTrackWrites(t *testing.T) {
+	track := func(id, link string) tracks.Track {
+		return tracks.Track{ID: id, PrimaryLink: link, SecondaryLink: "s/" + id}
+	}
+	a, b := track("a", "p/a"), track("b", "p/b")
+	now := time.Now()
+	w := newTrackWrites(time.Hour)
+	for _, tc := range []struct {
+		name  string
+		trcks []tracks.Track
+		fresh []tracks.Track
+		after time.Duration
+		want  string
+	}{
+		// b is known from an earlier run
+		{"first sight", []tracks.Track{a, b}, []tracks.Track{a}, 0, "[a b]"},
+		{"seen again", []tracks.Track{a, b}, nil, time.Minute, "[]"},
+		{"moved link", []tracks.Track{track("a", "p2/a"), b}, nil, 2 * time.Minute, "[a]"},
+		{"back to the old link", []tracks.Track{a, b}, nil, 3 * time.Minute, "[a]"},
+		// another channel saved it meanwhile, the repo tells it is new here
+		{"fresh again", []tracks.Track{a}, []tracks.Track{a}, 4 * time.Minute, "[a]"},
+		{"last seen refreshed", []tracks.Track{a, b}, nil, time.Hour, "[b]"},
+	} {
+		at := now.Add(tc.after)
+		due := w.due(tc.trcks, tc.fresh, at)
+		ids := make([]string, 0, len(due))
+		for _, t := range due {
+			ids = append(ids, t.ID)
+		}
+		if got := fmt.Sprint(ids); got != tc.want {
+			t.Errorf("%s: saved %s, want %s", tc.name, got, tc.want)
+		}
+		w.written(due, at)
+	}
+}